@@ -2,24 +2,58 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"flag"
+	"os"
 	"strconv"
 	"time"
 
-	"github.com/libp2p/go-libp2p"
-	dht "github.com/libp2p/go-libp2p-kad-dht"
-
 	logging "github.com/ipfs/go-log/v2"
 
-	// create "mnwarm/internal/host"
+	"mnwarm/internal/health"
+	"mnwarm/internal/lifecycle"
+	"mnwarm/internal/membership"
+	"mnwarm/internal/presence"
 	cmn "mnwarm/internal/shared"
 )
 
 var log = logging.Logger("bootlog")
 
+// watchManifest re-reads the manifest file so the operator can publish a new version
+// by replacing it on any one bootstrap node, gossip takes it to the others
+func watchManifest(ctx context.Context, cluster *membership.Cluster, path string) {
+	var lastMod time.Time
+	for {
+		if info, err := os.Stat(path); err != nil {
+			log.Warnf("manifest: %v", err)
+		} else if info.ModTime() != lastMod {
+			lastMod = info.ModTime()
+			signed, err := cmn.ReadManifest(path)
+			if err == nil {
+				err = cluster.OfferManifest(signed)
+			}
+			if err != nil {
+				log.Errorf("manifest %s not served: %v", path, err)
+			}
+		}
+		select {
+		case <-time.After(30 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func main() {
 	logging.SetAllLoggers(logging.LevelError)
 	logging.SetLogLevel("bootlog", "debug")
+	logging.SetLogLevel("membershiplog", "info")
+
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(health.RunHealthcheck(os.Args[2:]))
+	}
+
+	flags := cmn.RegisterCommonFlags(flag.CommandLine)
+	flag.Parse()
 
 	portStr, keyIndexInt, bootstrapAddrs, err := cmn.ParseCmdArgs()
 	nodeOpt, err := cmn.GetLibp2pIdentity(keyIndexInt)
@@ -29,23 +63,46 @@ func main() {
 		log.Fatal(err)
 	}
 
-	ctx := context.Background()
-	// nodeType := create.Bootstrap
-	//XLF2ipQ4jD3U
-	// host, _, err := create.CreateHost(ctx, nodeType, nil, listenPort)
-	host, err := libp2p.New(
-		nodeOpt,
-		libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", listenPort)),
-		// libp2p.EnableRelay(),
-		libp2p.NATPortMap(),
-		libp2p.EnableNATService(),
-		libp2p.EnableAutoNATv2(),
-		libp2p.EnableHolePunching(),
-		libp2p.ForceReachabilityPublic(),
-	)
+	lc := lifecycle.New(flags.DrainTimeout)
+	ctx := lc.Context()
+
+	checker := health.NewChecker()
+	if flags.HealthAddr != "" {
+		stopProbes, err := checker.Serve(flags.HealthAddr)
+		if err != nil {
+			log.Fatalf("could not serve health probes: %v", err)
+		}
+		lc.OnShutdown("stop health probes", stopProbes)
+	}
+
+	hostCfg := cmn.BootstrapHostConfig(listenPort)
+	hostCfg.Identity = nodeOpt
+	if hostCfg.Store, err = flags.OpenStore(); err != nil {
+		log.Fatal(err)
+	}
+	if hostCfg.Store != nil {
+		lc.OnShutdown("close datastore", func(context.Context) error {
+			return hostCfg.Store.Close()
+		})
+	}
+	if err := flags.ApplyHost(&hostCfg); err != nil {
+		log.Fatal(err)
+	}
+	host, kademliaDHT, err := cmn.NewHost(ctx, hostCfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	lc.OnShutdown("close host", func(context.Context) error {
+		return host.Close()
+	})
+	lc.OnShutdown("close dht", func(context.Context) error {
+		return kademliaDHT.Close()
+	})
+	if hostCfg.Store != nil {
+		lc.OnShutdown("save routing table", func(ctx context.Context) error {
+			return hostCfg.Store.SaveRoutingTable(ctx, kademliaDHT)
+		})
+	}
 
 	log.Infof("bootstrap up pid %s", host.ID())
 	log.Info("listening on:")
@@ -53,20 +110,64 @@ func main() {
 		log.Infof("%s/p2p/%s", addr, host.ID())
 	}
 
-	kademliaDHT, err := dht.New(ctx, host, dht.Mode(dht.ModeServer))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	bootstrapPeers, err := cmn.ParseBootstrap(bootstrapAddrs)
+	bootstrapPeers, err := cmn.ResolveBootstrapPeers(bootstrapAddrs, flags.BootstrapList, flags.OperatorKey)
 	if len(bootstrapPeers) == 0 {
 		log.Warn("no valid bootstrap addrs")
 	}
 
+	cmn.ProtectInfrastructure(host.ConnManager(), bootstrapPeers...)
+	// trim the peers that misbehave first once the connection manager is full
+	if err := cmn.NewPeerScorer(host.ConnManager()).Watch(ctx, host); err != nil {
+		log.Fatal(err)
+	}
 	cmn.ConnectToBootstrapPeers(ctx, host, bootstrapPeers)
 	cmn.BootstrapDHT(ctx, kademliaDHT)
 
-	time.Sleep(2 * time.Second)
+	// gossip with the other bootstrap nodes and answer peer exchange, so any one of
+	// us is enough for a new node to find the rest of the infrastructure
+	var clusterOpts []membership.Option
+	if flags.OperatorKey != "" {
+		operatorKey, err := cmn.DecodeOperatorKey(flags.OperatorKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clusterOpts = append(clusterOpts, membership.WithManifest(operatorKey))
+	}
+	cluster := membership.NewCluster(host, cmn.NewPeerClassifier(host), clusterOpts...)
+	cluster.Join(bootstrapPeers...)
+	cluster.Start(ctx)
+	// runners and clients are connected to us rather than to each other, so runner
+	// presence reaches clients through the bootstrap nodes
+	ps, err := presence.NewGossipSub(ctx, host)
+	if err != nil {
+		log.Fatal(err)
+	}
+	presenceChannel, err := presence.Join(host, ps)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := presenceChannel.Relay(); err != nil {
+		log.Fatal(err)
+	}
+
+	if flags.Manifest != "" {
+		if flags.OperatorKey == "" {
+			log.Fatal("-manifest needs -operator-key")
+		}
+		go watchManifest(ctx, cluster, flags.Manifest)
+	}
+
+	// the first bootstrap node up has nobody to find yet, so it is ready with an empty
+	// routing table and only the others wait for theirs
+	minRoutingPeers := 0
+	if len(bootstrapPeers) > 0 {
+		ready := flags.Readiness()
+		minRoutingPeers = ready.MinRoutingPeers
+		if err := cmn.WaitForRoutingTable(ctx, kademliaDHT, ready.MinRoutingPeers, ready.RoutingTableTimeout); err != nil {
+			log.Warnf("starting without a routing table: %v", err)
+		}
+	}
+	checker.Add("dht", health.RoutingTableCheck(kademliaDHT, minRoutingPeers))
 
 	log.Infof("running pid %s", host.ID())
 	log.Info("use multiaddrs to connect:")
@@ -74,15 +175,7 @@ func main() {
 		log.Infof("%s/p2p/%s", addr, host.ID())
 	}
 
-	// go func() {
-	// 	for {
-	// 		time.Sleep(30 * time.Second)
-	// 		kademliaDHT.RefreshRoutingTable() //has a channel to block, but unused for now
-	// 		peers := kademliaDHT.RoutingTable().ListPeers()
-	// 		log.Infof("dht routing table peers (%d): %v", len(peers), peers)
-	// 		log.Infof("network peers, %s, peerstore peers, %s", host.Network().Peers(), host.Peerstore().Peers())
-	// 	}
-	// }()
-
-	select {}
+	if err := lc.Wait(); err != nil {
+		log.Errorf("shutdown: %v", err)
+	}
 }
@@ -2,18 +2,50 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
+
+	cmn "mnwarm/internal/shared"
 )
 
 // go run keys.go -n 3
+// go run keys.go -sign <operator private key> /ip4/.../p2p/... /ip4/.../p2p/...
+// go run keys.go -sign <operator private key> -manifest manifest.json > manifest.signed.json
+// go run keys.go -swarm-key > swarm.key
 func main() {
 	var n int
+	var signKey string
+	var swarmKey bool
+	var manifest string
 	flag.IntVar(&n, "n", 10, "number of keys to be generated")
+	flag.StringVar(&signKey, "sign", "", "operator private key, signs the bootstrap addrs given as args")
+	flag.StringVar(&manifest, "manifest", "", "with -sign, sign this unsigned network manifest json instead of bootstrap addrs")
+	flag.BoolVar(&swarmKey, "swarm-key", false, "generate a private network swarm.key")
 	flag.Parse()
 
+	if swarmKey {
+		key, err := cmn.GenerateSwarmKey()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Print(key)
+		return
+	}
+
+	if signKey != "" && manifest != "" {
+		signManifest(signKey, manifest)
+		return
+	}
+	if signKey != "" {
+		signBootstrapList(signKey, flag.Args())
+		return
+	}
+
 	for i := 0; i < n; i++ {
 		priv, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
 		if err != nil {
@@ -29,3 +61,61 @@ func main() {
 		fmt.Println(encoded)
 	}
 }
+
+func operatorKey(keyStr string) crypto.PrivKey {
+	keyBytes, err := crypto.ConfigDecodeKey(keyStr)
+	if err != nil {
+		panic(err)
+	}
+	priv, err := crypto.UnmarshalPrivateKey(keyBytes)
+	if err != nil {
+		panic(err)
+	}
+
+	pubBytes, err := crypto.MarshalPublicKey(priv.GetPublic())
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(os.Stderr, "operator key: %s\n", crypto.ConfigEncodeKey(pubBytes))
+	return priv
+}
+
+func signManifest(keyStr string, path string) {
+	priv := operatorKey(keyStr)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	var m cmn.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		panic(err)
+	}
+	if m.Issued.IsZero() {
+		m.Issued = time.Now().UTC()
+	}
+	signed, err := cmn.SignManifest(&m, priv)
+	if err != nil {
+		panic(err)
+	}
+	out, err := json.MarshalIndent(signed, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(out))
+}
+
+func signBootstrapList(keyStr string, addrs []string) {
+	priv := operatorKey(keyStr)
+
+	list, err := cmn.SignBootstrapList(addrs, priv)
+	if err != nil {
+		panic(err)
+	}
+	out, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(string(out))
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"mnwarm/internal/lifecycle"
+	"mnwarm/pkg/client"
+
+	cmn "mnwarm/internal/shared"
+)
+
+// globalFlags come before the command name
+type globalFlags struct {
+	common    *cmn.CommonFlags
+	relay     string
+	keyIndex  int
+	bootstrap string
+	json      bool
+	verbose   bool
+}
+
+func registerGlobalFlags(fs *flag.FlagSet) *globalFlags {
+	g := &globalFlags{common: cmn.RegisterCommonFlags(fs)}
+	fs.StringVar(&g.relay, "relay", "", "relay multiaddr, /ip4/.../p2p/<relay id>")
+	fs.IntVar(&g.keyIndex, "key-index", -1, "index of our identity key, negative for an ephemeral identity")
+	fs.StringVar(&g.bootstrap, "bootstrap", "", "comma separated bootstrap multiaddrs")
+	fs.BoolVar(&g.json, "json", false, "print JSON instead of tables")
+	fs.BoolVar(&g.verbose, "v", false, "log libp2p and protocol activity to stderr")
+	return g
+}
+
+func (g *globalFlags) config() *client.Config {
+	cfg := client.NewConfig()
+	cfg.Relay = g.relay
+	cfg.Bootstrap = g.bootstrap
+	cfg.BootstrapList = g.common.BootstrapList
+	cfg.OperatorKey = g.common.OperatorKey
+	cfg.KeyIndex = g.keyIndex
+	cfg.ReadyTimeoutMs = int(g.common.ReadyTimeout.Milliseconds())
+	cfg.HealthAddr = g.common.HealthAddr
+	cfg.DataDir = g.common.DataDir
+	cfg.Transports = g.common.Transports
+	cfg.Security = g.common.Security
+	cfg.Reachability = g.common.Reachability
+	return cfg
+}
+
+// env is what a command runs with
+type env struct {
+	client *client.Client
+	out    *printer
+	lc     *lifecycle.Manager
+}
+
+type runFunc func(ctx context.Context, e *env, args []string) error
+
+type command struct {
+	name    string
+	args    string
+	help    string
+	minArgs int
+	maxArgs int
+	// setup registers the command flags and returns what runs once they are parsed,
+	// flags that shape the client are bound into cfg
+	setup func(fs *flag.FlagSet, cfg *client.Config) runFunc
+}
+
+var commands = []command{
+	{name: "discover", help: "list runners and what they advertise", setup: discoverCmd},
+	{name: "available", help: "list runners with a free slot as they announce themselves", setup: availableCmd},
+	{name: "info", args: "<peer>", help: "show the info a runner reports", minArgs: 1, maxArgs: 1, setup: infoCmd},
+	{name: "status", args: "<peer>", help: "show the stream status of a runner", minArgs: 1, maxArgs: 1, setup: statusCmd},
+	{name: "start", args: "[peer]", help: "start a stream, on the best runner when no peer is given", maxArgs: 1, setup: startCmd},
+	{name: "stop", args: "<peer>", help: "stop the stream on a runner", minArgs: 1, maxArgs: 1, setup: stopCmd},
+	{name: "watch", help: "follow runners as they come and go", setup: watchCmd},
+	{name: "diagnose", help: "report how we get through our NAT", setup: diagnoseCmd},
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// parse reads the command flags, they may come before or after the positional args
+func (c command) parse(args []string, cfg *client.Config) (runFunc, []string, error) {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: mobile_client [global flags] %s [flags] %s\n", c.name, c.args)
+		fs.PrintDefaults()
+	}
+	run := c.setup(fs, cfg)
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if len(positional) < c.minArgs || len(positional) > c.maxArgs {
+		fs.Usage()
+		return nil, nil, fmt.Errorf("%s takes %s", c.name, c.args)
+	}
+	return run, positional, nil
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "usage: mobile_client [global flags] <command> [flags] [args]")
+	fmt.Fprintln(out, "\ncommands:")
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", c.name, c.args, c.help)
+	}
+	fmt.Fprintln(w, "  healthcheck\tprobe a running client, see healthcheck -h")
+	w.Flush()
+	fmt.Fprintln(out, "\nglobal flags:")
+	flag.PrintDefaults()
+}
+
+// streamFlags identify a stream to the runner
+type streamFlags struct {
+	dev string
+	key string
+}
+
+func (s *streamFlags) register(fs *flag.FlagSet, cfg *client.Config) {
+	fs.StringVar(&cfg.Project, "project", "", "project id")
+	fs.StringVar(&s.dev, "dev", "", "developer id")
+	fs.StringVar(&s.key, "key", "", "api key")
+}
+
+func (s *streamFlags) request(runner, project string) *client.StreamRequest {
+	req := client.NewStreamRequest(project)
+	req.Runner = runner
+	req.DevID = s.dev
+	req.APIKey = s.key
+	return req
+}
+
+// persistentIdentity checks we have the identity a runner knows our session by, an
+// ephemeral one can't stop a session started earlier and leaves the runner busy
+func persistentIdentity(cfg *client.Config, what string) error {
+	if cfg.KeyIndex < 0 {
+		return fmt.Errorf("%s needs a persistent identity, pass -key-index", what)
+	}
+	return nil
+}
+
+// optFlag collects repeated -opt k=v into a map
+type optFlag map[string]string
+
+func (o optFlag) String() string {
+	pairs := make([]string, 0, len(o))
+	for k, v := range o {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (o optFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("want k=v, got %q", s)
+	}
+	o[k] = v
+	return nil
+}
+
+// printer writes command results either as tables or as one JSON document per result
+type printer struct {
+	json bool
+	w    io.Writer
+}
+
+func (p *printer) emit(v any, human func(w io.Writer)) error {
+	if p.json {
+		return json.NewEncoder(p.w).Encode(v)
+	}
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	human(tw)
+	return tw.Flush()
+}
+
+type runnerView struct {
+	Peer      string   `json:"peer"`
+	Projects  []string `json:"projects,omitempty"`
+	Region    string   `json:"region,omitempty"`
+	Capacity  int      `json:"capacity"`
+	Sessions  int      `json:"sessions"`
+	Relayed   bool     `json:"relayed"`
+	LatencyMs int64    `json:"latency_ms"`
+	Score     float64  `json:"score"`
+}
+
+func newRunnerView(r *client.Runner) runnerView {
+	var projects []string
+	if r.Projects != "" {
+		projects = strings.Split(r.Projects, ",")
+	}
+	return runnerView{
+		Peer:      r.ID,
+		Projects:  projects,
+		Region:    r.Region,
+		Capacity:  r.Capacity,
+		Sessions:  r.Sessions,
+		Relayed:   r.Relayed,
+		LatencyMs: r.LatencyMs,
+		Score:     r.Score,
+	}
+}
+
+func printRunnerRow(w io.Writer, v runnerView) {
+	projects := strings.Join(v.Projects, ",")
+	if projects == "" {
+		projects = "*"
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%d/%d\t%v\t%dms\t%.1f\n",
+		v.Peer, projects, v.Region, v.Sessions, v.Capacity, v.Relayed, v.LatencyMs, v.Score)
+}
+
+func discoverCmd(fs *flag.FlagSet, cfg *client.Config) runFunc {
+	fs.StringVar(&cfg.Project, "project", "", "only list runners serving this project")
+	timeout := fs.Duration("timeout", client.DiscoverTimeout, "how long to look for runners")
+	return func(ctx context.Context, e *env, args []string) error {
+		ctx, cancel := context.WithTimeout(ctx, *timeout)
+		defer cancel()
+		runners, err := e.client.Discover(ctx)
+		if err != nil {
+			return err
+		}
+
+		views := make([]runnerView, 0, runners.Len())
+		for i := 0; i < runners.Len(); i++ {
+			views = append(views, newRunnerView(runners.Get(i)))
+		}
+		return e.out.emit(views, func(w io.Writer) {
+			fmt.Fprint(w, "PEER\tPROJECTS\tREGION\tSESSIONS\tRELAYED\tLATENCY\tSCORE\n")
+			for _, v := range views {
+				printRunnerRow(w, v)
+			}
+		})
+	}
+}
+
+func availableCmd(fs *flag.FlagSet, cfg *client.Config) runFunc {
+	fs.StringVar(&cfg.Project, "project", "", "only list runners serving this project")
+	wait := fs.Duration("wait", 12*time.Second, "how long to listen for runner announcements")
+	return func(ctx context.Context, e *env, args []string) error {
+		select {
+		case <-time.After(*wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		runners := e.client.Available()
+
+		views := make([]runnerView, 0, runners.Len())
+		for i := 0; i < runners.Len(); i++ {
+			views = append(views, newRunnerView(runners.Get(i)))
+		}
+		return e.out.emit(views, func(w io.Writer) {
+			fmt.Fprint(w, "PEER\tPROJECTS\tREGION\tSESSIONS\tRELAYED\tLATENCY\tSCORE\n")
+			for _, v := range views {
+				printRunnerRow(w, v)
+			}
+		})
+	}
+}
+
+func infoCmd(fs *flag.FlagSet, cfg *client.Config) runFunc {
+	return func(ctx context.Context, e *env, args []string) error {
+		info, err := e.client.Info(ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		v := struct {
+			Peer          string            `json:"peer"`
+			HostID        string            `json:"host_id"`
+			PublicIP      string            `json:"public_ip,omitempty"`
+			PrivateIP     string            `json:"private_ip,omitempty"`
+			IsPublic      bool              `json:"is_public"`
+			ClientVersion string            `json:"client_version"`
+			SystemConfig  map[string]string `json:"system_config,omitempty"`
+			Relayed       bool              `json:"relayed"`
+			RTTMs         int64             `json:"rtt_ms"`
+		}{info.ID, info.HostID, info.PublicIP, info.PrivateIP, info.IsPublic, info.ClientVersion, info.SystemConfig, info.Relayed, info.RTTMs}
+		return e.out.emit(v, func(w io.Writer) {
+			fmt.Fprintf(w, "peer\t%s\n", v.Peer)
+			fmt.Fprintf(w, "host id\t%s\n", v.HostID)
+			fmt.Fprintf(w, "public ip\t%s\n", v.PublicIP)
+			fmt.Fprintf(w, "private ip\t%s\n", v.PrivateIP)
+			fmt.Fprintf(w, "public\t%v\n", v.IsPublic)
+			fmt.Fprintf(w, "version\t%s\n", v.ClientVersion)
+			fmt.Fprintf(w, "relayed\t%v\n", v.Relayed)
+			fmt.Fprintf(w, "rtt\t%dms\n", v.RTTMs)
+			keys := make([]string, 0, len(v.SystemConfig))
+			for k := range v.SystemConfig {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Fprintf(w, "config %s\t%s\n", k, v.SystemConfig[k])
+			}
+		})
+	}
+}
+
+type streamView struct {
+	Peer          string `json:"peer"`
+	IsStreaming   bool   `json:"is_streaming"`
+	StatusMessage string `json:"status_message,omitempty"`
+}
+
+func (v streamView) print(w io.Writer) {
+	fmt.Fprintf(w, "peer\t%s\n", v.Peer)
+	fmt.Fprintf(w, "streaming\t%v\n", v.IsStreaming)
+	if v.StatusMessage != "" {
+		fmt.Fprintf(w, "status\t%s\n", v.StatusMessage)
+	}
+}
+
+func statusCmd(fs *flag.FlagSet, cfg *client.Config) runFunc {
+	var sf streamFlags
+	sf.register(fs, cfg)
+	return func(ctx context.Context, e *env, args []string) error {
+		session, err := e.client.AttachSession(ctx, sf.request(args[0], cfg.Project))
+		if err != nil {
+			return err
+		}
+		status, err := session.Status(ctx)
+		if err != nil {
+			return err
+		}
+		v := streamView{Peer: session.Runner(), IsStreaming: status.IsStreaming, StatusMessage: status.StatusMessage}
+		return e.out.emit(v, v.print)
+	}
+}
+
+func startCmd(fs *flag.FlagSet, cfg *client.Config) runFunc {
+	var sf streamFlags
+	sf.register(fs, cfg)
+	issue := fs.String("issue", "", "issue the stream is needed for")
+	opts := optFlag{}
+	fs.Var(opts, "opt", "config option k=v, repeatable")
+	hold := fs.Bool("hold", true, "keep the stream until interrupted, then stop it. -hold=false leaves it to a later stop with the same -key-index")
+	return func(ctx context.Context, e *env, args []string) error {
+		if cfg.Project == "" {
+			return errors.New("-project is required")
+		}
+		if !*hold {
+			if err := persistentIdentity(cfg, "start -hold=false"); err != nil {
+				return err
+			}
+		}
+		runner := ""
+		if len(args) == 1 {
+			runner = args[0]
+		}
+		req := sf.request(runner, cfg.Project)
+		req.IssueNeed = *issue
+		for k, v := range opts {
+			req.SetOption(k, v)
+		}
+
+		session, err := e.client.StartStream(ctx, req)
+		if err != nil {
+			return err
+		}
+		v := streamView{Peer: session.Runner(), IsStreaming: true, StatusMessage: session.StatusMessage}
+		if err := e.out.emit(v, v.print); err != nil {
+			return err
+		}
+		if !*hold {
+			return nil
+		}
+
+		e.lc.OnShutdown("stop active stream", session.Stop)
+		<-ctx.Done()
+		return nil
+	}
+}
+
+func stopCmd(fs *flag.FlagSet, cfg *client.Config) runFunc {
+	var sf streamFlags
+	sf.register(fs, cfg)
+	return func(ctx context.Context, e *env, args []string) error {
+		if err := persistentIdentity(cfg, "stop"); err != nil {
+			return err
+		}
+		session, err := e.client.AttachSession(ctx, sf.request(args[0], cfg.Project))
+		if err != nil {
+			return err
+		}
+		if err := session.Stop(ctx); err != nil {
+			return err
+		}
+		v := streamView{Peer: session.Runner(), IsStreaming: false, StatusMessage: "STREAM_STOPPED"}
+		return e.out.emit(v, v.print)
+	}
+}
+
+type watchEvent struct {
+	Time   time.Time   `json:"time"`
+	Event  string      `json:"event"`
+	Peer   string      `json:"peer"`
+	Runner *runnerView `json:"runner,omitempty"`
+}
+
+// watchPrinter prints runner events as they arrive
+type watchPrinter struct {
+	out *printer
+	err error
+}
+
+func (p *watchPrinter) emit(ev watchEvent) {
+	if p.err != nil {
+		return
+	}
+	p.err = p.out.emit(ev, func(w io.Writer) {
+		fmt.Fprintf(w, "%s\t%s\t%s", ev.Time.Format(time.TimeOnly), ev.Event, ev.Peer)
+		if r := ev.Runner; r != nil {
+			fmt.Fprintf(w, "\tprojects=%s region=%s sessions=%d/%d relayed=%v latency=%dms",
+				strings.Join(r.Projects, ","), r.Region, r.Sessions, r.Capacity, r.Relayed, r.LatencyMs)
+		}
+		fmt.Fprintln(w)
+	})
+}
+
+func (p *watchPrinter) OnRunner(r *client.Runner) {
+	v := newRunnerView(r)
+	p.emit(watchEvent{Time: time.Now(), Event: "discovered", Peer: r.ID, Runner: &v})
+}
+
+func (p *watchPrinter) OnRunnerLost(id string) {
+	p.emit(watchEvent{Time: time.Now(), Event: "lost", Peer: id})
+}
+
+func watchCmd(fs *flag.FlagSet, cfg *client.Config) runFunc {
+	fs.StringVar(&cfg.Project, "project", "", "only follow runners serving this project")
+	return func(ctx context.Context, e *env, args []string) error {
+		p := &watchPrinter{out: e.out}
+		if err := e.client.Watch(ctx, p); err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		}
+		return p.err
+	}
+}
+
+func diagnoseCmd(fs *flag.FlagSet, cfg *client.Config) runFunc {
+	wait := fs.Duration("wait", 5*time.Second, "how long to let peers observe us before reporting")
+	return func(ctx context.Context, e *env, args []string) error {
+		select {
+		case <-time.After(*wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		raw, err := e.client.Diagnose(ctx)
+		if err != nil {
+			return err
+		}
+		var report cmn.NATReport
+		if err := json.Unmarshal([]byte(raw), &report); err != nil {
+			return err
+		}
+		return e.out.emit(report, func(w io.Writer) { printNATReport(w, report) })
+	}
+}
+
+func printNATReport(w io.Writer, r cmn.NATReport) {
+	fmt.Fprintf(w, "peer\t%s\n", r.Peer)
+	fmt.Fprintf(w, "reachability\t%s\n", r.Reachability)
+	fmt.Fprintf(w, "nat mapping\t%s\n", r.Mapping)
+	for _, a := range r.ListenAddrs {
+		fmt.Fprintf(w, "listen\t%s\n", a)
+	}
+	for _, a := range r.Addrs {
+		fmt.Fprintf(w, "addr\t%s\n", a)
+	}
+	for _, o := range r.Observed {
+		fmt.Fprintf(w, "observed\t%s\t%d peers\n", o.Addr, o.Observers)
+	}
+	for _, c := range r.AutoNAT {
+		if c.Error != "" {
+			fmt.Fprintf(w, "autonat\t%s\t%s\n", c.Addr, c.Error)
+		} else {
+			fmt.Fprintf(w, "autonat\t%s\t%s (%s)\n", c.Addr, c.Reachability, c.DialStatus)
+		}
+	}
+	fmt.Fprintf(w, "port mapping\tenabled %v, nat discovered %v\n", r.PortMapping.Enabled, r.PortMapping.NATDiscovered)
+	for _, m := range r.PortMapping.Mappings {
+		external := m.External
+		if external == "" {
+			external = "not mapped"
+		}
+		fmt.Fprintf(w, "mapped\t%s\t%s\n", m.Internal, external)
+	}
+	for _, rl := range r.Relays {
+		fmt.Fprintf(w, "relay\t%s\tconnected %v, reserved %v\n", rl.Relay, rl.Connected, rl.Reserved)
+	}
+	for _, hp := range r.HolePunches {
+		result := "running"
+		switch {
+		case hp.Done && hp.Success:
+			result = "ok"
+		case hp.Done:
+			result = "failed: " + hp.Error
+		}
+		if hp.RelayClosed && !hp.Direct {
+			result += ", stuck on relay"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", hp.Type, hp.Peer, hp.Started.Format(time.RFC3339), hp.Elapsed.Round(time.Millisecond), result)
+	}
+	if st := r.HolePunchStats; st != nil {
+		fmt.Fprintf(w, "hole punches\t%d started, %d succeeded, %d stuck on relay\n", st.Total.Attempts, st.Total.Successes, st.Total.StuckOnRelay)
+		nats := make([]string, 0, len(st.ByNAT))
+		for nat := range st.ByNAT {
+			nats = append(nats, nat)
+		}
+		sort.Strings(nats)
+		for _, nat := range nats {
+			s := st.ByNAT[nat]
+			fmt.Fprintf(w, "behind %s\t%d started, %d succeeded, %d stuck on relay\n", nat, s.Attempts, s.Successes, s.StuckOnRelay)
+		}
+	}
+}
+
+// runCommand joins the network, runs the command and shuts down once it returns
+func runCommand(g *globalFlags, cfg *client.Config, run runFunc, args []string) error {
+	lc := lifecycle.New(g.common.DrainTimeout)
+	ctx := lc.Context()
+
+	errc := make(chan error, 1)
+	go func() {
+		defer lc.Shutdown()
+		c, err := client.New(cfg)
+		if err != nil {
+			errc <- err
+			return
+		}
+		lc.OnShutdown("close client", func(context.Context) error {
+			return c.Close()
+		})
+		errc <- run(ctx, &env{client: c, out: &printer{json: g.json, w: os.Stdout}, lc: lc}, args)
+	}()
+
+	if err := lc.Wait(); err != nil {
+		log.Errorf("shutdown: %v", err)
+	}
+	select {
+	case err := <-errc:
+		return err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"mnwarm/pkg/runner"
+)
+
+// runDiagnose asks a running node runner for its NAT report over the control socket
+// and prints it as JSON
+func runDiagnose(args []string) int {
+	fs := flag.NewFlagSet("diagnose", flag.ContinueOnError)
+	socket := fs.String("control-socket", "", "control socket of the running runner, see -control-socket")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long the report may take")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *socket == "" {
+		fmt.Println("diagnose: -control-socket is required")
+		return 2
+	}
+
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", *socket)
+		},
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://runner"+runner.ControlDiagnosePath, nil)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
@@ -6,28 +6,29 @@ import (
 	"flag"
 	"fmt" // Added import for io
 	"io"
+	"os"
 	"strings"
 	"time"
 
-	// tptu "github.com/libp2p/go-libp2p/p2p/net/upgrader"
-	noise "github.com/libp2p/go-libp2p/p2p/security/noise"
-
 	dht "github.com/libp2p/go-libp2p-kad-dht"
-	"github.com/libp2p/go-libp2p/config"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/peerstore"
 	"github.com/libp2p/go-libp2p/core/protocol"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
 
 	logging "github.com/ipfs/go-log/v2"
 	libp2p "github.com/libp2p/go-libp2p"
 
-	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
 	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
 	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
 
+	discovery "mnwarm/internal/discovery"
+	"mnwarm/internal/health"
+	"mnwarm/internal/lifecycle"
+	"mnwarm/internal/membership"
 	cmn "mnwarm/internal/shared"
 
 	multiaddr "github.com/multiformats/go-multiaddr"
@@ -112,59 +113,6 @@ func getRelayIdentity(keyIndex int) libp2p.Option {
 	return relayOpt
 }
 
-func createHost(ctx context.Context, relayOpt libp2p.Option, listenPort int) host.Host {
-	ListenAddrs := func(cfg *config.Config) error {
-		addrs := []string{
-			fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", listenPort),
-			"/ip6/::/tcp/0",
-		}
-		listenAddrs := make([]multiaddr.Multiaddr, 0, len(addrs))
-
-		for _, s := range addrs {
-			addr, err := multiaddr.NewMultiaddr(s)
-			if err != nil {
-				return err
-			}
-			listenAddrs = append(listenAddrs, addr)
-		}
-
-		return cfg.Apply(libp2p.ListenAddrs(listenAddrs...))
-	}
-
-	rcmgr, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(rcmgr.InfiniteLimits))
-	if err != nil {
-		log.Fatalf("could not create new resource manager: %w", err)
-	}
-
-	host, err := libp2p.New(
-		relayOpt,
-		ListenAddrs,
-		libp2p.EnableRelay(),
-		libp2p.EnableRelayService(relay.WithInfiniteLimits()), // do a config with limited istead?
-		libp2p.NATPortMap(),
-		libp2p.EnableNATService(),
-		libp2p.EnableAutoNATv2(),
-		libp2p.EnableHolePunching(),
-		libp2p.ForceReachabilityPublic(),
-		libp2p.Security(noise.ID, noise.New),
-		// libp2p.Security(
-		// 	noise.ID,
-		// 	func(id protocol.ID, privkey crypto.PrivKey, muxers []tptu.StreamMuxer) (*noise.SessionTransport, error) {
-		// 		tp, err := noise.New(id, privkey, muxers)
-		// 		if err != nil {
-		// 			return nil, err
-		// 		}
-		// 		return tp.WithSessionOptions(noise.Prologue(prologue))
-		// 	},
-		// ),
-		libp2p.ResourceManager(rcmgr),
-	)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return host
-}
-
 func setupRelayService(host host.Host) (*relay.Relay, relay.MetricsTracer) {
 	mt := relay.NewMetricsTracer()
 	log.Debugf("Relay timeouts: %d %d %d",
@@ -193,14 +141,6 @@ func logHostInfo(host host.Host) {
 	}
 }
 
-func createDHT(ctx context.Context, host host.Host) *dht.IpfsDHT {
-	kademliaDHT, err := dht.New(ctx, host, dht.Mode(dht.ModeServer))
-	if err != nil {
-		log.Fatal(err)
-	}
-	return kademliaDHT
-}
-
 func bootstrapDHT(ctx context.Context, kademliaDHT *dht.IpfsDHT) {
 	log.Info("Bootstrapping DHT")
 	if err := kademliaDHT.Bootstrap(ctx); err != nil {
@@ -241,10 +181,14 @@ func connectToBootstrapPeers(ctx context.Context, host host.Host, bootstrapPeers
 	}
 }
 
-func setupDHTRefresh(kademliaDHT *dht.IpfsDHT) {
+func setupDHTRefresh(ctx context.Context, kademliaDHT *dht.IpfsDHT) {
 	go func() {
 		for {
-			time.Sleep(60 * time.Second)
+			select {
+			case <-time.After(60 * time.Second):
+			case <-ctx.Done():
+				return
+			}
 			kademliaDHT.RefreshRoutingTable()
 			peers := kademliaDHT.RoutingTable().ListPeers()
 			log.Infof("Routing table peers (%d): %v", len(peers), peers)
@@ -309,7 +253,13 @@ func main() {
 	initializeLogger()
 	identify.ActivationThresh = 1
 
-	cmn.ParseCmdArgs()
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(health.RunHealthcheck(os.Args[2:]))
+	}
+
+	flags := cmn.RegisterCommonFlags(flag.CommandLine)
+	flag.Parse()
+
 	relayAddrStr, keyIndexInt, bootstrapAddrs, err := cmn.ParseCmdArgs()
 	log.Infof("%v, %v, %v ", relayAddrStr, keyIndexInt, bootstrapAddrs)
 	listenPort := 1240
@@ -321,32 +271,104 @@ func main() {
 	if err != nil {
 		log.Errorf("error in startup %v", err)
 	}
-	ctx := context.Background()
+	lc := lifecycle.New(flags.DrainTimeout)
+	ctx := lc.Context()
 
-	host := createHost(ctx, nodeOpt, listenPort)
+	checker := health.NewChecker()
+	if flags.HealthAddr != "" {
+		stopProbes, err := checker.Serve(flags.HealthAddr)
+		if err != nil {
+			log.Fatalf("could not serve health probes: %v", err)
+		}
+		lc.OnShutdown("stop health probes", stopProbes)
+	}
+
+	hostCfg := cmn.RelayHostConfig(listenPort)
+	hostCfg.Identity = nodeOpt
+	// setupRelayService runs the relay service with metrics and closes it on shutdown,
+	// a second one from the host would compete for the hop protocol
+	hostCfg.RelayService = false
+	if hostCfg.Store, err = flags.OpenStore(); err != nil {
+		log.Fatal(err)
+	}
+	if hostCfg.Store != nil {
+		lc.OnShutdown("close datastore", func(context.Context) error {
+			return hostCfg.Store.Close()
+		})
+	}
+	if err := flags.ApplyHost(&hostCfg); err != nil {
+		log.Fatal(err)
+	}
+	host, kademliaDHT, err := cmn.NewHost(ctx, hostCfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	lc.OnShutdown("close host", func(context.Context) error {
+		return host.Close()
+	})
+	lc.OnShutdown("close dht", func(context.Context) error {
+		return kademliaDHT.Close()
+	})
+	if hostCfg.Store != nil {
+		lc.OnShutdown("save routing table", func(ctx context.Context) error {
+			return hostCfg.Store.SaveRoutingTable(ctx, kademliaDHT)
+		})
+	}
 
 	relayService, metrics := setupRelayService(host)
 
 	log.Info(relayService, metrics)
 	logHostInfo(host)
 
-	kademliaDHT := createDHT(ctx, host)
+	// closing the relay service drops every reservation and circuit it holds
+	lc.OnShutdown("close relay service", func(context.Context) error {
+		return relayService.Close()
+	})
 
 	bootstrapDHT(ctx, kademliaDHT)
 
-	bootstrapPeers, err := cmn.ParseBootstrap(bootstrapAddrs)
+	bootstrapPeers, err := cmn.ResolveBootstrapPeers(bootstrapAddrs, flags.BootstrapList, flags.OperatorKey)
 	if len(bootstrapPeers) == 0 {
 		log.Fatal("no valid bootstrap addrs")
 	}
 
-	cmn.ConnectToBootstrapPeers(ctx, host, bootstrapPeers)
-	// connectToBootstrapPeers(ctx, host, bootstrapPeers)
+	cmn.ProtectInfrastructure(host.ConnManager(), bootstrapPeers...)
+	// trim the peers that misbehave first once the connection manager is full
+	if err := cmn.NewPeerScorer(host.ConnManager()).Watch(ctx, host); err != nil {
+		log.Fatal(err)
+	}
+	ready := flags.Readiness()
+	checker.Add("bootstrap", health.BootstrapCheck(host, bootstrapPeers))
+	checker.Add("routing_table", health.RoutingTableCheck(kademliaDHT, ready.MinRoutingPeers))
+	checker.Add("relay_service", health.RelayServiceCheck(host))
 
-	time.Sleep(5 * time.Second)
+	if err := cmn.WaitForBootstrap(ctx, host, bootstrapPeers, ready.BootstrapTimeout); err != nil {
+		log.Fatalf("not ready: %v", err)
+	}
+	if px, err := membership.Expand(ctx, host, bootstrapPeers); err != nil {
+		log.Warnf("peer exchange failed, using the configured bootstrap peers: %v", err)
+	} else {
+		log.Infof("%d bootstrap nodes, %d relays and %d runners known", len(px.Bootstraps), len(px.Relays), len(px.Runners))
+	}
+	if flags.OperatorKey != "" {
+		operatorKey, err := cmn.DecodeOperatorKey(flags.OperatorKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the relay only needs the bootstrap nodes of the manifest, the watcher handles them
+		membership.NewManifestWatcher(host, operatorKey, time.Minute).Start(ctx)
+	}
+	// connectToBootstrapPeers(ctx, host, bootstrapPeers)
+	if err := cmn.WaitForRoutingTable(ctx, kademliaDHT, ready.MinRoutingPeers, ready.RoutingTableTimeout); err != nil {
+		log.Fatalf("not ready: %v", err)
+	}
 
 	logHostInfo(host)
 
-	setupDHTRefresh(kademliaDHT)
+	setupDHTRefresh(ctx, kademliaDHT)
+
+	routingDiscovery := drouting.NewRoutingDiscovery(kademliaDHT)
+	discovery.AdvertiseAll(ctx, routingDiscovery, discovery.RelayNamespace())
 
 	// host.SetStreamHandler(NodeRunnerProtocol, func(s network.Stream) {
 	// 	handleStream(strea)
@@ -355,5 +377,7 @@ func main() {
 
 	log.Info("Relay is ready to handle Node Runner ID requests")
 
-	select {}
+	if err := lc.Wait(); err != nil {
+		log.Errorf("shutdown: %v", err)
+	}
 }
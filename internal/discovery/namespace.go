@@ -0,0 +1,209 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+	dutil "github.com/libp2p/go-libp2p/p2p/discovery/util"
+)
+
+var log = logging.Logger("discoverylog")
+
+// rendezvous namespaces, one per role so a lookup for runners never returns clients
+const (
+	namespaceVersion = "1.0.0"
+	runnerNamespace  = "/mnwarm/runner/" + namespaceVersion
+	relayNamespace   = "/mnwarm/relay/" + namespaceVersion
+	clientNamespace  = "/mnwarm/client/" + namespaceVersion
+
+	// anyProject is the project namespace runners without a project list advertise under
+	anyProject = "_any"
+)
+
+// keys runners put in InfoResponse.SystemConfig so clients can read the attributes back
+const (
+	AttrProjects = "projects"
+	AttrRegion   = "region"
+	AttrCapacity = "capacity"
+)
+
+func RelayNamespace() string {
+	return relayNamespace
+}
+
+func ClientNamespace() string {
+	return clientNamespace
+}
+
+// RunnerNamespace is the namespace for all runners, or only the runners serving project
+func RunnerNamespace(project string) string {
+	if project == "" {
+		return runnerNamespace
+	}
+	return fmt.Sprintf("%s/project/%s", runnerNamespace, project)
+}
+
+// RunnerRegionNamespace is the namespace for runners in a region
+func RunnerRegionNamespace(region string) string {
+	if region == "" {
+		return runnerNamespace
+	}
+	return fmt.Sprintf("%s/region/%s", runnerNamespace, region)
+}
+
+// RunnerAttrs describe what a runner offers
+type RunnerAttrs struct {
+	Projects []string
+	Region   string
+	Capacity int
+}
+
+// Namespaces are all the namespaces a runner with these attributes advertises under
+func (a RunnerAttrs) Namespaces() []string {
+	namespaces := []string{RunnerNamespace("")}
+	if len(a.Projects) == 0 {
+		namespaces = append(namespaces, RunnerNamespace(anyProject))
+	}
+	for _, project := range a.Projects {
+		if project == "" {
+			continue
+		}
+		namespaces = append(namespaces, RunnerNamespace(project))
+	}
+	if a.Region != "" {
+		namespaces = append(namespaces, RunnerRegionNamespace(a.Region))
+	}
+	return namespaces
+}
+
+// SystemConfig encodes the attributes for InfoResponse.SystemConfig
+func (a RunnerAttrs) SystemConfig() map[string]string {
+	projects := append([]string(nil), a.Projects...)
+	sort.Strings(projects)
+	return map[string]string{
+		AttrProjects: strings.Join(projects, ","),
+		AttrRegion:   a.Region,
+		AttrCapacity: strconv.Itoa(a.Capacity),
+	}
+}
+
+// ParseRunnerAttrs reads attributes back out of an InfoResponse.SystemConfig,
+// missing or malformed keys are left at their zero value
+func ParseRunnerAttrs(systemConfig map[string]string) RunnerAttrs {
+	var a RunnerAttrs
+	if projects := systemConfig[AttrProjects]; projects != "" {
+		a.Projects = SplitList(projects)
+	}
+	a.Region = systemConfig[AttrRegion]
+	if capacity, err := strconv.Atoi(systemConfig[AttrCapacity]); err == nil {
+		a.Capacity = capacity
+	}
+	return a
+}
+
+// Serves is true if the runner advertises project, a runner with no projects serves everyone
+func (a RunnerAttrs) Serves(project string) bool {
+	if project == "" || len(a.Projects) == 0 {
+		return true
+	}
+	for _, p := range a.Projects {
+		if p == project {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitList splits a comma separated flag value, dropping blanks
+func SplitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// AdvertiseAll advertises under every namespace, dutil.Advertise keeps
+// re-advertising in the background until ctx is done
+func AdvertiseAll(ctx context.Context, advertiser discovery.Advertiser, namespaces ...string) {
+	for _, ns := range namespaces {
+		log.Infof("advertising under %s", ns)
+		dutil.Advertise(ctx, advertiser, ns)
+	}
+}
+
+// FindRunners looks up runners for project, including runners that serve every project,
+// or every runner if project is empty
+func FindRunners(ctx context.Context, discoverer discovery.Discoverer, project string) (<-chan peer.AddrInfo, error) {
+	namespaces := []string{RunnerNamespace("")}
+	if project != "" {
+		namespaces = []string{RunnerNamespace(project), RunnerNamespace(anyProject)}
+	}
+
+	var chans []<-chan peer.AddrInfo
+	for _, ns := range namespaces {
+		log.Infof("searching for runners under %s", ns)
+		peerChan, err := discoverer.FindPeers(ctx, ns)
+		if err != nil {
+			return nil, fmt.Errorf("find runners under %s: %w", ns, err)
+		}
+		chans = append(chans, peerChan)
+	}
+	return mergePeers(ctx, chans...), nil
+}
+
+// mergePeers fans several FindPeers channels into one, dropping duplicate ids
+func mergePeers(ctx context.Context, chans ...<-chan peer.AddrInfo) <-chan peer.AddrInfo {
+	if len(chans) == 1 {
+		return chans[0]
+	}
+
+	out := make(chan peer.AddrInfo)
+	var mu sync.Mutex
+	seen := make(map[peer.ID]struct{})
+	var wg sync.WaitGroup
+	for _, ch := range chans {
+		wg.Add(1)
+		go func(ch <-chan peer.AddrInfo) {
+			defer wg.Done()
+			for p := range ch {
+				mu.Lock()
+				_, dup := seen[p.ID]
+				seen[p.ID] = struct{}{}
+				mu.Unlock()
+				if dup {
+					continue
+				}
+				select {
+				case out <- p:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(ch)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// FindRelays looks up relays advertising the relay namespace
+func FindRelays(ctx context.Context, discoverer discovery.Discoverer) (<-chan peer.AddrInfo, error) {
+	peerChan, err := discoverer.FindPeers(ctx, relayNamespace)
+	if err != nil {
+		return nil, fmt.Errorf("find relays under %s: %w", relayNamespace, err)
+	}
+	return peerChan, nil
+}
@@ -0,0 +1,70 @@
+package discovery
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRunnerAttrsNamespaces(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs RunnerAttrs
+		want  []string
+	}{
+		{
+			name:  "No projects or region",
+			attrs: RunnerAttrs{Capacity: 1},
+			want:  []string{"/mnwarm/runner/1.0.0", "/mnwarm/runner/1.0.0/project/_any"},
+		},
+		{
+			name:  "Projects and region",
+			attrs: RunnerAttrs{Projects: []string{"p1", "", "p2"}, Region: "eu"},
+			want: []string{
+				"/mnwarm/runner/1.0.0",
+				"/mnwarm/runner/1.0.0/project/p1",
+				"/mnwarm/runner/1.0.0/project/p2",
+				"/mnwarm/runner/1.0.0/region/eu",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.attrs.Namespaces(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Namespaces() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if RunnerNamespace("p1") == ClientNamespace() || RunnerNamespace("") == RelayNamespace() {
+		t.Errorf("role namespaces must not collide")
+	}
+}
+
+func TestParseRunnerAttrs(t *testing.T) {
+	attrs := RunnerAttrs{Projects: []string{"p2", "p1"}, Region: "us", Capacity: 4}
+
+	got := ParseRunnerAttrs(attrs.SystemConfig())
+	want := RunnerAttrs{Projects: []string{"p1", "p2"}, Region: "us", Capacity: 4}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseRunnerAttrs() = %+v, want %+v", got, want)
+	}
+
+	tests := []struct {
+		name    string
+		attrs   RunnerAttrs
+		project string
+		want    bool
+	}{
+		{name: "Listed project", attrs: want, project: "p1", want: true},
+		{name: "Unlisted project", attrs: want, project: "p3", want: false},
+		{name: "Runner serves all", attrs: RunnerAttrs{}, project: "p3", want: true},
+		{name: "Client wants any", attrs: want, project: "", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.attrs.Serves(tt.project); got != tt.want {
+				t.Errorf("Serves(%q) = %v, want %v", tt.project, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package discovery
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// EventType says what happened to a peer
+type EventType int
+
+const (
+	PeerDiscovered EventType = iota
+	PeerLost
+)
+
+func (t EventType) String() string {
+	if t == PeerLost {
+		return "lost"
+	}
+	return "discovered"
+}
+
+// Event is published when a peer is discovered for the first time or lost
+type Event struct {
+	Type EventType
+	Peer peer.AddrInfo
+}
+
+// LookupFunc runs one discovery query, FindRunners fits with a bound project
+type LookupFunc func(ctx context.Context, discoverer discovery.Discoverer) (<-chan peer.AddrInfo, error)
+
+// SubscriberTimeout is how long an event waits for a subscriber that is not reading,
+// a subscriber that falls behind further misses it
+var SubscriberTimeout = 5 * time.Second
+
+// Service keeps re-querying and re-advertising on a schedule instead of doing it once
+type Service struct {
+	host       host.Host
+	discovery  discovery.Discovery
+	lookup     LookupFunc
+	namespaces []string
+	filter     func(peer.ID) bool
+
+	interval      time.Duration
+	jitter        time.Duration
+	advertiseTTL  time.Duration
+	expireAfter   time.Duration
+	lookupTimeout time.Duration
+
+	mu    sync.Mutex
+	known map[peer.ID]*knownPeer
+	// kick is closed to make the advertise loops advertise again right away
+	kick chan struct{}
+
+	// subMu is held while an event is sent, so a slow subscriber doesn't block mu
+	subMu sync.Mutex
+	subs  []chan Event
+}
+
+type knownPeer struct {
+	info     peer.AddrInfo
+	lastSeen time.Time
+}
+
+// Option configures a Service
+type Option func(*Service)
+
+// WithInterval sets how often lookups run and the random jitter added to each wait
+func WithInterval(interval, jitter time.Duration) Option {
+	return func(s *Service) {
+		s.interval = interval
+		s.jitter = jitter
+	}
+}
+
+// WithLookup sets the query the service repeats, without it the service only advertises
+func WithLookup(lookup LookupFunc) Option {
+	return func(s *Service) {
+		s.lookup = lookup
+	}
+}
+
+// WithAdvertise sets the namespaces the service keeps advertising under
+func WithAdvertise(namespaces ...string) Option {
+	return func(s *Service) {
+		s.namespaces = append(s.namespaces, namespaces...)
+	}
+}
+
+// WithFilter drops discovered peers the filter returns false for
+func WithFilter(filter func(peer.ID) bool) Option {
+	return func(s *Service) {
+		s.filter = filter
+	}
+}
+
+// WithAdvertiseTTL sets the ttl asked for on each advertisement
+func WithAdvertiseTTL(ttl time.Duration) Option {
+	return func(s *Service) {
+		s.advertiseTTL = ttl
+	}
+}
+
+// WithExpiry sets how long an unconnected peer may go unseen before it is reported lost
+func WithExpiry(expireAfter time.Duration) Option {
+	return func(s *Service) {
+		s.expireAfter = expireAfter
+	}
+}
+
+func NewService(h host.Host, d discovery.Discovery, opts ...Option) *Service {
+	s := &Service{
+		host:          h,
+		discovery:     d,
+		interval:      30 * time.Second,
+		jitter:        5 * time.Second,
+		advertiseTTL:  time.Hour,
+		lookupTimeout: 20 * time.Second,
+		known:         make(map[peer.ID]*knownPeer),
+		kick:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.expireAfter == 0 {
+		s.expireAfter = 3 * s.interval
+	}
+	return s
+}
+
+// Subscribe returns a channel of discovered/lost events, it is closed when the service stops.
+// events wait up to SubscriberTimeout for a subscriber whose buffer is full
+func (s *Service) Subscribe() <-chan Event {
+	ch := make(chan Event, 32)
+	s.subMu.Lock()
+	s.subs = append(s.subs, ch)
+	s.subMu.Unlock()
+	return ch
+}
+
+// Peers are the currently known peers
+func (s *Service) Peers() []peer.AddrInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]peer.AddrInfo, 0, len(s.known))
+	for _, k := range s.known {
+		out = append(out, k.info)
+	}
+	return out
+}
+
+// Start runs the advertise and lookup loops until ctx is done
+func (s *Service) Start(ctx context.Context) {
+	notifee := &network.NotifyBundle{
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			pid := conn.RemotePeer()
+			// publishing may wait for subscribers, don't hold up the swarm
+			go func() {
+				if !present(n, pid) {
+					s.lose(pid)
+				}
+			}()
+		},
+	}
+	s.host.Network().Notify(notifee)
+
+	var wg sync.WaitGroup
+	for _, ns := range s.namespaces {
+		wg.Add(1)
+		go func(ns string) {
+			defer wg.Done()
+			s.advertiseLoop(ctx, ns)
+		}(ns)
+	}
+	if s.lookup != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.lookupLoop(ctx)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		s.host.Network().StopNotify(notifee)
+		s.subMu.Lock()
+		for _, ch := range s.subs {
+			close(ch)
+		}
+		s.subs = nil
+		s.subMu.Unlock()
+	}()
+}
+
+// Readvertise advertises every namespace again now instead of waiting for the next round
+func (s *Service) Readvertise() {
+	s.mu.Lock()
+	close(s.kick)
+	s.kick = make(chan struct{})
+	s.mu.Unlock()
+}
+
+func (s *Service) kicked() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kick
+}
+
+// advertiseLoop re-advertises before the granted ttl runs out
+func (s *Service) advertiseLoop(ctx context.Context, ns string) {
+	for {
+		kick := s.kicked()
+		ttl, err := s.discovery.Advertise(ctx, ns, discovery.TTL(s.advertiseTTL))
+		wait := s.interval
+		if err != nil {
+			log.Warnf("advertise under %s failed: %v", ns, err)
+		} else {
+			log.Debugf("advertised under %s for %s", ns, ttl)
+			wait = ttl * 7 / 8
+		}
+
+		select {
+		case <-time.After(s.withJitter(wait)):
+		case <-kick:
+			log.Debugf("readvertising under %s", ns)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Service) lookupLoop(ctx context.Context) {
+	for {
+		s.lookupOnce(ctx)
+		s.expire()
+
+		select {
+		case <-time.After(s.withJitter(s.interval)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Service) lookupOnce(ctx context.Context) {
+	lookupCtx, cancel := context.WithTimeout(ctx, s.lookupTimeout)
+	defer cancel()
+
+	peerChan, err := s.lookup(lookupCtx, s.discovery)
+	if err != nil {
+		log.Warnf("discovery lookup failed: %v", err)
+		return
+	}
+	for p := range peerChan {
+		if p.ID == s.host.ID() || len(p.Addrs) == 0 {
+			continue
+		}
+		if s.filter != nil && !s.filter(p.ID) {
+			continue
+		}
+		s.see(p)
+	}
+}
+
+func (s *Service) see(p peer.AddrInfo) {
+	s.mu.Lock()
+	k, exists := s.known[p.ID]
+	if exists {
+		k.info = p
+		k.lastSeen = time.Now()
+		s.mu.Unlock()
+		return
+	}
+	s.known[p.ID] = &knownPeer{info: p, lastSeen: time.Now()}
+	s.mu.Unlock()
+
+	log.Infof("discovered peer %s", p.ID)
+	s.publish(Event{Type: PeerDiscovered, Peer: p})
+}
+
+func (s *Service) lose(pid peer.ID) {
+	s.mu.Lock()
+	k, exists := s.known[pid]
+	if !exists {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.known, pid)
+	s.mu.Unlock()
+
+	log.Infof("lost peer %s", pid)
+	s.publish(Event{Type: PeerLost, Peer: k.info})
+}
+
+// expire reports peers we are not connected to and have not seen for a while as lost
+func (s *Service) expire() {
+	cutoff := time.Now().Add(-s.expireAfter)
+	var stale []peer.ID
+
+	s.mu.Lock()
+	for pid, k := range s.known {
+		if k.lastSeen.Before(cutoff) && !present(s.host.Network(), pid) {
+			stale = append(stale, pid)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, pid := range stale {
+		s.lose(pid)
+	}
+}
+
+// present is true while we have a connection to pid, a relayed one counts too
+func present(n network.Network, pid peer.ID) bool {
+	c := n.Connectedness(pid)
+	return c == network.Connected || c == network.Limited
+}
+
+func (s *Service) publish(ev Event) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	for _, ch := range s.subs {
+		select {
+		case ch <- ev:
+		case <-time.After(SubscriberTimeout):
+			log.Errorf("discovery subscriber did not read for %s, dropped %s event for %s", SubscriberTimeout, ev.Type, ev.Peer.ID)
+		}
+	}
+}
+
+func (s *Service) withJitter(d time.Duration) time.Duration {
+	if s.jitter <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(s.jitter)))
+}
@@ -0,0 +1,199 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mocks"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func TestServiceDiscoversAndLoses(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(2)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+	hosts := mn.Hosts()
+	runnerHost, clientHost := hosts[0], hosts[1]
+
+	server := mocks.NewDiscoveryServer(realClock{})
+	attrs := RunnerAttrs{Projects: []string{"p1"}, Capacity: 1}
+
+	runnerSvc := NewService(runnerHost, mocks.NewDiscoveryClient(runnerHost, server),
+		WithInterval(50*time.Millisecond, 0),
+		WithAdvertise(attrs.Namespaces()...),
+	)
+	runnerSvc.Start(ctx)
+
+	clientSvc := NewService(clientHost, mocks.NewDiscoveryClient(clientHost, server),
+		WithInterval(50*time.Millisecond, 10*time.Millisecond),
+		WithLookup(func(ctx context.Context, d discovery.Discoverer) (<-chan peer.AddrInfo, error) {
+			return FindRunners(ctx, d, "p1")
+		}),
+	)
+	events := clientSvc.Subscribe()
+	clientSvc.Start(ctx)
+
+	select {
+	case ev := <-events:
+		if ev.Type != PeerDiscovered || ev.Peer.ID != runnerHost.ID() {
+			t.Fatalf("got %s event for %s, want discovered %s", ev.Type, ev.Peer.ID, runnerHost.ID())
+		}
+	case <-ctx.Done():
+		t.Fatal("runner was never discovered")
+	}
+
+	if err := clientHost.Connect(ctx, peer.AddrInfo{ID: runnerHost.ID(), Addrs: runnerHost.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect to runner: %v", err)
+	}
+
+	// repeated lookups must not publish the runner again
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected %s event for %s", ev.Type, ev.Peer.ID)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := clientHost.Network().ClosePeer(runnerHost.ID()); err != nil {
+		t.Fatalf("Failed to disconnect runner: %v", err)
+	}
+
+	select {
+	case ev := <-events:
+		if ev.Type != PeerLost || ev.Peer.ID != runnerHost.ID() {
+			t.Fatalf("got %s event for %s, want lost %s", ev.Type, ev.Peer.ID, runnerHost.ID())
+		}
+	case <-ctx.Done():
+		t.Fatal("runner was never reported lost")
+	}
+}
+
+// countingDiscovery reports every Advertise call
+type countingDiscovery struct {
+	discovery.Discovery
+	advertised chan string
+}
+
+func (c countingDiscovery) Advertise(ctx context.Context, ns string, opts ...discovery.Option) (time.Duration, error) {
+	c.advertised <- ns
+	return c.Discovery.Advertise(ctx, ns, opts...)
+}
+
+func TestServiceReadvertise(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(1)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+	h := mn.Hosts()[0]
+
+	d := countingDiscovery{
+		Discovery:  mocks.NewDiscoveryClient(h, mocks.NewDiscoveryServer(realClock{})),
+		advertised: make(chan string, 4),
+	}
+	svc := NewService(h, d, WithInterval(time.Hour, 0), WithAdvertise(RunnerNamespace("p1")))
+	svc.Start(ctx)
+
+	for round := 0; round < 2; round++ {
+		select {
+		case ns := <-d.advertised:
+			if ns != RunnerNamespace("p1") {
+				t.Fatalf("advertised under %s, want %s", ns, RunnerNamespace("p1"))
+			}
+		case <-ctx.Done():
+			t.Fatalf("advertise round %d never happened", round)
+		}
+		svc.Readvertise()
+	}
+}
+
+func TestServiceKeepsRelayedPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	newHost := func(opts ...libp2p.Option) host.Host {
+		t.Helper()
+		opts = append(opts, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.Transport(tcp.NewTCPTransport))
+		h, err := libp2p.New(opts...)
+		if err != nil {
+			t.Fatalf("Failed to create host: %v", err)
+		}
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+	relayHost := newHost(libp2p.EnableRelayService(), libp2p.ForceReachabilityPublic())
+	runnerHost, clientHost := newHost(), newHost()
+	relayInfo := peer.AddrInfo{ID: relayHost.ID(), Addrs: relayHost.Addrs()}
+	if err := runnerHost.Connect(ctx, relayInfo); err != nil {
+		t.Fatalf("Failed to connect runner to relay: %v", err)
+	}
+	if _, err := client.Reserve(ctx, runnerHost, relayInfo); err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+
+	server := mocks.NewDiscoveryServer(realClock{})
+	runnerSvc := NewService(runnerHost, mocks.NewDiscoveryClient(runnerHost, server),
+		WithInterval(50*time.Millisecond, 0),
+		WithAdvertise(RunnerNamespace("p1")),
+	)
+	runnerSvc.Start(ctx)
+	clientSvc := NewService(clientHost, mocks.NewDiscoveryClient(clientHost, server),
+		WithInterval(50*time.Millisecond, 0),
+		WithLookup(func(ctx context.Context, d discovery.Discoverer) (<-chan peer.AddrInfo, error) {
+			return FindRunners(ctx, d, "p1")
+		}),
+	)
+	events := clientSvc.Subscribe()
+	clientSvc.Start(ctx)
+	select {
+	case <-events:
+	case <-ctx.Done():
+		t.Fatal("runner was never discovered")
+	}
+
+	// reach the runner through the relay and directly, then lose the direct connection
+	circuit, err := ma.NewMultiaddr(relayInfo.Addrs[0].String() + "/p2p/" + relayHost.ID().String() + "/p2p-circuit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clientHost.Connect(ctx, peer.AddrInfo{ID: runnerHost.ID(), Addrs: []ma.Multiaddr{circuit}}); err != nil {
+		t.Fatalf("Failed to connect through the relay: %v", err)
+	}
+	if err := clientHost.Connect(network.WithForceDirectDial(ctx, "test"), peer.AddrInfo{ID: runnerHost.ID(), Addrs: runnerHost.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect directly: %v", err)
+	}
+	for _, c := range clientHost.Network().ConnsToPeer(runnerHost.ID()) {
+		if !c.Stat().Limited {
+			c.Close()
+		}
+	}
+	if got := clientHost.Network().Connectedness(runnerHost.ID()); got != network.Limited {
+		t.Fatalf("Connectedness() = %s, want limited", got)
+	}
+
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected %s event for %s while it is reachable through the relay", ev.Type, ev.Peer.ID)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
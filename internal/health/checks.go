@@ -0,0 +1,77 @@
+package health
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/proto"
+)
+
+// BootstrapCheck passes while we are connected to at least one bootstrap peer
+func BootstrapCheck(h host.Host, bootstrapPeers []peer.AddrInfo) Check {
+	return func() error {
+		for _, p := range bootstrapPeers {
+			if h.Network().Connectedness(p.ID) == network.Connected {
+				return nil
+			}
+		}
+		return fmt.Errorf("connected to none of %d bootstrap peers", len(bootstrapPeers))
+	}
+}
+
+// RoutingTableCheck passes while the DHT routing table holds at least minPeers peers
+func RoutingTableCheck(kademliaDHT *dht.IpfsDHT, minPeers int) Check {
+	return func() error {
+		if kademliaDHT == nil {
+			return errors.New("no dht")
+		}
+		if size := kademliaDHT.RoutingTable().Size(); size < minPeers {
+			return fmt.Errorf("routing table has %d of %d peers", size, minPeers)
+		}
+		return nil
+	}
+}
+
+// RelayConnectionCheck passes while we are connected to the relay
+func RelayConnectionCheck(h host.Host, relayID peer.ID) Check {
+	return func() error {
+		if h.Network().Connectedness(relayID) != network.Connected {
+			return fmt.Errorf("not connected to relay %s", relayID)
+		}
+		return nil
+	}
+}
+
+// ReservationCheck passes while the reservation returned by current is live,
+// it ends when it expires or when the connection to its relay drops. current also
+// returns the relay, which changes when the runner moves to another one
+func ReservationCheck(h host.Host, current func() (peer.ID, *client.Reservation)) Check {
+	return func() error {
+		relayID, rsvp := current()
+		if rsvp == nil {
+			return errors.New("no relay reservation")
+		}
+		if time.Now().After(rsvp.Expiration) {
+			return fmt.Errorf("relay reservation expired at %s", rsvp.Expiration)
+		}
+		return RelayConnectionCheck(h, relayID)()
+	}
+}
+
+// RelayServiceCheck passes while the circuit v2 hop protocol is served
+func RelayServiceCheck(h host.Host) Check {
+	return func() error {
+		for _, id := range h.Mux().Protocols() {
+			if id == proto.ProtoIDv2Hop {
+				return nil
+			}
+		}
+		return errors.New("relay service is not running")
+	}
+}
@@ -0,0 +1,186 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var log = logging.Logger("healthlog")
+
+const (
+	LivenessPath  = "/livez"
+	ReadinessPath = "/readyz"
+	// MetricsPath serves the prometheus metrics of libp2p and ours
+	MetricsPath = "/metrics"
+)
+
+// Check reports why a component is not ready, nil when it is
+type Check func() error
+
+// CheckResult is one entry of a Report
+type CheckResult struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report is the JSON body served on the probe endpoints
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Checker holds the named readiness checks of a binary
+type Checker struct {
+	mu     sync.Mutex
+	checks map[string]Check
+}
+
+func NewChecker() *Checker {
+	return &Checker{checks: make(map[string]Check)}
+}
+
+// Add registers a readiness check, a later check with the same name replaces it
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// Ready runs every check, the report is ready only when all of them pass. a checker
+// without checks is still starting up and not ready
+func (c *Checker) Ready() (Report, bool) {
+	c.mu.Lock()
+	if len(c.checks) == 0 {
+		c.mu.Unlock()
+		return Report{Status: "starting"}, false
+	}
+	names := make([]string, 0, len(c.checks))
+	for name := range c.checks {
+		names = append(names, name)
+	}
+	checks := make(map[string]Check, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	c.mu.Unlock()
+	sort.Strings(names)
+
+	report := Report{Status: "ok", Checks: make(map[string]CheckResult, len(names))}
+	ready := true
+	for _, name := range names {
+		if err := checks[name](); err != nil {
+			report.Checks[name] = CheckResult{OK: false, Detail: err.Error()}
+			ready = false
+			continue
+		}
+		report.Checks[name] = CheckResult{OK: true}
+	}
+	if !ready {
+		report.Status = "unavailable"
+	}
+	return report, ready
+}
+
+// Handler serves LivenessPath, ReadinessPath and MetricsPath
+func (c *Checker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(LivenessPath, func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, Report{Status: "ok"}, true)
+	})
+	mux.HandleFunc(ReadinessPath, func(w http.ResponseWriter, r *http.Request) {
+		report, ready := c.Ready()
+		writeReport(w, report, ready)
+	})
+	mux.Handle(MetricsPath, promhttp.Handler())
+	return mux
+}
+
+func writeReport(w http.ResponseWriter, report Report, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Warnf("could not write health report: %v", err)
+	}
+}
+
+// Serve starts the probe endpoints on addr, the returned func stops them
+func (c *Checker) Serve(addr string) (func(ctx context.Context) error, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("health listener error: %w", err)
+	}
+	srv := &http.Server{Handler: c.Handler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("health server stopped: %v", err)
+		}
+	}()
+	log.Infof("health probes on http://%s%s and %s, metrics on %s", ln.Addr(), LivenessPath, ReadinessPath, MetricsPath)
+	return srv.Shutdown, nil
+}
+
+// Probe asks a running binary for its liveness or readiness
+func Probe(ctx context.Context, addr string, live bool) (Report, error) {
+	path := ReadinessPath
+	if live {
+		path = LivenessPath
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return Report{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Report{}, fmt.Errorf("probe error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var report Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return Report{}, fmt.Errorf("probe response error: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return report, fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+	return report, nil
+}
+
+// RunHealthcheck implements the `healthcheck` subcommand, args are what follows it.
+// the exit code is 0 when the probe passes, so it can be used as a container healthcheck
+func RunHealthcheck(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	addr := fs.String("addr", "", "address the binary serves its probes on, see -health-addr")
+	live := fs.Bool("live", false, "check liveness instead of readiness")
+	timeout := fs.Duration("timeout", 3*time.Second, "probe timeout")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *addr == "" {
+		fmt.Println("healthcheck: -addr is required")
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	report, err := Probe(ctx, *addr, *live)
+	out, _ := json.Marshal(report)
+	fmt.Println(string(out))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,79 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCheckerReady(t *testing.T) {
+	c := NewChecker()
+	if report, ready := c.Ready(); ready || report.Status != "starting" {
+		t.Fatalf("Ready() = %+v, %v without checks, want starting", report, ready)
+	}
+	c.Add("ok", func() error { return nil })
+
+	if report, ready := c.Ready(); !ready || report.Status != "ok" {
+		t.Fatalf("Ready() = %+v, %v, want ready", report, ready)
+	}
+
+	c.Add("relay", func() error { return errors.New("no relay reservation") })
+	report, ready := c.Ready()
+	if ready {
+		t.Fatal("Ready() = true with a failing check")
+	}
+	if report.Status != "unavailable" {
+		t.Errorf("Status = %q, want unavailable", report.Status)
+	}
+	if got := report.Checks["relay"]; got.OK || got.Detail != "no relay reservation" {
+		t.Errorf("relay check = %+v", got)
+	}
+	if !report.Checks["ok"].OK {
+		t.Errorf("ok check = %+v", report.Checks["ok"])
+	}
+}
+
+func TestProbe(t *testing.T) {
+	c := NewChecker()
+	var failing atomic.Bool
+	failing.Store(true)
+	c.Add("bootstrap", func() error {
+		if failing.Load() {
+			return errors.New("connected to none of 3 bootstrap peers")
+		}
+		return nil
+	})
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	if _, err := Probe(context.Background(), addr, true); err != nil {
+		t.Errorf("liveness probe error = %v", err)
+	}
+
+	report, err := Probe(context.Background(), addr, false)
+	if err == nil {
+		t.Fatal("readiness probe passed with a failing check")
+	}
+	if report.Checks["bootstrap"].OK {
+		t.Errorf("bootstrap check = %+v", report.Checks["bootstrap"])
+	}
+
+	failing.Store(false)
+	if _, err := Probe(context.Background(), addr, false); err != nil {
+		t.Errorf("readiness probe error = %v", err)
+	}
+
+	resp, err := http.Get(srv.URL + MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET %s = %s", MetricsPath, resp.Status)
+	}
+}
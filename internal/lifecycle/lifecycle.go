@@ -0,0 +1,133 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("lifecyclelog")
+
+// DefaultDrainTimeout bounds how long shutdown hooks may take all together
+const DefaultDrainTimeout = 10 * time.Second
+
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Manager owns the root context of a binary and runs its shutdown hooks on SIGINT/SIGTERM.
+// hooks run in reverse registration order, so registering them as things start up
+// (host, dht, relay, loops) stops the loops first and closes the host last
+type Manager struct {
+	drainTimeout time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	hooks    []hook
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func New(drainTimeout time.Duration) *Manager {
+	if drainTimeout <= 0 {
+		drainTimeout = DefaultDrainTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		drainTimeout: drainTimeout,
+		ctx:          ctx,
+		cancel:       cancel,
+		stop:         make(chan struct{}),
+	}
+}
+
+// Context is canceled as soon as shutdown starts, loops should exit on it
+func (m *Manager) Context() context.Context {
+	return m.ctx
+}
+
+// OnShutdown registers a hook, the ctx it gets expires with the drain timeout
+func (m *Manager) OnShutdown(name string, fn func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks = append(m.hooks, hook{name: name, fn: fn})
+}
+
+// Shutdown starts shutdown without a signal
+func (m *Manager) Shutdown() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+// Wait blocks until SIGINT/SIGTERM or Shutdown, then runs the hooks. a second
+// signal while draining exits right away, and so does a hook that outlives the
+// drain timeout
+func (m *Manager) Wait() error {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	select {
+	case sig := <-sigs:
+		log.Infof("received %s, shutting down (drain timeout %s)", sig, m.drainTimeout)
+	case <-m.stop:
+		log.Infof("shutting down (drain timeout %s)", m.drainTimeout)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.drain()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case sig := <-sigs:
+		log.Warnf("received second %s, exiting without draining", sig)
+		return errors.New("shutdown interrupted")
+	case <-time.After(m.drainTimeout):
+		log.Warnf("shutdown hooks still running after %s, exiting without them", m.drainTimeout)
+		return fmt.Errorf("shutdown did not drain: %w", context.DeadlineExceeded)
+	}
+}
+
+// drain cancels the root context and runs every hook within the drain timeout
+func (m *Manager) drain() error {
+	m.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.drainTimeout)
+	defer cancel()
+
+	m.mu.Lock()
+	hooks := append([]hook(nil), m.hooks...)
+	m.mu.Unlock()
+
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		h := hooks[i]
+		if ctx.Err() != nil {
+			errs = append(errs, fmt.Errorf("%s: skipped, drain timeout reached", h.name))
+			continue
+		}
+		log.Infof("shutdown: %s", h.name)
+		if err := h.fn(ctx); err != nil {
+			log.Errorf("shutdown %s failed: %v", h.name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", h.name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	log.Info("shutdown complete")
+	return nil
+}
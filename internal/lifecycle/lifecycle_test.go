@@ -0,0 +1,80 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShutdownRunsHooksInReverse(t *testing.T) {
+	m := New(time.Second)
+
+	var order []string
+	for _, name := range []string{"host", "dht", "loops"} {
+		name := name
+		m.OnShutdown(name, func(ctx context.Context) error {
+			order = append(order, name)
+			return nil
+		})
+	}
+
+	m.Shutdown()
+	if err := m.Wait(); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+
+	if want := []string{"loops", "dht", "host"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("hooks ran in %v, want %v", order, want)
+	}
+	if m.Context().Err() == nil {
+		t.Errorf("Context() not canceled after shutdown")
+	}
+}
+
+func TestShutdownDrainTimeout(t *testing.T) {
+	m := New(50 * time.Millisecond)
+
+	skipped := true
+	m.OnShutdown("after slow", func(ctx context.Context) error {
+		skipped = false
+		return nil
+	})
+	m.OnShutdown("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	m.Shutdown()
+	err := m.Wait()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() error = %v, want deadline exceeded", err)
+	}
+	if !skipped {
+		t.Errorf("hook after the drain timeout should be skipped")
+	}
+}
+
+func TestShutdownHookIgnoringContext(t *testing.T) {
+	m := New(50 * time.Millisecond)
+
+	block := make(chan struct{})
+	defer close(block)
+	m.OnShutdown("stuck", func(ctx context.Context) error {
+		<-block
+		return nil
+	})
+
+	m.Shutdown()
+	done := make(chan error, 1)
+	go func() { done <- m.Wait() }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Wait() error = %v, want deadline exceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait() blocked on a hook that ignores its context")
+	}
+}
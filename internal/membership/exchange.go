@@ -0,0 +1,113 @@
+package membership
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	cmn "mnwarm/internal/shared"
+)
+
+const (
+	// streamTimeout bounds a whole gossip or peer-exchange round trip
+	streamTimeout = 10 * time.Second
+	// maxMessageSize caps what we read from a peer, a full digest of a large swarm fits
+	maxMessageSize = 1 << 20
+	// MaxExchangeLimit is the most peers of each role a peer-exchange answer holds
+	MaxExchangeLimit = 32
+)
+
+// ExchangeRequest asks a bootstrap node for up to Limit peers of each role
+type ExchangeRequest struct {
+	Limit int `json:"limit"`
+}
+
+// ExchangeResponse is a random sample of the healthy infrastructure
+type ExchangeResponse struct {
+	Bootstraps []peer.AddrInfo `json:"bootstraps"`
+	Relays     []peer.AddrInfo `json:"relays"`
+	Runners    []peer.AddrInfo `json:"runners"`
+}
+
+// Exchange asks the bootstrap node boot for a sample of the infrastructure
+func Exchange(ctx context.Context, h host.Host, boot peer.ID, limit int) (*ExchangeResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, streamTimeout)
+	defer cancel()
+
+	s, err := h.NewStream(ctx, boot, ExchangeProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	var resp ExchangeResponse
+	if err := roundTrip(s, ExchangeRequest{Limit: limit}, &resp); err != nil {
+		s.Reset()
+		return nil, fmt.Errorf("peer exchange with %s: %w", boot, err)
+	}
+	return &resp, nil
+}
+
+// Expand asks the bootstrap peers we are connected to for the rest of the infrastructure.
+// bootstrap nodes we did not know are dialed, protected and added to the bootstrap
+// peer set, the returned Bootstraps hold the known and the learned ones
+func Expand(ctx context.Context, h host.Host, bootstrapPeers []peer.AddrInfo) (*ExchangeResponse, error) {
+	var errs []error
+	for _, b := range bootstrapPeers {
+		if h.Network().Connectedness(b.ID) != network.Connected {
+			continue
+		}
+		resp, err := Exchange(ctx, h, b.ID, MaxExchangeLimit)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		var learned []peer.AddrInfo
+		for _, p := range resp.Bootstraps {
+			if p.ID != h.ID() && !cmn.ContainsPeer(bootstrapPeers, p.ID) {
+				learned = append(learned, p)
+			}
+		}
+		cmn.AddBootstrapPeers(append(append([]peer.AddrInfo{}, bootstrapPeers...), learned...)...)
+		if len(learned) > 0 {
+			log.Infof("learned %d bootstrap nodes from %s", len(learned), b.ID)
+			cmn.ProtectInfrastructure(h.ConnManager(), learned...)
+			cmn.ConnectToBootstrapPeers(ctx, h, learned)
+		}
+		resp.Bootstraps = append(append([]peer.AddrInfo{}, bootstrapPeers...), learned...)
+		return resp, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no connected bootstrap peer to ask")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// roundTrip writes req, closes our side and reads the answer into resp
+func roundTrip(s network.Stream, req, resp any) error {
+	s.SetDeadline(time.Now().Add(streamTimeout))
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		return err
+	}
+	if err := s.CloseWrite(); err != nil {
+		return err
+	}
+	return json.NewDecoder(io.LimitReader(s, maxMessageSize)).Decode(resp)
+}
+
+// serve reads a request into req and writes the answer reply builds from it
+func serve(s network.Stream, req any, reply func() any) error {
+	s.SetDeadline(time.Now().Add(streamTimeout))
+	if err := json.NewDecoder(io.LimitReader(s, maxMessageSize)).Decode(req); err != nil {
+		return err
+	}
+	return json.NewEncoder(s).Encode(reply())
+}
@@ -0,0 +1,262 @@
+package membership
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	cmn "mnwarm/internal/shared"
+)
+
+// ManifestProtocol serves the newest signed network manifest a bootstrap node holds
+const ManifestProtocol = protocol.ID("/mnwarm/manifest/1.0.0")
+
+// PolicyManifestInterval is the manifest policy that sets how often nodes poll for a newer manifest
+const PolicyManifestInterval = "manifest_interval"
+
+type manifestRequest struct {
+	// Have is the version the asking node runs, informational only
+	Have uint64 `json:"have"`
+}
+
+type manifestResponse struct {
+	Manifest *cmn.SignedManifest `json:"manifest,omitempty"`
+}
+
+// manifestHolder keeps the newest manifest that verifies against the operator key
+type manifestHolder struct {
+	operatorKey crypto.PubKey
+
+	mu       sync.RWMutex
+	signed   *cmn.SignedManifest
+	manifest *cmn.Manifest
+}
+
+// offer verifies signed and keeps it when it is newer than what we hold
+func (m *manifestHolder) offer(signed *cmn.SignedManifest) (*cmn.Manifest, bool, error) {
+	if signed == nil {
+		return nil, false, nil
+	}
+	if m.operatorKey == nil {
+		return nil, false, errors.New("no operator key to verify manifest")
+	}
+	manifest, err := signed.Open(m.operatorKey)
+	if err != nil {
+		return nil, false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.manifest != nil && manifest.Version <= m.manifest.Version {
+		return m.manifest, false, nil
+	}
+	m.signed, m.manifest = signed, manifest
+	return manifest, true, nil
+}
+
+func (m *manifestHolder) current() (*cmn.SignedManifest, *cmn.Manifest) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.signed, m.manifest
+}
+
+// WithManifest makes the cluster serve and gossip the network manifest signed by operatorKey
+func WithManifest(operatorKey crypto.PubKey) Option {
+	return func(c *Cluster) {
+		c.manifests = &manifestHolder{operatorKey: operatorKey}
+	}
+}
+
+// OfferManifest adopts signed when it verifies and is newer than the one we serve,
+// the next gossip rounds spread it to the other bootstrap nodes
+func (c *Cluster) OfferManifest(signed *cmn.SignedManifest) error {
+	if c.manifests == nil {
+		return errors.New("cluster does not serve a manifest")
+	}
+	m, updated, err := c.manifests.offer(signed)
+	if err != nil {
+		return err
+	}
+	if updated {
+		log.Infof("serving network manifest version %d", m.Version)
+	}
+	return nil
+}
+
+// Manifest is the manifest the cluster serves, nil without one
+func (c *Cluster) Manifest() *cmn.Manifest {
+	if c.manifests == nil {
+		return nil
+	}
+	_, m := c.manifests.current()
+	return m
+}
+
+func (c *Cluster) handleManifest(s network.Stream) {
+	defer s.Close()
+
+	var req manifestRequest
+	err := serve(s, &req, func() any {
+		signed, _ := c.manifests.current()
+		return manifestResponse{Manifest: signed}
+	})
+	if err != nil {
+		log.Debugf("manifest request from %s failed: %v", s.Conn().RemotePeer(), err)
+		s.Reset()
+	}
+}
+
+// FetchManifest asks the bootstrap node boot for its signed manifest, nil when it has none
+func FetchManifest(ctx context.Context, h host.Host, boot peer.ID, have uint64) (*cmn.SignedManifest, error) {
+	ctx, cancel := context.WithTimeout(ctx, streamTimeout)
+	defer cancel()
+
+	s, err := h.NewStream(ctx, boot, ManifestProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	var resp manifestResponse
+	if err := roundTrip(s, manifestRequest{Have: have}, &resp); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return resp.Manifest, nil
+}
+
+// ManifestWatcher keeps a node on the newest manifest its bootstrap peers serve.
+// an update adds the new bootstrap nodes to the bootstrap peer set and dials them,
+// everything else is up to the OnUpdate callbacks
+type ManifestWatcher struct {
+	host     host.Host
+	holder   *manifestHolder
+	interval time.Duration
+
+	mu       sync.Mutex
+	onUpdate []func(*cmn.Manifest)
+}
+
+func (w *ManifestWatcher) pollInterval() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.interval
+}
+
+// NewManifestWatcher accepts manifests signed by operatorKey only
+func NewManifestWatcher(h host.Host, operatorKey crypto.PubKey, interval time.Duration) *ManifestWatcher {
+	return &ManifestWatcher{
+		host:     h,
+		holder:   &manifestHolder{operatorKey: operatorKey},
+		interval: interval,
+	}
+}
+
+// OnUpdate registers fn to run with every newer manifest
+func (w *ManifestWatcher) OnUpdate(fn func(*cmn.Manifest)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onUpdate = append(w.onUpdate, fn)
+}
+
+// Current is the manifest in use, nil before the first one was fetched
+func (w *ManifestWatcher) Current() *cmn.Manifest {
+	_, m := w.holder.current()
+	return m
+}
+
+// Start fetches the manifest now and then every interval until ctx is done
+func (w *ManifestWatcher) Start(ctx context.Context) {
+	go func() {
+		for {
+			if err := w.Fetch(ctx); err != nil && ctx.Err() == nil {
+				log.Debugf("manifest fetch failed: %v", err)
+			}
+			select {
+			case <-time.After(w.pollInterval()):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Fetch asks the connected bootstrap peers for their manifest and applies the newest
+func (w *ManifestWatcher) Fetch(ctx context.Context) error {
+	var errs []error
+	asked := 0
+	for _, pid := range cmn.BootstrapPeerSet() {
+		if w.host.Network().Connectedness(pid) != network.Connected {
+			continue
+		}
+		asked++
+		var have uint64
+		if cur := w.Current(); cur != nil {
+			have = cur.Version
+		}
+		signed, err := FetchManifest(ctx, w.host, pid, have)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := w.Offer(ctx, signed); err != nil {
+			log.Warnf("rejecting manifest from %s: %v", pid, err)
+			errs = append(errs, err)
+		}
+	}
+	if asked == 0 {
+		return errors.New("no connected bootstrap peer to ask")
+	}
+	return errors.Join(errs...)
+}
+
+// Offer applies signed when it verifies and is newer than the current manifest
+func (w *ManifestWatcher) Offer(ctx context.Context, signed *cmn.SignedManifest) error {
+	m, updated, err := w.holder.offer(signed)
+	if err != nil || !updated {
+		return err
+	}
+	log.Infof("network manifest version %d: %d bootstraps, %d relays", m.Version, len(m.Bootstraps), len(m.Relays))
+	if missing := m.MissingProtocols(w.host); len(missing) > 0 {
+		log.Warnf("network manifest lists protocols we do not speak, this node is outdated: %v", missing)
+	}
+
+	w.joinBootstraps(ctx, m)
+
+	w.mu.Lock()
+	if d := m.PolicyDuration(PolicyManifestInterval, w.interval); d > 0 {
+		w.interval = d
+	}
+	callbacks := append([]func(*cmn.Manifest){}, w.onUpdate...)
+	w.mu.Unlock()
+	for _, fn := range callbacks {
+		fn(m)
+	}
+	return nil
+}
+
+func (w *ManifestWatcher) joinBootstraps(ctx context.Context, m *cmn.Manifest) {
+	listed, err := m.BootstrapPeers()
+	if err != nil {
+		log.Warnf("manifest bootstrap addrs: %v", err)
+	}
+	var fresh []peer.AddrInfo
+	for _, p := range listed {
+		if p.ID != w.host.ID() {
+			fresh = append(fresh, p)
+		}
+	}
+	added := cmn.AddBootstrapPeers(fresh...)
+	if len(added) == 0 {
+		return
+	}
+	cmn.ProtectInfrastructure(w.host.ConnManager(), added...)
+	go cmn.ConnectToBootstrapPeers(ctx, w.host, added)
+}
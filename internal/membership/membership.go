@@ -0,0 +1,358 @@
+// Package membership keeps the bootstrap nodes aware of each other and of the relays
+// and runners connected to any of them. bootstrap nodes gossip their tables among
+// themselves and answer peer-exchange requests, so a new node only needs one
+// bootstrap addr to find the rest of the infrastructure.
+package membership
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	cmn "mnwarm/internal/shared"
+)
+
+var log = logging.Logger("membershiplog")
+
+const (
+	// GossipProtocol is spoken between bootstrap nodes only
+	GossipProtocol = protocol.ID("/mnwarm/membership/1.0.0")
+	// ExchangeProtocol is the peer-exchange RPC bootstrap nodes serve to everyone
+	ExchangeProtocol = protocol.ID("/mnwarm/px/1.0.0")
+)
+
+// Entry is a peer the cluster knows, Seen is when some bootstrap node last had a
+// connection to it (or, for a bootstrap node, when it last announced itself)
+type Entry struct {
+	Peer peer.AddrInfo `json:"peer"`
+	Role string        `json:"role"`
+	Seen time.Time     `json:"seen"`
+}
+
+// digest is what two bootstrap nodes swap on every gossip round
+type digest struct {
+	Entries  []Entry             `json:"entries"`
+	Manifest *cmn.SignedManifest `json:"manifest,omitempty"`
+}
+
+// Cluster is the membership of one bootstrap node: the other bootstrap nodes and the
+// relays and runners any of them is connected to
+type Cluster struct {
+	host       host.Host
+	classifier *cmn.PeerClassifier
+
+	interval    time.Duration
+	expireAfter time.Duration
+	fanout      int
+	manifests   *manifestHolder
+
+	mu      sync.Mutex
+	entries map[peer.ID]*Entry
+}
+
+// Option configures a Cluster
+type Option func(*Cluster)
+
+// WithInterval sets how often the cluster gossips, entries expire after three rounds
+func WithInterval(interval time.Duration) Option {
+	return func(c *Cluster) {
+		c.interval = interval
+	}
+}
+
+// WithFanout sets how many bootstrap nodes are gossiped with per round
+func WithFanout(fanout int) Option {
+	return func(c *Cluster) {
+		c.fanout = fanout
+	}
+}
+
+// NewCluster tracks the membership seen from h, classifier decides which connected
+// peers are relays and runners worth sharing
+func NewCluster(h host.Host, classifier *cmn.PeerClassifier, opts ...Option) *Cluster {
+	c := &Cluster{
+		host:       h,
+		classifier: classifier,
+		interval:   15 * time.Second,
+		fanout:     3,
+		entries:    make(map[peer.ID]*Entry),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.expireAfter = 3 * c.interval
+	return c
+}
+
+// Join adds the bootstrap nodes we were started with, the first round gossips with them
+func (c *Cluster) Join(seeds ...peer.AddrInfo) {
+	now := time.Now()
+	for _, s := range seeds {
+		if s.ID == c.host.ID() {
+			continue
+		}
+		c.merge(Entry{Peer: s, Role: cmn.RoleBootstrap.String(), Seen: now})
+	}
+}
+
+// Start serves the gossip and peer-exchange protocols and gossips until ctx is done
+func (c *Cluster) Start(ctx context.Context) {
+	c.host.SetStreamHandler(GossipProtocol, c.handleGossip)
+	c.host.SetStreamHandler(ExchangeProtocol, c.handleExchange)
+	if c.manifests != nil {
+		c.host.SetStreamHandler(ManifestProtocol, c.handleManifest)
+	}
+
+	go func() {
+		defer c.host.RemoveStreamHandler(GossipProtocol)
+		defer c.host.RemoveStreamHandler(ExchangeProtocol)
+		defer c.host.RemoveStreamHandler(ManifestProtocol)
+		for {
+			c.round(ctx)
+			select {
+			case <-time.After(c.interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Members are the bootstrap nodes of the cluster, ourselves included
+func (c *Cluster) Members() []peer.AddrInfo {
+	return infos(c.Sample(cmn.RoleBootstrap, 0))
+}
+
+// Sample returns up to n fresh entries of role in random order, all of them when n is 0
+func (c *Cluster) Sample(role cmn.PeerRole, n int) []Entry {
+	c.observe()
+	cutoff := time.Now().Add(-c.expireAfter)
+
+	c.mu.Lock()
+	var out []Entry
+	for _, e := range c.entries {
+		if e.Role == role.String() && e.Seen.After(cutoff) {
+			out = append(out, *e)
+		}
+	}
+	c.mu.Unlock()
+
+	rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+func (c *Cluster) round(ctx context.Context) {
+	c.expire()
+
+	targets := c.Sample(cmn.RoleBootstrap, 0)
+	sent := 0
+	for _, t := range targets {
+		if sent == c.fanout {
+			break
+		}
+		if t.Peer.ID == c.host.ID() {
+			continue
+		}
+		sent++
+		if err := c.gossip(ctx, t.Peer); err != nil {
+			log.Debugf("gossip with %s failed: %v", t.Peer.ID, err)
+		}
+	}
+}
+
+// observe refreshes our own entry and the entries of the peers we are connected to
+func (c *Cluster) observe() {
+	now := time.Now()
+	self := Entry{
+		Peer: peer.AddrInfo{ID: c.host.ID(), Addrs: c.host.Addrs()},
+		Role: cmn.RoleBootstrap.String(),
+		Seen: now,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[self.Peer.ID] = &self
+	for _, pid := range c.host.Network().Peers() {
+		role := c.classifier.Classify(pid)
+		if role != cmn.RoleBootstrap && role != cmn.RoleRelay && role != cmn.RoleRunner {
+			continue
+		}
+		// any peer can claim to be a bootstrap node in its agent version
+		if role == cmn.RoleBootstrap && !c.isMemberLocked(pid) {
+			continue
+		}
+		addrs := c.host.Peerstore().Addrs(pid)
+		if len(addrs) == 0 {
+			continue
+		}
+		c.entries[pid] = &Entry{Peer: peer.AddrInfo{ID: pid, Addrs: addrs}, Role: role.String(), Seen: now}
+	}
+}
+
+// isMember is true for the bootstrap nodes we were configured with and the ones the
+// cluster learned from them, nobody else may gossip with us
+func (c *Cluster) isMember(pid peer.ID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.isMemberLocked(pid)
+}
+
+func (c *Cluster) isMemberLocked(pid peer.ID) bool {
+	if cmn.IsBootstrapPeer(pid) {
+		return true
+	}
+	e, ok := c.entries[pid]
+	return ok && e.Role == cmn.RoleBootstrap.String()
+}
+
+func (c *Cluster) expire() {
+	cutoff := time.Now().Add(-c.expireAfter)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for pid, e := range c.entries {
+		if e.Seen.Before(cutoff) {
+			log.Infof("%s %s left the cluster", e.Role, pid)
+			delete(c.entries, pid)
+		}
+	}
+}
+
+// merge keeps the fresher of two entries for the same peer and reports new ones
+func (c *Cluster) merge(e Entry) bool {
+	if e.Peer.ID == c.host.ID() || e.Peer.ID.Validate() != nil || len(e.Peer.Addrs) == 0 {
+		return false
+	}
+	// a peer with a clock ahead of ours must not keep an entry alive forever
+	if now := time.Now(); e.Seen.After(now) {
+		e.Seen = now
+	}
+	if e.Seen.Before(time.Now().Add(-c.expireAfter)) {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, ok := c.entries[e.Peer.ID]
+	if ok && !e.Seen.After(old.Seen) {
+		return false
+	}
+	c.entries[e.Peer.ID] = &e
+	if !ok {
+		log.Infof("%s %s joined the cluster", e.Role, e.Peer.ID)
+	}
+	return !ok
+}
+
+func (c *Cluster) digest() digest {
+	c.mu.Lock()
+	d := digest{Entries: make([]Entry, 0, len(c.entries))}
+	for _, e := range c.entries {
+		d.Entries = append(d.Entries, *e)
+	}
+	c.mu.Unlock()
+	if c.manifests != nil {
+		d.Manifest, _ = c.manifests.current()
+	}
+	return d
+}
+
+// apply merges a digest received from another bootstrap node, new bootstrap
+// nodes are dialed and protected so the cluster stays connected
+func (c *Cluster) apply(ctx context.Context, d digest) {
+	if c.manifests != nil && d.Manifest != nil {
+		if err := c.OfferManifest(d.Manifest); err != nil {
+			log.Warnf("rejecting gossiped manifest: %v", err)
+		}
+	}
+	for _, e := range d.Entries {
+		if !c.merge(e) || e.Role != cmn.RoleBootstrap.String() {
+			continue
+		}
+		c.host.ConnManager().Protect(e.Peer.ID, cmn.InfrastructureTag)
+		go func(info peer.AddrInfo) {
+			dialCtx, cancel := context.WithTimeout(ctx, streamTimeout)
+			defer cancel()
+			if err := c.host.Connect(dialCtx, info); err != nil {
+				log.Debugf("could not connect to bootstrap node %s: %v", info.ID, err)
+			}
+		}(e.Peer)
+	}
+}
+
+// gossip is one push-pull exchange with another bootstrap node
+func (c *Cluster) gossip(ctx context.Context, target peer.AddrInfo) error {
+	ctx, cancel := context.WithTimeout(ctx, streamTimeout)
+	defer cancel()
+
+	c.host.Peerstore().AddAddrs(target.ID, target.Addrs, time.Hour)
+	s, err := c.host.NewStream(ctx, target.ID, GossipProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var theirs digest
+	if err := roundTrip(s, c.digest(), &theirs); err != nil {
+		s.Reset()
+		return err
+	}
+	c.apply(ctx, theirs)
+	return nil
+}
+
+func (c *Cluster) handleGossip(s network.Stream) {
+	defer s.Close()
+	// the role a peer claims in its agent version proves nothing, only members gossip
+	if pid := s.Conn().RemotePeer(); !c.isMember(pid) {
+		log.Debugf("refusing gossip from %s, not a bootstrap node of the cluster", pid)
+		s.Reset()
+		return
+	}
+
+	var theirs digest
+	if err := serve(s, &theirs, func() any { return c.digest() }); err != nil {
+		log.Debugf("gossip from %s failed: %v", s.Conn().RemotePeer(), err)
+		s.Reset()
+		return
+	}
+	c.apply(context.Background(), theirs)
+}
+
+func (c *Cluster) handleExchange(s network.Stream) {
+	defer s.Close()
+
+	var req ExchangeRequest
+	err := serve(s, &req, func() any {
+		limit := req.Limit
+		if limit <= 0 || limit > MaxExchangeLimit {
+			limit = MaxExchangeLimit
+		}
+		return ExchangeResponse{
+			Bootstraps: infos(c.Sample(cmn.RoleBootstrap, limit)),
+			Relays:     infos(c.Sample(cmn.RoleRelay, limit)),
+			Runners:    infos(c.Sample(cmn.RoleRunner, limit)),
+		}
+	})
+	if err != nil {
+		log.Debugf("peer exchange with %s failed: %v", s.Conn().RemotePeer(), err)
+		s.Reset()
+	}
+}
+
+func infos(entries []Entry) []peer.AddrInfo {
+	out := make([]peer.AddrInfo, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, e.Peer)
+	}
+	return out
+}
@@ -0,0 +1,243 @@
+package membership
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	cmn "mnwarm/internal/shared"
+)
+
+func addrInfo(h host.Host) peer.AddrInfo {
+	return peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}
+}
+
+func waitFor(t *testing.T, ctx context.Context, what string, cond func() bool) {
+	t.Helper()
+	for !cond() {
+		select {
+		case <-time.After(20 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestClusterGossipAndExchange(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	defer cmn.SetBootstrapPeers(nil)
+
+	mn, err := mocknet.FullMeshLinked(5)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+	hosts := mn.Hosts()
+	boots, runnerHost, clientHost := hosts[:3], hosts[3], hosts[4]
+
+	// the operator lists every bootstrap node, but each one only has the addrs of the previous
+	cmn.SetBootstrapPeers([]peer.AddrInfo{{ID: boots[0].ID()}, {ID: boots[1].ID()}, {ID: boots[2].ID()}})
+	clusters := make([]*Cluster, len(boots))
+	for i, h := range boots {
+		clusters[i] = NewCluster(h, cmn.NewPeerClassifier(h), WithInterval(50*time.Millisecond))
+		if i > 0 {
+			clusters[i].Join(addrInfo(boots[i-1]))
+		}
+		clusters[i].Start(ctx)
+	}
+
+	if err := runnerHost.Connect(ctx, addrInfo(boots[0])); err != nil {
+		t.Fatalf("Failed to connect runner: %v", err)
+	}
+	clusters[0].classifier.SetRole(runnerHost.ID(), cmn.RoleRunner)
+
+	for i, c := range clusters {
+		waitFor(t, ctx, "full membership", func() bool { return len(c.Members()) == len(boots) })
+		t.Logf("bootstrap %d sees %d members", i, len(c.Members()))
+	}
+	waitFor(t, ctx, "runner gossiped to the last bootstrap", func() bool {
+		return len(clusters[2].Sample(cmn.RoleRunner, 0)) == 1
+	})
+
+	// a new node that knows only the last bootstrap finds everything else
+	known := []peer.AddrInfo{addrInfo(boots[2])}
+	cmn.SetBootstrapPeers(known)
+	if err := clientHost.Connect(ctx, known[0]); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	resp, err := Expand(ctx, clientHost, known)
+	if err != nil {
+		t.Fatalf("Expand() error = %v", err)
+	}
+	if len(resp.Bootstraps) != len(boots) {
+		t.Errorf("Expand() found %d bootstraps, want %d", len(resp.Bootstraps), len(boots))
+	}
+	if len(resp.Runners) != 1 || resp.Runners[0].ID != runnerHost.ID() {
+		t.Errorf("Expand() runners = %v, want %s", resp.Runners, runnerHost.ID())
+	}
+	for _, b := range boots {
+		if !cmn.IsBootstrapPeer(b.ID()) {
+			t.Errorf("%s was not added to the bootstrap peer set", b.ID())
+		}
+	}
+}
+
+func TestClusterExpiresMembers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(2)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+	a, b := mn.Hosts()[0], mn.Hosts()[1]
+
+	defer cmn.SetBootstrapPeers(nil)
+	cmn.SetBootstrapPeers([]peer.AddrInfo{addrInfo(a), addrInfo(b)})
+
+	ca := NewCluster(a, cmn.NewPeerClassifier(a), WithInterval(50*time.Millisecond))
+	cb := NewCluster(b, cmn.NewPeerClassifier(b), WithInterval(50*time.Millisecond))
+	ca.Start(ctx)
+	cbCtx, stopB := context.WithCancel(ctx)
+	cb.Join(addrInfo(a))
+	cb.Start(cbCtx)
+
+	waitFor(t, ctx, "a learns b", func() bool { return len(ca.Members()) == 2 })
+
+	stopB()
+	// b is a configured bootstrap node, a refreshes it for as long as they are connected
+	if err := mn.UnlinkPeers(a.ID(), b.ID()); err != nil {
+		t.Fatalf("Failed to unlink b: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Failed to close b: %v", err)
+	}
+	waitFor(t, ctx, "b expires", func() bool { return len(ca.Members()) == 1 })
+}
+
+func TestClusterRefusesGossipFromNonMembers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	defer cmn.SetBootstrapPeers(nil)
+
+	mn, err := mocknet.FullMeshLinked(3)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+	boot, liar, fake := mn.Hosts()[0], mn.Hosts()[1], mn.Hosts()[2]
+	cmn.SetBootstrapPeers([]peer.AddrInfo{addrInfo(boot)})
+
+	c := NewCluster(boot, cmn.NewPeerClassifier(boot), WithInterval(50*time.Millisecond))
+	c.Start(ctx)
+
+	// the liar claims to be a bootstrap node in its agent version and pushes another one
+	if err := liar.Connect(ctx, addrInfo(boot)); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	boot.Peerstore().Put(liar.ID(), "AgentVersion", "mnwarm-bootstrap/1.0.0")
+	if role := c.classifier.Classify(liar.ID()); role != cmn.RoleBootstrap {
+		t.Fatalf("liar classified as %s, want it to pass for a bootstrap node", role)
+	}
+	s, err := liar.NewStream(ctx, boot.ID(), GossipProtocol)
+	if err != nil {
+		t.Fatalf("NewStream() error = %v", err)
+	}
+	forged := digest{Entries: []Entry{{Peer: addrInfo(fake), Role: cmn.RoleBootstrap.String(), Seen: time.Now()}}}
+	var theirs digest
+	if err := roundTrip(s, forged, &theirs); err == nil {
+		t.Error("gossip from a peer outside the cluster was answered")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	for _, m := range c.Members() {
+		if m.ID == fake.ID() || m.ID == liar.ID() {
+			t.Errorf("%s became a member of the cluster", m.ID)
+		}
+	}
+}
+
+func TestManifestDistribution(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	defer cmn.SetBootstrapPeers(nil)
+
+	operatorKey, operatorPub, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate operator key: %v", err)
+	}
+	forgerKey, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate forger key: %v", err)
+	}
+
+	mn, err := mocknet.FullMeshLinked(3)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+	boots, nodeHost := mn.Hosts()[:2], mn.Hosts()[2]
+
+	clusters := make([]*Cluster, len(boots))
+	for i, h := range boots {
+		clusters[i] = NewCluster(h, cmn.NewPeerClassifier(h), WithInterval(50*time.Millisecond), WithManifest(operatorPub))
+		if i > 0 {
+			clusters[i].Join(addrInfo(boots[i-1]))
+		}
+		clusters[i].Start(ctx)
+	}
+
+	sign := func(key crypto.PrivKey, version uint64) *cmn.SignedManifest {
+		t.Helper()
+		signed, err := cmn.SignManifest(&cmn.Manifest{
+			Version:    version,
+			Bootstraps: []string{addrInfo(boots[0]).Addrs[0].String() + "/p2p/" + boots[0].ID().String()},
+		}, key)
+		if err != nil {
+			t.Fatalf("Failed to sign manifest: %v", err)
+		}
+		return signed
+	}
+	if err := clusters[0].OfferManifest(sign(forgerKey, 9)); err == nil {
+		t.Fatal("OfferManifest() accepted a manifest signed by another key")
+	}
+	if err := clusters[0].OfferManifest(sign(operatorKey, 1)); err != nil {
+		t.Fatalf("OfferManifest() error = %v", err)
+	}
+
+	// the node only knows the second bootstrap node, which learns the manifest by gossip
+	cmn.SetBootstrapPeers([]peer.AddrInfo{addrInfo(boots[1])})
+	if err := nodeHost.Connect(ctx, addrInfo(boots[1])); err != nil {
+		t.Fatalf("Failed to connect node: %v", err)
+	}
+	watcher := NewManifestWatcher(nodeHost, operatorPub, 50*time.Millisecond)
+	updates := make(chan uint64, 4)
+	watcher.OnUpdate(func(m *cmn.Manifest) { updates <- m.Version })
+	watcher.Start(ctx)
+
+	for _, want := range []uint64{1, 2} {
+		if want == 2 {
+			if err := clusters[0].OfferManifest(sign(operatorKey, 2)); err != nil {
+				t.Fatalf("OfferManifest() error = %v", err)
+			}
+		}
+		select {
+		case got := <-updates:
+			if got != want {
+				t.Fatalf("watcher applied version %d, want %d", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("watcher never applied version %d", want)
+		}
+	}
+	if !cmn.IsBootstrapPeer(boots[0].ID()) {
+		t.Error("bootstrap node listed in the manifest was not added to the bootstrap peer set")
+	}
+}
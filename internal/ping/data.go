@@ -0,0 +1,36 @@
+package customprotocol
+
+import (
+	"context"
+
+	cmn "mnwarm/internal/shared"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// DataProtocol carries the content of a session from the runner to its client,
+// the client opens it once its session runs
+const DataProtocol = "/stream/data/0.0.1"
+
+// DataHandler sends the content of the session of from over s
+type DataHandler func(s network.Stream, from peer.ID)
+
+// SetDataHandler serves DataProtocol with handler, streams from peers without a session are reset
+func (p *PingProtocol) SetDataHandler(handler DataHandler) {
+	p.host.SetStreamHandler(DataProtocol, func(s network.Stream) {
+		from := s.Conn().RemotePeer()
+		if !p.isStreamingTo(from) {
+			log.Warnf("data stream from %s without a session", from)
+			s.Reset()
+			return
+		}
+		handler(s, from)
+	})
+}
+
+// OpenDataStream opens the data stream of our session on target. it is a bulk transfer,
+// so it waits for a hole punch before it falls back to a limited relayed connection
+func (p *PingProtocol) OpenDataStream(ctx context.Context, target peer.ID) (network.Stream, error) {
+	return p.OpenStream(ctx, target, DataProtocol, cmn.BulkStream)
+}
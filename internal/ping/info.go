@@ -1,7 +1,9 @@
 package customprotocol
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 
 	p2p "mnwarm/internal/ping/pb"
 
@@ -35,6 +37,10 @@ func (h *InfoRequestHandler) Handle(s network.Stream, from peer.ID, data []byte)
 		"arch":   "amd64",
 		"uptime": "null",
 	}
+	for k, v := range h.protocol.advertisedSystemConfig() {
+		systemConfig[k] = v
+	}
+	systemConfig[SessionsKey] = strconv.Itoa(h.protocol.sessionCount())
 
 	resp := &p2p.InfoResponse{
 		HostId:        h.protocol.host.ID().String(),
@@ -45,7 +51,7 @@ func (h *InfoRequestHandler) Handle(s network.Stream, from peer.ID, data []byte)
 		SystemConfig:  systemConfig,
 	}
 
-	ok := h.protocol.sendProtoMessage(s.Conn().RemotePeer(), infoResponse, resp)
+	ok := h.protocol.sendProtoMessage(context.Background(), s.Conn().RemotePeer(), infoResponse, resp)
 
 	if ok {
 		log.Infof("%s: InfoResponse sent to %s.", h.protocol.host.ID().String(), from.String())
@@ -55,7 +61,7 @@ func (h *InfoRequestHandler) Handle(s network.Stream, from peer.ID, data []byte)
 	}
 
 	log.Infof("Sent InfoResponse to %s: HostID=%s, PublicIP=%s", from, resp.HostId, resp.PublicIp)
-	h.protocol.done <- true
+	h.protocol.signalDone()
 	return nil
 }
 
@@ -73,6 +79,7 @@ func (h *InfoResponseHandler) Handle(s network.Stream, from peer.ID, data []byte
 
 	log.Infof("Received InfoResponse from %s: HostID=%s, PublicIP=%s, PrivateIP=%s, IsPublic=%v, ClientVersion=%s, SystemConfig=%v",
 		from, resp.HostId, resp.PublicIp, resp.PrivateIp, resp.IsPublic, resp.ClientVersion, resp.SystemConfig)
-	h.protocol.done <- true
+	h.protocol.deliver(from, infoResponse, &resp)
+	h.protocol.signalDone()
 	return nil
 }
@@ -13,6 +13,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/network"
 
 	p2p "mnwarm/internal/ping/pb"
+	cmn "mnwarm/internal/shared"
 
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -22,8 +23,6 @@ import (
 
 var log = logging.Logger("ping-log")
 
-var isStreaming = false
-
 /*
 generate in /ping:
 protoc --go_out=. --go_opt=paths=source_relative pb/p2p.proto
@@ -50,12 +49,24 @@ type ProtocolHandler interface {
 	Handle(s network.Stream, from peer.ID, data []byte) error
 }
 
+// RPCObserver is told the outcome of every message we send, rtt is only set for round trips
+type RPCObserver interface {
+	RecordRPC(pid peer.ID, success bool, rtt time.Duration)
+}
+
 // PingProtocol type
 type PingProtocol struct {
 	host             host.Host
 	mu               sync.Mutex
 	requestHandlers  map[protocol.ID]ProtocolHandler
 	responseHandlers map[protocol.ID]ProtocolHandler
+	systemConfig     map[string]string                    // advertised attributes added to every InfoResponse. Protected by mu
+	configSources    []func() map[string]string           // attributes read on every InfoRequest. Protected by mu
+	waiters          map[responseKey][]chan proto.Message // callers blocked on a response. Protected by mu
+	rpcObserver      RPCObserver                          // optional, set before use
+	sessions         map[peer.ID]*p2p.Id                  // peers we are streaming to. Protected by mu
+	capacity         int                                  // max concurrent sessions. Protected by mu
+	controller       StreamController                     // optional, runs the streams behind sessions
 	// requests map[string]*p2p.PingRequest // used to access request data from response handlers. Protected by mu
 	done chan bool // only for demo purposes to stop main from terminating
 }
@@ -66,6 +77,10 @@ func NewPingProtocol(host host.Host, done chan bool) *PingProtocol {
 		done:             done,
 		requestHandlers:  make(map[protocol.ID]ProtocolHandler),
 		responseHandlers: make(map[protocol.ID]ProtocolHandler),
+		systemConfig:     make(map[string]string),
+		waiters:          make(map[responseKey][]chan proto.Message),
+		sessions:         make(map[peer.ID]*p2p.Id),
+		capacity:         1,
 	}
 	logging.SetLogLevel("ping-log", "debug")
 
@@ -80,6 +95,7 @@ func NewPingProtocol(host host.Host, done chan bool) *PingProtocol {
 	p.registerResponseHandler(stopStreamResponse, &StopStreamResponseHandler{protocol: p})
 	p.registerResponseHandler(statusResponse, &StatusResponseHandler{protocol: p})
 	p.registerResponseHandler(infoResponse, &InfoResponseHandler{protocol: p})
+	p.watchSessions()
 
 	// requests := []string{
 	// 	pingRequest,
@@ -107,6 +123,51 @@ func NewPingProtocol(host host.Host, done chan bool) *PingProtocol {
 	return p
 }
 
+// SetRPCObserver installs an observer for rpc outcomes, call it before sending anything
+func (p *PingProtocol) SetRPCObserver(observer RPCObserver) {
+	p.rpcObserver = observer
+}
+
+func (p *PingProtocol) recordRPC(pid peer.ID, success bool, rtt time.Duration) {
+	if p.rpcObserver != nil {
+		p.rpcObserver.RecordRPC(pid, success, rtt)
+	}
+}
+
+// SetSystemConfig sets extra key/values sent back in InfoResponse.SystemConfig,
+// runners use it to publish their capacity, region and projects
+func (p *PingProtocol) SetSystemConfig(config map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, v := range config {
+		p.systemConfig[k] = v
+	}
+}
+
+// AddSystemConfigSource adds key/values read on every InfoRequest, for attributes
+// that change too often to be set with SetSystemConfig
+func (p *PingProtocol) AddSystemConfigSource(source func() map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.configSources = append(p.configSources, source)
+}
+
+func (p *PingProtocol) advertisedSystemConfig() map[string]string {
+	p.mu.Lock()
+	out := make(map[string]string, len(p.systemConfig))
+	for k, v := range p.systemConfig {
+		out[k] = v
+	}
+	sources := append([]func() map[string]string(nil), p.configSources...)
+	p.mu.Unlock()
+	for _, source := range sources {
+		for k, v := range source() {
+			out[k] = v
+		}
+	}
+	return out
+}
+
 func (p *PingProtocol) registerRequestHandler(protocolID protocol.ID, handler ProtocolHandler) {
 	p.requestHandlers[protocolID] = handler
 	p.host.SetStreamHandler(protocol.ID(protocolID), p.onProtocolRequest)
@@ -190,7 +251,7 @@ func (p *PingProtocol) Ping(target peer.ID) bool {
 	}
 
 	// Send the ping request using the Ping Protocol
-	ok := p.sendProtoMessage(target, pingRequest, req)
+	ok := p.sendProtoMessage(context.Background(), target, pingRequest, req)
 	if !ok {
 		return false
 	}
@@ -215,7 +276,7 @@ func (p *PingProtocol) StartStream(target peer.ID, projectID, devID, apiKey, iss
 	}
 
 	// Send StartStreamRequest
-	ok := p.sendProtoMessage(target, startStreamRequest, req)
+	ok := p.sendProtoMessage(context.Background(), target, startStreamRequest, req)
 	if !ok {
 		return false
 	}
@@ -236,7 +297,7 @@ func (p *PingProtocol) StopStream(target peer.ID, projectID, devID, apiKey strin
 		},
 	}
 
-	ok := p.sendProtoMessage(target, stopStreamRequest, req)
+	ok := p.sendProtoMessage(context.Background(), target, stopStreamRequest, req)
 	if !ok {
 		return false
 	}
@@ -257,7 +318,7 @@ func (p *PingProtocol) Status(target peer.ID, projectID, devID, apiKey string) b
 		},
 	}
 
-	ok := p.sendProtoMessage(target, statusRequest, req)
+	ok := p.sendProtoMessage(context.Background(), target, statusRequest, req)
 	if !ok {
 		return false
 	}
@@ -274,7 +335,7 @@ func (p *PingProtocol) Info(target peer.ID, hostID string) bool {
 		HostId: hostID,
 	}
 
-	ok := p.sendProtoMessage(target, infoRequest, req)
+	ok := p.sendProtoMessage(context.Background(), target, infoRequest, req)
 	if !ok {
 		return false
 	}
@@ -285,48 +346,54 @@ func (p *PingProtocol) Info(target peer.ID, hostID string) bool {
 
 // helper method - writes a protobuf go data object to a network stream
 // data: reference of protobuf go data object to send (not the object itself)
-// s: network stream to write the data to
-func (p *PingProtocol) sendProtoMessage(id peer.ID, pid protocol.ID, data proto.Message) bool {
-	log.Info(p.host.Peerstore().PeersWithAddrs())
-	s, err := p.host.NewStream(context.Background(), id, pid)
-	// network.WithAllowLimitedConn(context.Background(), string(pid))
+// requests and responses are small, so they may go over a limited relayed connection
+func (p *PingProtocol) sendProtoMessage(ctx context.Context, id peer.ID, pid protocol.ID, data proto.Message) bool {
+	bytes, err := proto.Marshal(data)
 	if err != nil {
 		log.Error(err)
 		return false
 	}
-	defer s.Close()
 
-	bytes, err := proto.Marshal(data)
+	s, err := cmn.OpenStream(ctx, p.host, id, cmn.ControlStream, pid)
 	if err != nil {
 		log.Error(err)
+		p.recordRPC(id, false, 0)
 		return false
 	}
+	defer s.Close()
 
 	n, err := s.Write(bytes)
 	if err != nil {
 		log.Errorf("%d, '%+v'", n, err)
 		s.Reset()
 
-		retry := true
-		if retry {
-			log.Warnf("retry protoMessage is true, trying to stream again!")
-			peers := p.host.Network().Peers()
-			log.Debugf("peers %s=V", peers)
-			time.Sleep(2 * time.Second)
-			stream, err := p.host.NewStream(network.WithAllowLimitedConn(context.Background(), string(pid)), id, pid)
-			if err != nil {
-				log.Error(err)
-			}
-			defer stream.Close()
-			n, err := stream.Write(bytes)
-			if err != nil {
-				log.Errorf("%d, '%+v'", n, err)
-				stream.Reset()
-				return false
-			}
-		} else {
+		log.Warnf("write to %s failed, retrying once", id)
+		select {
+		case <-time.After(2 * time.Second):
+		case <-ctx.Done():
+			p.recordRPC(id, false, 0)
+			return false
+		}
+		stream, err := cmn.OpenStream(ctx, p.host, id, cmn.ControlStream, pid)
+		if err != nil {
+			log.Error(err)
+			p.recordRPC(id, false, 0)
+			return false
+		}
+		defer stream.Close()
+		n, err := stream.Write(bytes)
+		if err != nil {
+			log.Errorf("%d, '%+v'", n, err)
+			stream.Reset()
+			p.recordRPC(id, false, 0)
 			return false
 		}
 	}
 	return true
 }
+
+// OpenStream opens a stream of kind to target for a protocol served next to this one,
+// bulk transfers wait for a hole punch before they fall back to the relay
+func (p *PingProtocol) OpenStream(ctx context.Context, target peer.ID, pid protocol.ID, kind cmn.StreamKind) (network.Stream, error) {
+	return cmn.OpenStream(ctx, p.host, target, kind, pid)
+}
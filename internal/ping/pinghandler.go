@@ -1,6 +1,7 @@
 package customprotocol
 
 import (
+	"context"
 	"fmt"
 
 	p2p "mnwarm/internal/ping/pb"
@@ -32,7 +33,7 @@ func (h *PingRequestHandler) Handle(s network.Stream, from peer.ID, data []byte)
 		Message:     fmt.Sprintf("Ping response from %s", h.protocol.host.ID()),
 	}
 
-	ok := h.protocol.sendProtoMessage(s.Conn().RemotePeer(), pingResponse, resp)
+	ok := h.protocol.sendProtoMessage(context.Background(), s.Conn().RemotePeer(), pingResponse, resp)
 
 	if ok {
 		log.Infof("%s: %T response to %s sent.", s.Conn().LocalPeer().String(), resp, s.Conn().RemotePeer().String())
@@ -41,7 +42,7 @@ func (h *PingRequestHandler) Handle(s network.Stream, from peer.ID, data []byte)
 	}
 
 	log.Infof("Sent PingResponse to %s: %s", from, resp.MessageData)
-	h.protocol.done <- true
+	h.protocol.signalDone()
 	return nil
 }
 
@@ -54,6 +55,6 @@ func (h *PingResponseHandler) Handle(s network.Stream, from peer.ID, data []byte
 	}
 
 	log.Infof("Received PingResponse from %s: %s", from, resp.MessageData)
-	h.protocol.done <- true
+	h.protocol.signalDone()
 	return nil
 }
@@ -0,0 +1,171 @@
+package customprotocol
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	p2p "mnwarm/internal/ping/pb"
+	cmn "mnwarm/internal/shared"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// StatusRejected prefixes the StartStreamResponse status when the StreamController refused the stream
+const StatusRejected = "REJECTED"
+
+// SessionGracePeriod is how long a session outlives the last connection to its peer,
+// a client that reconnects within it keeps its session
+var SessionGracePeriod = 30 * time.Second
+
+// StreamController runs the streams behind sessions. StartStream is called before the
+// session is accepted, an error rejects it. StopStream is called once it ends
+type StreamController interface {
+	StartStream(from peer.ID, req *p2p.StartStreamRequest) error
+	StopStream(from peer.ID, id *p2p.Id)
+}
+
+// SetStreamController must be called before the protocol serves requests
+func (p *PingProtocol) SetStreamController(c StreamController) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.controller = c
+}
+
+// SetCapacity sets how many sessions may run at once, running sessions are kept
+func (p *PingProtocol) SetCapacity(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.capacity = n
+}
+
+func (p *PingProtocol) Capacity() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.capacity
+}
+
+// startSession accepts a StartStreamRequest from a peer and returns the response status
+func (p *PingProtocol) startSession(from peer.ID, req *p2p.StartStreamRequest) string {
+	p.mu.Lock()
+	if _, ok := p.sessions[from]; ok {
+		p.mu.Unlock()
+		return StatusAlreadyStreaming
+	}
+	if len(p.sessions) >= p.capacity {
+		p.mu.Unlock()
+		return StatusBusy
+	}
+	// hold the slot while the controller starts the stream
+	p.sessions[from] = req.Id
+	controller := p.controller
+	p.mu.Unlock()
+
+	if controller != nil {
+		if err := controller.StartStream(from, req); err != nil {
+			log.Warnf("stream for %s rejected: %v", from, err)
+			p.mu.Lock()
+			delete(p.sessions, from)
+			p.mu.Unlock()
+			return StatusRejected + ": " + err.Error()
+		}
+	}
+	p.host.ConnManager().Protect(from, cmn.StreamingTag)
+	return StatusSuccess
+}
+
+// stopSession ends the session of a peer, false when it had none
+func (p *PingProtocol) stopSession(from peer.ID) bool {
+	p.mu.Lock()
+	id, ok := p.sessions[from]
+	delete(p.sessions, from)
+	controller := p.controller
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	p.host.ConnManager().Unprotect(from, cmn.StreamingTag)
+	if controller != nil {
+		controller.StopStream(from, id)
+	}
+	return true
+}
+
+// watchSessions frees the session of a peer once it has been gone for SessionGracePeriod,
+// a client that exits or stops answering without a StopStreamRequest would hold it forever
+func (p *PingProtocol) watchSessions() {
+	p.host.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			pid := conn.RemotePeer()
+			if !p.isStreamingTo(pid) || len(n.ConnsToPeer(pid)) > 0 {
+				return
+			}
+			time.AfterFunc(SessionGracePeriod, func() {
+				if len(p.host.Network().ConnsToPeer(pid)) > 0 {
+					return
+				}
+				if p.stopSession(pid) {
+					log.Infof("ended stream session with %s, it disconnected", pid)
+				}
+			})
+		},
+	})
+}
+
+func (p *PingProtocol) isStreamingTo(from peer.ID) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.sessions[from]
+	return ok
+}
+
+func (p *PingProtocol) sessionCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sessions)
+}
+
+// Sessions are the peers we are currently streaming to
+func (p *PingProtocol) Sessions() map[peer.ID]*p2p.Id {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make(map[peer.ID]*p2p.Id, len(p.sessions))
+	for pid, id := range p.sessions {
+		out[pid] = id
+	}
+	return out
+}
+
+// EndSession stops the session of a peer and tells it with an unsolicited
+// StopStreamResponse within ctx, false when it had none
+func (p *PingProtocol) EndSession(ctx context.Context, pid peer.ID) bool {
+	p.mu.Lock()
+	id, ok := p.sessions[pid]
+	p.mu.Unlock()
+	if !ok || !p.stopSession(pid) {
+		return false
+	}
+
+	log.Infof("ending stream session with %s", pid)
+	resp := &p2p.StopStreamResponse{Id: id}
+	if ok := p.sendProtoMessage(ctx, pid, stopStreamResponse, resp); !ok {
+		log.Warnf("could not send end of stream to %s", pid)
+	}
+	return true
+}
+
+// EndSessions ends every session at once, used on shutdown. peers we can't tell
+// before ctx is done still lose their session
+func (p *PingProtocol) EndSessions(ctx context.Context) {
+	var wg sync.WaitGroup
+	for pid := range p.Sessions() {
+		wg.Add(1)
+		go func(pid peer.ID) {
+			defer wg.Done()
+			p.EndSession(ctx, pid)
+		}(pid)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,63 @@
+package customprotocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	p2p "mnwarm/internal/ping/pb"
+)
+
+func TestSessionEndsWhenClientLeaves(t *testing.T) {
+	grace := SessionGracePeriod
+	SessionGracePeriod = 100 * time.Millisecond
+	defer func() { SessionGracePeriod = grace }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mn, err := mocknet.FullMeshLinked(2)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+	runnerHost, clientHost := mn.Hosts()[0], mn.Hosts()[1]
+	p := NewPingProtocol(runnerHost, make(chan bool))
+
+	connect := func() {
+		t.Helper()
+		if _, err := mn.ConnectPeers(clientHost.ID(), runnerHost.ID()); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+	}
+	connect()
+	req := &p2p.StartStreamRequest{Id: &p2p.Id{ProjectId: "p1"}}
+	if status := p.startSession(clientHost.ID(), req); status != StatusSuccess {
+		t.Fatalf("startSession() = %s", status)
+	}
+
+	// a client that comes back within the grace period keeps its session
+	if err := mn.DisconnectPeers(clientHost.ID(), runnerHost.ID()); err != nil {
+		t.Fatalf("Failed to disconnect: %v", err)
+	}
+	connect()
+	time.Sleep(3 * SessionGracePeriod)
+	if !p.isStreamingTo(clientHost.ID()) {
+		t.Fatal("session ended although the client reconnected")
+	}
+
+	if err := mn.DisconnectPeers(clientHost.ID(), runnerHost.ID()); err != nil {
+		t.Fatalf("Failed to disconnect: %v", err)
+	}
+	for p.isStreamingTo(clientHost.ID()) {
+		select {
+		case <-time.After(20 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("session of a client that left was never freed")
+		}
+	}
+	if n := p.sessionCount(); n != 0 {
+		t.Errorf("sessionCount() = %d, want 0", n)
+	}
+}
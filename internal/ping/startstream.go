@@ -1,6 +1,7 @@
 package customprotocol
 
 import (
+	"context"
 	"fmt"
 
 	p2p "mnwarm/internal/ping/pb"
@@ -25,17 +26,12 @@ func (h *StartStreamRequestHandler) Handle(s network.Stream, from peer.ID, data
 	log.Infof("Received StartStreamRequest from %s: ProjectID=%s, DevID=%s, APIKey=%s, IssueNeed=%s, ConfigOptions=%v",
 		from, req.Id.ProjectId, req.Id.DevId, req.Id.ApiKey, req.RequestIssueNeed, req.ConfigOptions)
 
-	// TODO: logic!
-	statusMessage := "unknown"
-
-	if !isStreaming {
+	statusMessage := h.protocol.startSession(from, &req)
+	isStreaming := statusMessage == StatusSuccess || statusMessage == StatusAlreadyStreaming
+	if statusMessage == StatusSuccess {
 		log.Info("WE ARE NOW STREAMING")
-		isStreaming = true
-		statusMessage = "SUCCESS" //replace str with proto value
 	} else {
-		log.Warn("WE ARE ALREADY STRAMING")
-		// isStreaming = true
-		statusMessage = "ALREADY_STREAMING"
+		log.Warnf("stream not started: %s", statusMessage)
 	}
 
 	resp := &p2p.StartStreamResponse{
@@ -44,7 +40,7 @@ func (h *StartStreamRequestHandler) Handle(s network.Stream, from peer.ID, data
 		StatusMessage: statusMessage,
 	}
 
-	ok := h.protocol.sendProtoMessage(s.Conn().RemotePeer(), startStreamResponse, resp)
+	ok := h.protocol.sendProtoMessage(context.Background(), s.Conn().RemotePeer(), startStreamResponse, resp)
 
 	if ok {
 		log.Infof("%s: %T response to %s sent.", s.Conn().LocalPeer().String(), resp, s.Conn().RemotePeer().String())
@@ -54,7 +50,7 @@ func (h *StartStreamRequestHandler) Handle(s network.Stream, from peer.ID, data
 	}
 
 	log.Infof("Sent StartStreamResponse to %s: IsStreaming=%v, StatusMessage=%s", from, isStreaming, statusMessage)
-	h.protocol.done <- true
+	h.protocol.signalDone()
 	return nil
 }
 
@@ -72,6 +68,7 @@ func (h *StartStreamResponseHandler) Handle(s network.Stream, from peer.ID, data
 
 	log.Infof("Received StartStreamResponse from %s: IsStreaming=%v, StatusMessage=%s",
 		from, resp.IsStreaming, resp.StatusMessage)
-	h.protocol.done <- true
+	h.protocol.deliver(from, startStreamResponse, &resp)
+	h.protocol.signalDone()
 	return nil
 }
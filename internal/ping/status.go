@@ -1,6 +1,7 @@
 package customprotocol
 
 import (
+	"context"
 	"fmt"
 
 	p2p "mnwarm/internal/ping/pb"
@@ -28,6 +29,7 @@ func (h *StatusRequestHandler) Handle(s network.Stream, from peer.ID, data []byt
 	// logic here
 	statusMessage := "unknown"
 
+	isStreaming := h.protocol.isStreamingTo(from)
 	if isStreaming {
 		statusMessage = "Stream is active"
 	} else {
@@ -39,7 +41,7 @@ func (h *StatusRequestHandler) Handle(s network.Stream, from peer.ID, data []byt
 		StatusMessage: statusMessage,
 	}
 
-	ok := h.protocol.sendProtoMessage(s.Conn().RemotePeer(), statusResponse, resp)
+	ok := h.protocol.sendProtoMessage(context.Background(), s.Conn().RemotePeer(), statusResponse, resp)
 
 	if ok {
 		log.Infof("%s: StatusResponse sent to %s.", h.protocol.host.ID().String(), from.String())
@@ -49,7 +51,7 @@ func (h *StatusRequestHandler) Handle(s network.Stream, from peer.ID, data []byt
 	}
 
 	log.Infof("Sent StatusResponse to %s: IsStreaming=%v, StatusMessage=%s", from, isStreaming, statusMessage)
-	h.protocol.done <- true
+	h.protocol.signalDone()
 	return nil
 }
 
@@ -67,6 +69,7 @@ func (h *StatusResponseHandler) Handle(s network.Stream, from peer.ID, data []by
 
 	log.Infof("Received StatusResponse from %s: IsStreaming=%v, StatusMessage=%s",
 		from, resp.IsStreaming, resp.StatusMessage)
-	h.protocol.done <- true
+	h.protocol.deliver(from, statusResponse, &resp)
+	h.protocol.signalDone()
 	return nil
 }
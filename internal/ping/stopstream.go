@@ -1,6 +1,7 @@
 package customprotocol
 
 import (
+	"context"
 	"fmt"
 
 	p2p "mnwarm/internal/ping/pb"
@@ -28,19 +29,18 @@ func (h *StopStreamRequestHandler) Handle(s network.Stream, from peer.ID, data [
 	//logic here
 	statusMessage := "unknown"
 
-	if !isStreaming {
+	if !h.protocol.stopSession(from) {
 		log.Info("WE WERE NOT STREAMING")
 		statusMessage = "NOT_STREAMING_PREVIOUSLY" //replace str with proto value
 	} else {
 		log.Info("STOPPED ACTIVE STREAM")
-		isStreaming = false
 		statusMessage = "STREAM_STOPPED"
 	}
 	resp := &p2p.StopStreamResponse{
 		Id: &p2p.Id{ProjectId: req.Id.ProjectId, DevId: req.Id.DevId, ApiKey: req.Id.ApiKey},
 	}
 
-	ok := h.protocol.sendProtoMessage(s.Conn().RemotePeer(), stopStreamResponse, resp)
+	ok := h.protocol.sendProtoMessage(context.Background(), s.Conn().RemotePeer(), stopStreamResponse, resp)
 
 	if ok {
 		log.Infof("%s: StopStreamResponse sent to %s.", h.protocol.host.ID().String(), from.String())
@@ -49,8 +49,8 @@ func (h *StopStreamRequestHandler) Handle(s network.Stream, from peer.ID, data [
 		return err
 	}
 
-	log.Infof("Sent StopStreamResponse to %s", from, isStreaming, statusMessage)
-	h.protocol.done <- true
+	log.Infof("Sent StopStreamResponse to %s: %s", from, statusMessage)
+	h.protocol.signalDone()
 	return nil
 }
 
@@ -67,6 +67,7 @@ func (h *StopStreamResponseHandler) Handle(s network.Stream, from peer.ID, data
 	}
 
 	log.Infof("Received StopStreamResponse from %s", from)
-	h.protocol.done <- true
+	h.protocol.deliver(from, stopStreamResponse, &resp)
+	h.protocol.signalDone()
 	return nil
 }
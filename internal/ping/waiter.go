@@ -0,0 +1,166 @@
+package customprotocol
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	p2p "mnwarm/internal/ping/pb"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	proto "google.golang.org/protobuf/proto"
+)
+
+// StartStreamResponse status messages
+const (
+	StatusSuccess          = "SUCCESS"
+	StatusAlreadyStreaming = "ALREADY_STREAMING"
+	StatusBusy             = "BUSY"
+)
+
+// SessionsKey is the InfoResponse.SystemConfig key holding the number of active streams
+const SessionsKey = "sessions"
+
+// responseKey identifies a response we are waiting on
+type responseKey struct {
+	from     peer.ID
+	protocol protocol.ID
+}
+
+// signalDone tells main an exchange finished, without blocking handlers when nobody listens
+func (p *PingProtocol) signalDone() {
+	select {
+	case p.done <- true:
+	default:
+	}
+}
+
+// expect registers interest in the next response of protocolID from a peer,
+// it must be called before the request is sent so the response can't be missed
+func (p *PingProtocol) expect(from peer.ID, protocolID protocol.ID) (<-chan proto.Message, func()) {
+	key := responseKey{from: from, protocol: protocolID}
+	ch := make(chan proto.Message, 1)
+
+	p.mu.Lock()
+	p.waiters[key] = append(p.waiters[key], ch)
+	p.mu.Unlock()
+
+	cancel := func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		waiters := p.waiters[key]
+		for i, w := range waiters {
+			if w == ch {
+				p.waiters[key] = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(p.waiters[key]) == 0 {
+			delete(p.waiters, key)
+		}
+	}
+	return ch, cancel
+}
+
+// deliver hands a response to the oldest waiter for it, if any
+func (p *PingProtocol) deliver(from peer.ID, protocolID protocol.ID, msg proto.Message) {
+	key := responseKey{from: from, protocol: protocolID}
+
+	p.mu.Lock()
+	waiters := p.waiters[key]
+	if len(waiters) == 0 {
+		p.mu.Unlock()
+		return
+	}
+	ch := waiters[0]
+	p.waiters[key] = waiters[1:]
+	if len(p.waiters[key]) == 0 {
+		delete(p.waiters, key)
+	}
+	p.mu.Unlock()
+
+	ch <- msg
+}
+
+func (p *PingProtocol) roundTrip(ctx context.Context, target peer.ID, reqProtocol, respProtocol protocol.ID, req proto.Message) (proto.Message, time.Duration, error) {
+	ch, cancel := p.expect(target, respProtocol)
+	defer cancel()
+
+	start := time.Now()
+	if ok := p.sendProtoMessage(ctx, target, reqProtocol, req); !ok {
+		return nil, 0, fmt.Errorf("failed to send %s to %s", reqProtocol, target)
+	}
+
+	select {
+	case msg := <-ch:
+		rtt := time.Since(start)
+		p.host.Peerstore().RecordLatency(target, rtt)
+		p.recordRPC(target, true, rtt)
+		return msg, rtt, nil
+	case <-ctx.Done():
+		p.recordRPC(target, false, 0)
+		return nil, 0, fmt.Errorf("no %s from %s: %w", respProtocol, target, ctx.Err())
+	}
+}
+
+// RequestInfo sends an InfoRequest and waits for the InfoResponse, the round trip time is also
+// recorded in the peerstore latency
+func (p *PingProtocol) RequestInfo(ctx context.Context, target peer.ID, hostID string) (*p2p.InfoResponse, time.Duration, error) {
+	req := &p2p.InfoRequest{HostId: hostID}
+	msg, rtt, err := p.roundTrip(ctx, target, infoRequest, infoResponse, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	return msg.(*p2p.InfoResponse), rtt, nil
+}
+
+// RequestStartStream sends a StartStreamRequest and waits for the StartStreamResponse
+func (p *PingProtocol) RequestStartStream(ctx context.Context, target peer.ID, projectID, devID, apiKey, issueNeed string, configOptions map[string]string) (*p2p.StartStreamResponse, error) {
+	req := &p2p.StartStreamRequest{
+		Id: &p2p.Id{
+			ProjectId: projectID,
+			DevId:     devID,
+			ApiKey:    apiKey,
+		},
+		RequestIssueNeed: issueNeed,
+		ConfigOptions:    configOptions,
+	}
+	msg, _, err := p.roundTrip(ctx, target, startStreamRequest, startStreamResponse, req)
+	if err != nil {
+		return nil, err
+	}
+	return msg.(*p2p.StartStreamResponse), nil
+}
+
+// RequestStatus sends a StatusRequest and waits for the StatusResponse
+func (p *PingProtocol) RequestStatus(ctx context.Context, target peer.ID, projectID, devID, apiKey string) (*p2p.StatusResponse, error) {
+	req := &p2p.StatusRequest{
+		Id: &p2p.Id{
+			ProjectId: projectID,
+			DevId:     devID,
+			ApiKey:    apiKey,
+		},
+	}
+	msg, _, err := p.roundTrip(ctx, target, statusRequest, statusResponse, req)
+	if err != nil {
+		return nil, err
+	}
+	return msg.(*p2p.StatusResponse), nil
+}
+
+// RequestStopStream sends a StopStreamRequest and waits for the StopStreamResponse
+func (p *PingProtocol) RequestStopStream(ctx context.Context, target peer.ID, projectID, devID, apiKey string) (*p2p.StopStreamResponse, error) {
+	req := &p2p.StopStreamRequest{
+		Id: &p2p.Id{
+			ProjectId: projectID,
+			DevId:     devID,
+			ApiKey:    apiKey,
+		},
+	}
+	msg, _, err := p.roundTrip(ctx, target, stopStreamRequest, stopStreamResponse, req)
+	if err != nil {
+		return nil, err
+	}
+	return msg.(*p2p.StopStreamResponse), nil
+}
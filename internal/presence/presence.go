@@ -0,0 +1,239 @@
+// Package presence is a GossipSub channel on which runners announce themselves and
+// their free capacity, so clients keep a live view of available runners instead of
+// polling each runner for its status.
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	discovery "mnwarm/internal/discovery"
+)
+
+var log = logging.Logger("presencelog")
+
+// Topic is the GossipSub topic runners publish presence on
+const Topic = "/mnwarm/presence/1.0.0"
+
+// DefaultInterval is how often a runner announces itself when nothing changes,
+// views forget runners not heard from for three intervals
+const DefaultInterval = 10 * time.Second
+
+// Presence is what a runner announces. GossipSub signs every message with the
+// runner's key and the validator only accepts a presence about the signer itself
+type Presence struct {
+	ID       peer.ID               `json:"id"`
+	Addrs    []string              `json:"addrs"`
+	Attrs    discovery.RunnerAttrs `json:"attrs"`
+	Sessions int                   `json:"sessions"`
+	Sent     time.Time             `json:"sent"`
+}
+
+// Free is the number of advertised slots not in use
+func (p Presence) Free() int {
+	return p.Attrs.Capacity - p.Sessions
+}
+
+// Channel is our membership of the presence topic
+type Channel struct {
+	host      host.Host
+	ps        *pubsub.PubSub
+	topic     *pubsub.Topic
+	stopRelay pubsub.RelayCancelFunc
+}
+
+// NewGossipSub starts the GossipSub router on h, one per host
+func NewGossipSub(ctx context.Context, h host.Host) (*pubsub.PubSub, error) {
+	return pubsub.NewGossipSub(ctx, h, pubsub.WithMessageSignaturePolicy(pubsub.StrictSign))
+}
+
+// Join validates and joins the presence topic
+func Join(h host.Host, ps *pubsub.PubSub) (*Channel, error) {
+	if err := ps.RegisterTopicValidator(Topic, validate); err != nil {
+		return nil, err
+	}
+	topic, err := ps.Join(Topic)
+	if err != nil {
+		ps.UnregisterTopicValidator(Topic)
+		return nil, err
+	}
+	return &Channel{host: h, ps: ps, topic: topic}, nil
+}
+
+// validate drops presence about someone other than the signer and stale or broken messages
+func validate(_ context.Context, _ peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	var p Presence
+	if err := json.Unmarshal(msg.Data, &p); err != nil {
+		return pubsub.ValidationReject
+	}
+	if p.ID != msg.GetFrom() || p.Attrs.Capacity < 0 || p.Sessions < 0 {
+		return pubsub.ValidationReject
+	}
+	// gossip may deliver an announcement long after it was sent
+	if time.Since(p.Sent) > 2*time.Minute {
+		return pubsub.ValidationIgnore
+	}
+	return pubsub.ValidationAccept
+}
+
+// Relay forwards presence without subscribing, bootstrap nodes do this since every
+// runner and client is connected to them but not to each other
+func (c *Channel) Relay() error {
+	stop, err := c.topic.Relay()
+	if err != nil {
+		return err
+	}
+	c.stopRelay = stop
+	return nil
+}
+
+// Close leaves the topic
+func (c *Channel) Close() error {
+	if c.stopRelay != nil {
+		c.stopRelay()
+	}
+	err := c.topic.Close()
+	return errors.Join(err, c.ps.UnregisterTopicValidator(Topic))
+}
+
+// Publish announces p, ID and Sent are filled in
+func (c *Channel) Publish(ctx context.Context, p Presence) error {
+	p.ID = c.host.ID()
+	p.Sent = time.Now()
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return c.topic.Publish(ctx, b)
+}
+
+// Publisher announces a runner every interval and whenever Update is called
+type Publisher struct {
+	channel  *Channel
+	interval time.Duration
+	state    func() Presence
+	update   chan struct{}
+}
+
+// StartPublishing publishes what state returns until ctx is done
+func (c *Channel) StartPublishing(ctx context.Context, interval time.Duration, state func() Presence) *Publisher {
+	p := &Publisher{channel: c, interval: interval, state: state, update: make(chan struct{}, 1)}
+	go p.loop(ctx)
+	return p
+}
+
+// Update publishes right away, for session and capacity changes
+func (p *Publisher) Update() {
+	select {
+	case p.update <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Publisher) loop(ctx context.Context) {
+	for {
+		if err := p.channel.Publish(ctx, p.state()); err != nil && ctx.Err() == nil {
+			log.Warnf("could not publish presence: %v", err)
+		}
+		select {
+		case <-time.After(p.interval):
+		case <-p.update:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// View is the live set of runners heard on the channel
+type View struct {
+	host        host.Host
+	expireAfter time.Duration
+
+	mu      sync.Mutex
+	runners map[peer.ID]heard
+}
+
+// heard is a presence and when we received it, expiry goes by our clock not the runner's
+type heard struct {
+	presence Presence
+	at       time.Time
+}
+
+// Watch subscribes to the channel until ctx is done, runners not heard from for
+// expireAfter drop out of the view
+func (c *Channel) Watch(ctx context.Context, expireAfter time.Duration) (*View, error) {
+	sub, err := c.topic.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+	v := &View{host: c.host, expireAfter: expireAfter, runners: make(map[peer.ID]heard)}
+	go func() {
+		defer sub.Cancel()
+		for {
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				return
+			}
+			var p Presence
+			if err := json.Unmarshal(msg.Data, &p); err != nil {
+				continue
+			}
+			v.see(p)
+		}
+	}()
+	return v, nil
+}
+
+func (v *View) see(p Presence) {
+	if p.ID == v.host.ID() {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if old, ok := v.runners[p.ID]; ok && old.presence.Sent.After(p.Sent) {
+		return
+	}
+	v.runners[p.ID] = heard{presence: p, at: time.Now()}
+}
+
+// Runners are the runners heard from recently, most free slots first
+func (v *View) Runners() []Presence {
+	cutoff := time.Now().Add(-v.expireAfter)
+	v.mu.Lock()
+	out := make([]Presence, 0, len(v.runners))
+	for pid, h := range v.runners {
+		if h.at.Before(cutoff) {
+			delete(v.runners, pid)
+			continue
+		}
+		out = append(out, h.presence)
+	}
+	v.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Free() != out[j].Free() {
+			return out[i].Free() > out[j].Free()
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Available are the runners serving project with a free slot
+func (v *View) Available(project string) []Presence {
+	var out []Presence
+	for _, p := range v.Runners() {
+		if p.Free() > 0 && p.Attrs.Serves(project) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,93 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	discovery "mnwarm/internal/discovery"
+)
+
+func TestPresenceThroughRelayingPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(4)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+	hosts := mn.Hosts()
+	runnerHost, bootHost, clientHost, forgerHost := hosts[0], hosts[1], hosts[2], hosts[3]
+
+	channels := make(map[peer.ID]*Channel)
+	for _, h := range hosts {
+		ps, err := NewGossipSub(ctx, h)
+		if err != nil {
+			t.Fatalf("Failed to start gossipsub: %v", err)
+		}
+		if channels[h.ID()], err = Join(h, ps); err != nil {
+			t.Fatalf("Join() error = %v", err)
+		}
+	}
+	if err := channels[bootHost.ID()].Relay(); err != nil {
+		t.Fatalf("Relay() error = %v", err)
+	}
+	// runner, client and forger only reach each other through the bootstrap node
+	for _, h := range []peer.ID{runnerHost.ID(), clientHost.ID(), forgerHost.ID()} {
+		if _, err := mn.ConnectPeers(h, bootHost.ID()); err != nil {
+			t.Fatalf("Failed to connect peers: %v", err)
+		}
+	}
+
+	view, err := channels[clientHost.ID()].Watch(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+
+	var sessions atomic.Int32
+	attrs := discovery.RunnerAttrs{Projects: []string{"p1"}, Capacity: 1}
+	publisher := channels[runnerHost.ID()].StartPublishing(ctx, 100*time.Millisecond, func() Presence {
+		return Presence{Attrs: attrs, Sessions: int(sessions.Load())}
+	})
+
+	// a peer announcing someone else must be dropped by the validator
+	forged, err := json.Marshal(Presence{ID: runnerHost.ID(), Attrs: discovery.RunnerAttrs{Capacity: 99}, Sent: time.Now()})
+	if err != nil {
+		t.Fatalf("Failed to marshal forged presence: %v", err)
+	}
+
+	if err := channels[forgerHost.ID()].topic.Publish(ctx, forged); err == nil {
+		t.Error("publishing a presence about another peer passed validation")
+	}
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for !cond() {
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	waitFor("runner available", func() bool {
+		available := view.Available("p1")
+		return len(available) == 1 && available[0].ID == runnerHost.ID()
+	})
+	if got := view.Available("p2"); len(got) != 0 {
+		t.Errorf("Available(p2) = %v, want none", got)
+	}
+
+	sessions.Store(1)
+	publisher.Update()
+	waitFor("runner full", func() bool {
+		return len(view.Available("p1")) == 0 && len(view.Runners()) == 1
+	})
+}
@@ -0,0 +1,246 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	discovery "mnwarm/internal/discovery"
+	ping "mnwarm/internal/ping"
+	p2p "mnwarm/internal/ping/pb"
+	cmn "mnwarm/internal/shared"
+)
+
+var log = logging.Logger("schedulerlog")
+
+// ErrNoRunner is returned when no candidate accepted the stream
+var ErrNoRunner = errors.New("no runner accepted the stream")
+
+// Candidate is what we know about a discovered runner
+type Candidate struct {
+	ID       peer.ID
+	Attrs    discovery.RunnerAttrs
+	Sessions int
+	Relayed  bool
+	Latency  time.Duration
+	Failures int
+	LastSeen time.Time
+}
+
+// Free is the number of advertised slots not in use
+func (c Candidate) Free() int {
+	return c.Attrs.Capacity - c.Sessions
+}
+
+// Score ranks candidates, higher is better. full runners and runners that
+// stopped answering sink to the bottom but are never dropped
+func Score(c Candidate) float64 {
+	capacity := c.Attrs.Capacity
+	if capacity <= 0 {
+		capacity = 1
+	}
+
+	score := 100.0
+	score -= 50 * float64(c.Sessions) / float64(capacity)
+	if c.Free() <= 0 {
+		score -= 100
+	}
+	if c.Relayed {
+		score -= 20
+	}
+	latencyPenalty := float64(c.Latency.Milliseconds()) / 10
+	if latencyPenalty > 30 {
+		latencyPenalty = 30
+	}
+	score -= latencyPenalty
+	bonus := capacity
+	if bonus > 10 {
+		bonus = 10
+	}
+	score += 2 * float64(bonus)
+	score -= 25 * float64(c.Failures)
+	return score
+}
+
+// StreamRequest is what the client wants a runner to stream
+type StreamRequest struct {
+	ProjectID     string
+	DevID         string
+	APIKey        string
+	IssueNeed     string
+	ConfigOptions map[string]string
+}
+
+// Scheduler collects runner info and places StartStream on the best runner
+type Scheduler struct {
+	host           host.Host
+	protocol       *ping.PingProtocol
+	project        string
+	hostID         string
+	requestTimeout time.Duration
+
+	mu         sync.Mutex
+	candidates map[peer.ID]*Candidate
+}
+
+func New(h host.Host, protocol *ping.PingProtocol, project, hostID string, requestTimeout time.Duration) *Scheduler {
+	return &Scheduler{
+		host:           h,
+		protocol:       protocol,
+		project:        project,
+		hostID:         hostID,
+		requestTimeout: requestTimeout,
+		candidates:     make(map[peer.ID]*Candidate),
+	}
+}
+
+// Observe asks a runner for its info and updates its candidate entry.
+// runners not serving our project are forgotten
+func (s *Scheduler) Observe(ctx context.Context, pid peer.ID) error {
+	ctx, cancel := context.WithTimeout(ctx, s.requestTimeout)
+	defer cancel()
+
+	resp, rtt, err := s.protocol.RequestInfo(ctx, pid, s.hostID)
+	if err != nil {
+		s.recordFailure(pid)
+		return fmt.Errorf("info from %s: %w", pid, err)
+	}
+
+	attrs := discovery.ParseRunnerAttrs(resp.SystemConfig)
+	if !attrs.Serves(s.project) {
+		log.Infof("runner %s does not serve project %s", pid, s.project)
+		s.Forget(pid)
+		return nil
+	}
+	sessions, _ := strconv.Atoi(resp.SystemConfig[ping.SessionsKey])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.candidate(pid)
+	c.Attrs = attrs
+	c.Sessions = sessions
+	c.Relayed = cmn.IsRelayedPeer(s.host, pid)
+	c.Latency = rtt
+	c.Failures = 0
+	c.LastSeen = time.Now()
+	log.Debugf("runner %s: %+v score %.1f", pid, *c, Score(*c))
+	return nil
+}
+
+// Forget drops a runner, for example once it disconnects
+func (s *Scheduler) Forget(pid peer.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.candidates, pid)
+}
+
+// Candidates are the known runners, best first
+func (s *Scheduler) Candidates() []Candidate {
+	s.mu.Lock()
+	out := make([]Candidate, 0, len(s.candidates))
+	for _, c := range s.candidates {
+		out = append(out, *c)
+	}
+	s.mu.Unlock()
+
+	sort.SliceStable(out, func(i, j int) bool {
+		si, sj := Score(out[i]), Score(out[j])
+		if si != sj {
+			return si > sj
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Place sends StartStream to the best runner, moving on to the next one
+// when a runner is busy, rejects the stream or does not answer in time.
+// a runner already streaming to us is returned as is
+func (s *Scheduler) Place(ctx context.Context, req StreamRequest) (peer.ID, *p2p.StartStreamResponse, error) {
+	candidates := s.Candidates()
+	if len(candidates) == 0 {
+		return "", nil, ErrNoRunner
+	}
+
+	for _, c := range candidates {
+		if ctx.Err() != nil {
+			return "", nil, ctx.Err()
+		}
+		log.Infof("placing stream on runner %s (score %.1f)", c.ID, Score(c))
+
+		reqCtx, cancel := context.WithTimeout(ctx, s.requestTimeout)
+		resp, err := s.protocol.RequestStartStream(reqCtx, c.ID, req.ProjectID, req.DevID, req.APIKey, req.IssueNeed, req.ConfigOptions)
+		cancel()
+		if err != nil {
+			log.Warnf("runner %s did not answer StartStream: %v", c.ID, err)
+			s.recordFailure(c.ID)
+			s.abandon(ctx, c.ID, req)
+			continue
+		}
+		switch {
+		case resp.StatusMessage == ping.StatusSuccess:
+		case resp.StatusMessage == ping.StatusAlreadyStreaming:
+			log.Infof("runner %s already streams to us", c.ID)
+			return c.ID, resp, nil
+		case resp.StatusMessage == ping.StatusBusy:
+			log.Warnf("runner %s is busy", c.ID)
+			s.recordBusy(c.ID)
+			continue
+		default:
+			log.Warnf("runner %s did not take the stream: %s", c.ID, resp.StatusMessage)
+			continue
+		}
+
+		s.mu.Lock()
+		if cur, ok := s.candidates[c.ID]; ok {
+			cur.Sessions++
+		}
+		s.mu.Unlock()
+		return c.ID, resp, nil
+	}
+	return "", nil, ErrNoRunner
+}
+
+// abandon stops the stream on a runner that did not answer StartStream in time, it may
+// have started it anyway and we are about to ask another runner
+func (s *Scheduler) abandon(ctx context.Context, pid peer.ID, req StreamRequest) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.requestTimeout)
+	defer cancel()
+	if _, err := s.protocol.RequestStopStream(ctx, pid, req.ProjectID, req.DevID, req.APIKey); err != nil {
+		log.Debugf("could not stop the stream on runner %s: %v", pid, err)
+	}
+}
+
+// candidate returns the entry for pid, creating it. caller must hold mu
+func (s *Scheduler) candidate(pid peer.ID) *Candidate {
+	c, ok := s.candidates[pid]
+	if !ok {
+		c = &Candidate{ID: pid}
+		s.candidates[pid] = c
+	}
+	return c
+}
+
+func (s *Scheduler) recordFailure(pid peer.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.candidates[pid]; ok {
+		c.Failures++
+	}
+}
+
+func (s *Scheduler) recordBusy(pid peer.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.candidates[pid]; ok && c.Sessions < c.Attrs.Capacity {
+		c.Sessions = c.Attrs.Capacity
+	}
+}
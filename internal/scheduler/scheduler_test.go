@@ -0,0 +1,154 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	discovery "mnwarm/internal/discovery"
+	ping "mnwarm/internal/ping"
+	p2p "mnwarm/internal/ping/pb"
+)
+
+func TestScore(t *testing.T) {
+	idle := Candidate{ID: "idle", Attrs: discovery.RunnerAttrs{Capacity: 2}, Latency: 20 * time.Millisecond}
+
+	tests := []struct {
+		name  string
+		worse Candidate
+	}{
+		{
+			name:  "Loaded runner ranks below idle runner",
+			worse: Candidate{ID: "loaded", Attrs: discovery.RunnerAttrs{Capacity: 2}, Sessions: 1, Latency: 20 * time.Millisecond},
+		},
+		{
+			name:  "Full runner ranks below idle runner",
+			worse: Candidate{ID: "full", Attrs: discovery.RunnerAttrs{Capacity: 2}, Sessions: 2},
+		},
+		{
+			name:  "Relayed runner ranks below direct runner",
+			worse: Candidate{ID: "relayed", Attrs: discovery.RunnerAttrs{Capacity: 2}, Relayed: true, Latency: 20 * time.Millisecond},
+		},
+		{
+			name:  "Slow runner ranks below fast runner",
+			worse: Candidate{ID: "slow", Attrs: discovery.RunnerAttrs{Capacity: 2}, Latency: 250 * time.Millisecond},
+		},
+		{
+			name:  "Failing runner ranks below answering runner",
+			worse: Candidate{ID: "failing", Attrs: discovery.RunnerAttrs{Capacity: 2}, Latency: 20 * time.Millisecond, Failures: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if Score(tt.worse) >= Score(idle) {
+				t.Errorf("Score(%s) = %.1f, want below Score(idle) = %.1f", tt.worse.ID, Score(tt.worse), Score(idle))
+			}
+		})
+	}
+}
+
+func TestCandidatesOrder(t *testing.T) {
+	s := New(nil, nil, "", "", time.Second)
+	s.candidates["b"] = &Candidate{ID: "b", Attrs: discovery.RunnerAttrs{Capacity: 1}, Sessions: 1}
+	s.candidates["a"] = &Candidate{ID: "a", Attrs: discovery.RunnerAttrs{Capacity: 1}}
+	s.candidates["c"] = &Candidate{ID: "c", Attrs: discovery.RunnerAttrs{Capacity: 1}, Relayed: true}
+
+	got := s.Candidates()
+	want := []string{"a", "c", "b"}
+	if len(got) != len(want) {
+		t.Fatalf("Candidates() got %d, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if string(got[i].ID) != want[i] {
+			t.Errorf("Candidates()[%d] = %s, want %s", i, got[i].ID, want[i])
+		}
+	}
+}
+
+// fakeController starts streams after delay and fails them with err
+type fakeController struct {
+	delay time.Duration
+	err   error
+
+	mu      sync.Mutex
+	stopped int
+}
+
+func (f *fakeController) StartStream(from peer.ID, req *p2p.StartStreamRequest) error {
+	time.Sleep(f.delay)
+	return f.err
+}
+
+func (f *fakeController) StopStream(from peer.ID, id *p2p.Id) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopped++
+}
+
+func (f *fakeController) stops() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stopped
+}
+
+func TestPlace(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mn, err := mocknet.FullMeshConnected(4)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+	clientHost := mn.Hosts()[0]
+	s := New(clientHost, ping.NewPingProtocol(clientHost, make(chan bool)), "p1", "", 200*time.Millisecond)
+
+	runner := func(h host.Host, c *fakeController, score int) *ping.PingProtocol {
+		p := ping.NewPingProtocol(h, make(chan bool))
+		p.SetStreamController(c)
+		// higher capacity ranks first
+		s.candidates[h.ID()] = &Candidate{ID: h.ID(), Attrs: discovery.RunnerAttrs{Capacity: score}}
+		return p
+	}
+	slow := &fakeController{delay: time.Second}
+	slowProto := runner(mn.Hosts()[1], slow, 3)
+	rejecting := &fakeController{err: errors.New("not today")}
+	runner(mn.Hosts()[2], rejecting, 2)
+	ok := &fakeController{}
+	runner(mn.Hosts()[3], ok, 1)
+
+	req := StreamRequest{ProjectID: "p1"}
+	got, resp, err := s.Place(ctx, req)
+	if err != nil {
+		t.Fatalf("Place() error = %v", err)
+	}
+	if got != mn.Hosts()[3].ID() || resp.StatusMessage != ping.StatusSuccess {
+		t.Errorf("Place() = %s, %s, want the runner that accepts", got, resp.StatusMessage)
+	}
+	if c := s.candidates[mn.Hosts()[2].ID()]; c.Sessions != 0 {
+		t.Errorf("rejecting runner has %d sessions, it should not be marked full", c.Sessions)
+	}
+
+	// the slow runner started the stream after all, it must not stay held by us
+	for slow.stops() == 0 || len(slowProto.Sessions()) != 0 {
+		select {
+		case <-time.After(20 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("stream on the runner that timed out was never stopped")
+		}
+	}
+
+	// a runner that already streams to us is reused instead of holding a second one
+	delete(s.candidates, mn.Hosts()[1].ID())
+	delete(s.candidates, mn.Hosts()[2].ID())
+	s.candidates[mn.Hosts()[3].ID()].Sessions = 0
+	got, resp, err = s.Place(ctx, req)
+	if err != nil || got != mn.Hosts()[3].ID() || resp.StatusMessage != ping.StatusAlreadyStreaming {
+		t.Errorf("Place() = %s, %v, %v, want the runner we already hold", got, resp, err)
+	}
+}
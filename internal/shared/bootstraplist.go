@@ -0,0 +1,133 @@
+package common
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SignedBootstrapList is the on-disk bootstrap list, signed by an operator key.
+// the signature covers the addrs joined with newlines
+type SignedBootstrapList struct {
+	Addrs     []string `json:"addrs"`
+	Signature string   `json:"signature"`
+}
+
+func bootstrapListPayload(addrs []string) []byte {
+	return []byte(strings.Join(addrs, "\n"))
+}
+
+// SignBootstrapList signs addrs with the operator key
+func SignBootstrapList(addrs []string, privKey crypto.PrivKey) (*SignedBootstrapList, error) {
+	sig, err := privKey.Sign(bootstrapListPayload(addrs))
+	if err != nil {
+		return nil, fmt.Errorf("sign bootstrap list failed: %w", err)
+	}
+	return &SignedBootstrapList{
+		Addrs:     addrs,
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	}, nil
+}
+
+// Verify checks the list signature against the pinned operator key
+func (l *SignedBootstrapList) Verify(pubKey crypto.PubKey) error {
+	if pubKey == nil {
+		return errors.New("no operator key to verify bootstrap list")
+	}
+	sig, err := base64.StdEncoding.DecodeString(l.Signature)
+	if err != nil {
+		return fmt.Errorf("bad bootstrap list signature encoding: %w", err)
+	}
+	ok, err := pubKey.Verify(bootstrapListPayload(l.Addrs), sig)
+	if err != nil {
+		return fmt.Errorf("bootstrap list verify error: %w", err)
+	}
+	if !ok {
+		return errors.New("bootstrap list signature does not match operator key")
+	}
+	return nil
+}
+
+// DecodeOperatorKey decodes a base64 (libp2p config encoding) public key
+func DecodeOperatorKey(keyStr string) (crypto.PubKey, error) {
+	keyBytes, err := crypto.ConfigDecodeKey(strings.TrimSpace(keyStr))
+	if err != nil {
+		return nil, fmt.Errorf("decode operator key failed: %w", err)
+	}
+	pubKey, err := crypto.UnmarshalPublicKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal operator key failed: %w", err)
+	}
+	return pubKey, nil
+}
+
+// LoadBootstrapList reads a signed bootstrap list file, verifies it and parses the addrs
+func LoadBootstrapList(path string, pubKey crypto.PubKey) ([]peer.AddrInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to read bootstrap list '%s': %v", path, err)
+		log.Error(errMsg)
+		return nil, fmt.Errorf("bootstrap list read error: %w", err)
+	}
+
+	var list SignedBootstrapList
+	if err := json.Unmarshal(data, &list); err != nil {
+		errMsg := fmt.Sprintf("failed to decode bootstrap list '%s': %v", path, err)
+		log.Error(errMsg)
+		return nil, fmt.Errorf("bootstrap list decode error: %w", err)
+	}
+
+	if err := list.Verify(pubKey); err != nil {
+		log.Errorf("rejecting bootstrap list '%s': %v", path, err)
+		return nil, err
+	}
+
+	log.Infof("loaded %d signed bootstrap addrs from %s", len(list.Addrs), path)
+	return ParseBootstrap(list.Addrs)
+}
+
+// MergePeers appends peers not already in base, merging addrs of duplicates
+func MergePeers(base []peer.AddrInfo, extra []peer.AddrInfo) []peer.AddrInfo {
+	index := make(map[peer.ID]int, len(base))
+	for i, p := range base {
+		index[p.ID] = i
+	}
+	for _, p := range extra {
+		if i, ok := index[p.ID]; ok {
+			base[i].Addrs = append(base[i].Addrs, p.Addrs...)
+			continue
+		}
+		index[p.ID] = len(base)
+		base = append(base, p)
+	}
+	return base
+}
+
+// ResolveBootstrapPeers parses the command line bootstrap addrs, merges in the signed
+// bootstrap list when one is configured and fills BootstrapPeerIDs from the result
+func ResolveBootstrapPeers(bootstrapAddrs []string, listPath, operatorKey string) ([]peer.AddrInfo, error) {
+	bootstrapPeers, err := ParseBootstrap(bootstrapAddrs)
+
+	if listPath != "" {
+		pubKey, keyErr := DecodeOperatorKey(operatorKey)
+		if keyErr != nil {
+			log.Errorf("cannot verify bootstrap list without operator key: %v", keyErr)
+			return bootstrapPeers, keyErr
+		}
+		listPeers, listErr := LoadBootstrapList(listPath, pubKey)
+		if listErr != nil {
+			log.Errorf("signed bootstrap list not used: %v", listErr)
+			err = errors.Join(err, listErr)
+		}
+		bootstrapPeers = MergePeers(bootstrapPeers, listPeers)
+	}
+
+	SetBootstrapPeers(bootstrapPeers)
+	return bootstrapPeers, err
+}
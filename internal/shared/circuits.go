@@ -0,0 +1,239 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// CircuitRaceDelay is how long a circuit candidate gets before the next one is dialed
+// alongside it, a failed candidate starts the next one right away
+var CircuitRaceDelay = 250 * time.Millisecond
+
+// transportRank orders circuit candidates, QUIC first since it sets up in one round trip
+var transportRank = map[string]int{
+	"quic-v1":      0,
+	"quic":         0,
+	"webtransport": 1,
+	"tcp":          2,
+	"ws":           3,
+	"wss":          3,
+}
+
+// CircuitCandidate is one way to reach a peer through a relay: a relay addr and so a
+// transport, with the relay's round trip time when we measured it
+type CircuitCandidate struct {
+	Relay     peer.ID
+	Addr      multiaddr.Multiaddr
+	Transport string
+	RTT       time.Duration
+}
+
+// CircuitAddrs are the circuit addrs of target through relay, one for each relay addr.
+// relay addrs may end in the relay id or be circuit addrs themselves
+func CircuitAddrs(relay peer.AddrInfo, target peer.ID) ([]multiaddr.Multiaddr, error) {
+	return circuitAddrs(relay, fmt.Sprintf("/p2p/%s/p2p-circuit/p2p/%s", relay.ID, target))
+}
+
+// RelayedAddrs are the addrs we advertise for ourselves through relay, the ones
+// autorelay adds for a relay it holds a reservation on
+func RelayedAddrs(relay peer.AddrInfo) ([]multiaddr.Multiaddr, error) {
+	return circuitAddrs(relay, fmt.Sprintf("/p2p/%s/p2p-circuit", relay.ID))
+}
+
+func circuitAddrs(relay peer.AddrInfo, suffix string) ([]multiaddr.Multiaddr, error) {
+	circuit, err := multiaddr.NewMultiaddr(suffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create relay circuit multiaddr: %w", err)
+	}
+	seen := make(map[string]bool)
+	var out []multiaddr.Multiaddr
+	for _, a := range relay.Addrs {
+		base, _ := multiaddr.SplitFunc(a, func(c multiaddr.Component) bool {
+			code := c.Protocol().Code
+			return code == multiaddr.P_P2P || code == multiaddr.P_CIRCUIT
+		})
+		if base == nil || len(base.Bytes()) == 0 || seen[base.String()] {
+			continue
+		}
+		seen[base.String()] = true
+		out = append(out, base.Encapsulate(circuit))
+	}
+	return out, nil
+}
+
+// RankCircuitCandidates lists a candidate for every addr of every relay, QUIC before
+// WebTransport, TCP and WebSocket, and within a transport the relays we measured the
+// lowest round trip to first
+func RankCircuitCandidates(h host.Host, target peer.ID, relays ...peer.AddrInfo) []CircuitCandidate {
+	var candidates []CircuitCandidate
+	for _, relay := range relays {
+		if relay.ID == target || relay.ID == h.ID() {
+			continue
+		}
+		addrs, err := CircuitAddrs(relay, target)
+		if err != nil {
+			log.Warnf("no circuit addrs through %s: %v", relay.ID, err)
+			continue
+		}
+		rtt := h.Peerstore().LatencyEWMA(relay.ID)
+		for _, a := range addrs {
+			candidates = append(candidates, CircuitCandidate{Relay: relay.ID, Addr: a, Transport: AddrTransport(a), RTT: rtt})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ri, rj := rankTransport(candidates[i].Transport), rankTransport(candidates[j].Transport)
+		if ri != rj {
+			return ri < rj
+		}
+		// unmeasured relays go last
+		ti, tj := candidates[i].RTT, candidates[j].RTT
+		if (ti == 0) != (tj == 0) {
+			return tj == 0
+		}
+		return ti < tj
+	})
+	return candidates
+}
+
+func rankTransport(name string) int {
+	if rank, ok := transportRank[name]; ok {
+		return rank
+	}
+	return len(transportRank)
+}
+
+// dialCircuit connects to the relay over the candidate's own addr and then dials the
+// circuit through it. libp2p runs one circuit dial per target at a time, so it is the
+// relay leg the candidates race. a relay connection we already have is reused
+func dialCircuit(ctx context.Context, h host.Host, target peer.ID, c CircuitCandidate) error {
+	base, _ := multiaddr.SplitFunc(c.Addr, func(c multiaddr.Component) bool {
+		return c.Protocol().Code == multiaddr.P_P2P
+	})
+	if err := h.Connect(ctx, peer.AddrInfo{ID: c.Relay, Addrs: []multiaddr.Multiaddr{base}}); err != nil {
+		return fmt.Errorf("failed to connect to relay: %w", err)
+	}
+	return h.Connect(ctx, peer.AddrInfo{ID: target, Addrs: []multiaddr.Multiaddr{c.Addr}})
+}
+
+// circuitResult is how one candidate of a race went
+type circuitResult struct {
+	candidate CircuitCandidate
+	err       error
+}
+
+// usedCircuit is the circuit our relayed connection to target rides on. the swarm
+// merges concurrent dials to target and reuses relay connections we already had, so
+// it need not be the candidate whose dial returned first
+func usedCircuit(h host.Host, target peer.ID, winner CircuitCandidate) CircuitCandidate {
+	self, err := multiaddr.NewComponent("p2p", target.String())
+	if err != nil {
+		return winner
+	}
+	for _, conn := range h.Network().ConnsToPeer(target) {
+		addr := conn.RemoteMultiaddr()
+		if !IsCircuitAddr(addr) {
+			continue
+		}
+		// the remote addr is the relay connection's addr, then /p2p/<relay>/p2p-circuit
+		v, err := addr.ValueForProtocol(multiaddr.P_P2P)
+		if err != nil {
+			continue
+		}
+		relay, err := peer.Decode(v)
+		if err != nil {
+			continue
+		}
+		return CircuitCandidate{
+			Relay:     relay,
+			Addr:      addr.Encapsulate(self),
+			Transport: AddrTransport(addr),
+			RTT:       h.Peerstore().LatencyEWMA(relay),
+		}
+	}
+	return winner
+}
+
+// closeLosers waits for the dials still running and closes the relay connections
+// the race opened, except to keep and to the relays we were connected to before
+func closeLosers(h host.Host, results <-chan circuitResult, running int, held map[peer.ID]bool, keep peer.ID) {
+	for ; running > 0; running-- {
+		<-results
+	}
+	for relay, wasConnected := range held {
+		if wasConnected || relay == keep || h.Network().Connectedness(relay) != network.Connected {
+			continue
+		}
+		log.Debugf("closing connection to relay %s opened by a losing circuit candidate", relay)
+		if err := h.Network().ClosePeer(relay); err != nil {
+			log.Debugf("could not close connection to relay %s: %v", relay, err)
+		}
+	}
+}
+
+// ConnectViaRelays races the circuit candidates to target Happy Eyeballs style: the
+// best candidate is dialed first and every CircuitRaceDelay, or as soon as one fails,
+// the next one joins. the first connection wins and the other dials are cancelled,
+// the relay connections they opened are closed. it returns the circuit the
+// connection actually took
+func ConnectViaRelays(ctx context.Context, h host.Host, target peer.ID, relays ...peer.AddrInfo) (CircuitCandidate, error) {
+	candidates := RankCircuitCandidates(h, target, relays...)
+	if len(candidates) == 0 {
+		return CircuitCandidate{}, fmt.Errorf("no relay addrs to reach %s through", target)
+	}
+	held := make(map[peer.ID]bool)
+	for _, c := range candidates {
+		held[c.Relay] = h.Network().Connectedness(c.Relay) == network.Connected
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan circuitResult, len(candidates))
+	next, running := 0, 0
+	dialNext := func() <-chan time.Time {
+		c := candidates[next]
+		next++
+		running++
+		go func() {
+			results <- circuitResult{c, dialCircuit(ctx, h, target, c)}
+		}()
+		if next == len(candidates) {
+			return nil
+		}
+		return time.After(CircuitRaceDelay)
+	}
+
+	var errs []error
+	delay := dialNext()
+	for running > 0 {
+		select {
+		case <-delay:
+			delay = dialNext()
+		case res := <-results:
+			running--
+			if res.err == nil {
+				used := usedCircuit(h, target, res.candidate)
+				go closeLosers(h, results, running, held, used.Relay)
+				log.Infof("connected to %s through relay %s over %s", target, used.Relay, used.Transport)
+				return used, nil
+			}
+			log.Debugf("circuit %s failed: %v", res.candidate.Addr, res.err)
+			errs = append(errs, fmt.Errorf("%s: %w", res.candidate.Addr, res.err))
+			if next < len(candidates) {
+				delay = dialNext()
+			}
+		}
+	}
+	closeLosers(h, results, 0, held, "")
+	if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+	return CircuitCandidate{}, fmt.Errorf("could not reach %s through %d circuit candidates: %w", target, len(candidates), errors.Join(errs...))
+}
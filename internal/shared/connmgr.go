@@ -0,0 +1,223 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	bconnmgr "github.com/libp2p/go-libp2p/p2p/net/connmgr"
+)
+
+// connection manager tags
+const (
+	InfrastructureTag = "mnwarm-infra"  // protects bootstrap and relay connections
+	StreamingTag      = "mnwarm-stream" // protects peers with an active stream session
+	scoreTag          = "mnwarm-score"  // rpc score, lower values are trimmed first
+)
+
+// ConnManagerConfig are the connection manager watermarks
+type ConnManagerConfig struct {
+	LowWater    int
+	HighWater   int
+	GracePeriod time.Duration
+}
+
+// DefaultConnManagerConfig is sized for runners and clients, relays and bootstraps
+// pass bigger watermarks since every node in the swarm talks to them
+func DefaultConnManagerConfig() ConnManagerConfig {
+	return ConnManagerConfig{
+		LowWater:    64,
+		HighWater:   128,
+		GracePeriod: time.Minute,
+	}
+}
+
+// InfrastructureConnManagerConfig is for relays and bootstraps
+func InfrastructureConnManagerConfig() ConnManagerConfig {
+	return ConnManagerConfig{
+		LowWater:    512,
+		HighWater:   1024,
+		GracePeriod: time.Minute,
+	}
+}
+
+func NewConnManager(cfg ConnManagerConfig) (*bconnmgr.BasicConnMgr, error) {
+	cm, err := bconnmgr.NewConnManager(cfg.LowWater, cfg.HighWater, bconnmgr.WithGracePeriod(cfg.GracePeriod))
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to create connection manager: %v", err)
+		log.Error(errMsg)
+		return nil, fmt.Errorf("connection manager error: %w", err)
+	}
+	return cm, nil
+}
+
+// NewResourceManager uses the autoscaled default limits so connections stay bounded,
+// streams are left unlimited since the request/response protocols open one per message
+func NewResourceManager() (network.ResourceManager, error) {
+	streams := rcmgr.ResourceLimits{
+		Streams:         rcmgr.Unlimited,
+		StreamsInbound:  rcmgr.Unlimited,
+		StreamsOutbound: rcmgr.Unlimited,
+	}
+	cfg := rcmgr.PartialLimitConfig{
+		System:      streams,
+		Transient:   streams,
+		PeerDefault: streams,
+	}
+	limits := cfg.Build(rcmgr.DefaultLimits.AutoScale())
+
+	rm, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limits))
+	if err != nil {
+		errMsg := fmt.Sprintf("could not create new resource manager: %v", err)
+		log.Error(errMsg)
+		return nil, fmt.Errorf("resource manager error: %w", err)
+	}
+	return rm, nil
+}
+
+// ProtectInfrastructure keeps connections to bootstrap and relay peers out of trimming
+func ProtectInfrastructure(cm connmgr.ConnManager, peers ...peer.AddrInfo) {
+	for _, p := range peers {
+		cm.Protect(p.ID, InfrastructureTag)
+	}
+}
+
+type rpcStats struct {
+	success int
+	failure int
+	latency time.Duration // ewma of rpc round trips
+}
+
+// PeerScorer tracks rpc success rate and latency per peer and tags the connection
+// manager with the result, so misbehaving peers are trimmed before idle ones
+type PeerScorer struct {
+	cm    connmgr.ConnManager
+	mu    sync.Mutex
+	stats map[peer.ID]*rpcStats
+	net   network.Network // set by Watch, peers not connected to it are not kept. Protected by mu
+}
+
+func NewPeerScorer(cm connmgr.ConnManager) *PeerScorer {
+	return &PeerScorer{
+		cm:    cm,
+		stats: make(map[peer.ID]*rpcStats),
+	}
+}
+
+// RecordRPC records the outcome of one rpc, rtt is ignored when zero or on failure
+func (s *PeerScorer) RecordRPC(pid peer.ID, success bool, rtt time.Duration) {
+	s.mu.Lock()
+	if s.net != nil && s.net.Connectedness(pid) == network.NotConnected {
+		// there is no connection to tag, and nothing would forget the peer
+		s.mu.Unlock()
+		return
+	}
+	st, ok := s.stats[pid]
+	if !ok {
+		st = &rpcStats{}
+		s.stats[pid] = st
+	}
+	if success {
+		st.success++
+		if rtt > 0 {
+			if st.latency == 0 {
+				st.latency = rtt
+			} else {
+				st.latency = (st.latency*7 + rtt) / 8
+			}
+		}
+	} else {
+		st.failure++
+	}
+	score := scoreStats(*st)
+	s.mu.Unlock()
+
+	s.cm.TagPeer(pid, scoreTag, score)
+}
+
+// Score is the current connection manager value of pid
+func (s *PeerScorer) Score(pid peer.ID) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.stats[pid]
+	if !ok {
+		return 0
+	}
+	return scoreStats(*st)
+}
+
+// Forget drops the stats of a peer, Watch does once it disconnects
+func (s *PeerScorer) Forget(pid peer.ID) {
+	s.mu.Lock()
+	delete(s.stats, pid)
+	s.mu.Unlock()
+	s.cm.UntagPeer(pid, scoreTag)
+}
+
+// Watch follows h until ctx is done: every identify exchange counts as an rpc, so peers
+// are scored on nodes that mostly serve requests too, and peers are forgotten once
+// their last connection closes
+func (s *PeerScorer) Watch(ctx context.Context, h host.Host) error {
+	sub, err := h.EventBus().Subscribe([]any{
+		new(event.EvtPeerIdentificationCompleted),
+		new(event.EvtPeerIdentificationFailed),
+		new(event.EvtPeerConnectednessChanged),
+	})
+	if err != nil {
+		return fmt.Errorf("peer scorer error: %w", err)
+	}
+	s.mu.Lock()
+	s.net = h.Network()
+	s.mu.Unlock()
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case e := <-sub.Out():
+				switch e := e.(type) {
+				case event.EvtPeerIdentificationCompleted:
+					s.RecordRPC(e.Peer, true, h.Peerstore().LatencyEWMA(e.Peer))
+				case event.EvtPeerIdentificationFailed:
+					s.RecordRPC(e.Peer, false, 0)
+				case event.EvtPeerConnectednessChanged:
+					if e.Connectedness == network.NotConnected {
+						s.Forget(e.Peer)
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// scoreStats maps stats to [-50, 50]: mostly failing peers go negative so they sort
+// below peers we never talked to, fast reliable peers get up to 50
+func scoreStats(st rpcStats) int {
+	total := st.success + st.failure
+	if total == 0 {
+		return 0
+	}
+	rate := float64(st.success) / float64(total)
+	score := int(rate*80) - 50
+
+	if st.success > 0 {
+		latencyBonus := 20 - int(st.latency.Milliseconds()/25)
+		if latencyBonus < 0 {
+			latencyBonus = 0
+		}
+		score += latencyBonus
+	}
+	if score > 50 {
+		score = 50
+	}
+	return score
+}
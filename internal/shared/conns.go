@@ -0,0 +1,67 @@
+package common
+
+import (
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// IsCircuitAddr is true for /p2p-circuit addresses
+func IsCircuitAddr(addr multiaddr.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(multiaddr.P_CIRCUIT)
+	return err == nil
+}
+
+// IsRelayedConn is true for connections going through a relay circuit
+func IsRelayedConn(conn network.Conn) bool {
+	return conn.Stat().Limited || IsCircuitAddr(conn.RemoteMultiaddr())
+}
+
+// IsRelayedPeer is true when we have connections to pid and all of them are relayed
+func IsRelayedPeer(h host.Host, pid peer.ID) bool {
+	conns := h.Network().ConnsToPeer(pid)
+	if len(conns) == 0 {
+		return false
+	}
+	for _, conn := range conns {
+		if !IsRelayedConn(conn) {
+			return false
+		}
+	}
+	return true
+}
+
+// transportProtocols are the multiaddr protocols naming a transport, outermost last
+var transportProtocols = map[int]bool{
+	multiaddr.P_TCP:           true,
+	multiaddr.P_UDP:           true,
+	multiaddr.P_QUIC:          true,
+	multiaddr.P_QUIC_V1:       true,
+	multiaddr.P_WS:            true,
+	multiaddr.P_WSS:           true,
+	multiaddr.P_WEBTRANSPORT:  true,
+	multiaddr.P_WEBRTC_DIRECT: true,
+}
+
+// ConnTransport names the transport a connection uses, p2p-circuit for relayed ones
+func ConnTransport(conn network.Conn) string {
+	if IsCircuitAddr(conn.RemoteMultiaddr()) {
+		return multiaddr.ProtocolWithCode(multiaddr.P_CIRCUIT).Name
+	}
+	if t := conn.ConnState().Transport; t != "" {
+		return t
+	}
+	return AddrTransport(conn.RemoteMultiaddr())
+}
+
+// AddrTransport names the outermost transport of addr, empty when it has none
+func AddrTransport(addr multiaddr.Multiaddr) string {
+	name := ""
+	for _, p := range addr.Protocols() {
+		if transportProtocols[p.Code] {
+			name = p.Name
+		}
+	}
+	return name
+}
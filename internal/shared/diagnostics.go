@@ -0,0 +1,486 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	basichost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	"github.com/libp2p/go-libp2p/p2p/protocol/autonatv2"
+	autonatpb "github.com/libp2p/go-libp2p/p2p/protocol/autonatv2/pb"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// how many hole punch attempts a Diagnostics keeps, older ones are dropped
+const maxHolePunchHistory = 64
+
+// how long one AutoNAT v2 check may take
+const autonatCheckTimeout = 15 * time.Second
+
+// NAT mapping behaviors, see NATReport.Mapping
+const (
+	MappingUnknown             = "unknown"
+	MappingEndpointIndependent = "endpoint-independent"
+	MappingEndpointDependent   = "endpoint-dependent"
+)
+
+// Diagnostics follows what a host learns about its NAT: the addrs peers observe, its
+// port mappings, AutoNAT v2 checks and hole punch attempts. Set it in
+// HostConfig.Diagnostics before NewHost and ask for a Report
+type Diagnostics struct {
+	host    host.Host
+	autonat *autonatv2.AutoNAT
+	tracer  *HolePunchTracer
+
+	mu           sync.Mutex
+	natmgr       basichost.NATManager
+	observed     map[peer.ID]multiaddr.Multiaddr
+	reachability network.Reachability
+	holePunches  []HolePunchAttempt
+}
+
+func NewDiagnostics() *Diagnostics {
+	return &Diagnostics{observed: make(map[peer.ID]multiaddr.Multiaddr)}
+}
+
+// NATReport is what a node knows about its reachability, json tags keep it readable
+// when printed by the diagnose commands
+type NATReport struct {
+	Peer string    `json:"peer"`
+	Time time.Time `json:"time"`
+	// Reachability is the reachability libp2p assumes, forced for our roles
+	Reachability string   `json:"reachability"`
+	ListenAddrs  []string `json:"listen_addrs"`
+	Addrs        []string `json:"addrs"`
+	// Observed are our addrs as connected peers see them
+	Observed []ObservedAddr `json:"observed"`
+	// Mapping is the NAT mapping behavior guessed from Observed
+	Mapping     string             `json:"mapping"`
+	AutoNAT     []AddrCheck        `json:"autonat"`
+	PortMapping PortMapReport      `json:"port_mapping"`
+	Relays      []RelayReport      `json:"relays"`
+	HolePunches []HolePunchAttempt `json:"hole_punches"`
+	// HolePunchStats are the totals since the host started
+	HolePunchStats *HolePunchSummary `json:"hole_punch_stats,omitempty"`
+}
+
+// ObservedAddr is an addr peers see us on and how many of them do
+type ObservedAddr struct {
+	Addr      string `json:"addr"`
+	Observers int    `json:"observers"`
+}
+
+// AddrCheck is the AutoNAT v2 verdict on one of our addrs
+type AddrCheck struct {
+	Addr         string `json:"addr"`
+	Reachability string `json:"reachability,omitempty"`
+	DialStatus   string `json:"dial_status,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// PortMapReport is what UPnP or NAT-PMP did for us
+type PortMapReport struct {
+	Enabled       bool         `json:"enabled"`
+	NATDiscovered bool         `json:"nat_discovered"`
+	Mappings      []PortMapped `json:"mappings,omitempty"`
+}
+
+// PortMapped is a listen addr and the external addr the gateway mapped it to, empty when it did not
+type PortMapped struct {
+	Internal string `json:"internal"`
+	External string `json:"external,omitempty"`
+}
+
+// RelayReport is our state with one relay
+type RelayReport struct {
+	Relay     string `json:"relay"`
+	Connected bool   `json:"connected"`
+	// Reserved is true while we advertise circuit addrs through the relay
+	Reserved bool      `json:"reserved"`
+	Expiry   time.Time `json:"expiry,omitempty"`
+}
+
+// HolePunchAttempt is one DCUtR exchange with a peer, or the direct dial it starts with
+type HolePunchAttempt struct {
+	Peer    string        `json:"peer"`
+	Type    string        `json:"type"`
+	Started time.Time     `json:"started"`
+	Elapsed time.Duration `json:"elapsed"`
+	// Addrs are the remote addrs the hole punch tried, RTT the round trip over the relay
+	Addrs   []string      `json:"addrs,omitempty"`
+	RTT     time.Duration `json:"rtt,omitempty"`
+	Rounds  int           `json:"rounds,omitempty"`
+	Done    bool          `json:"done"`
+	Success bool          `json:"success"`
+	Error   string        `json:"error,omitempty"`
+	// RelayClosed is set once the relayed connection the hole punch started from closed,
+	// Direct tells whether a direct connection to the peer was left then
+	RelayClosed bool `json:"relay_closed,omitempty"`
+	Direct      bool `json:"direct,omitempty"`
+}
+
+// hole punch attempt types
+const (
+	HolePunchDirectDial    = "direct_dial"
+	HolePunchHolePunch     = "hole_punch"
+	HolePunchProtocolError = "protocol_error"
+)
+
+// natManager is the libp2p NAT manager constructor, it keeps the manager so Report
+// can read its mappings
+func (d *Diagnostics) natManager(n network.Network) basichost.NATManager {
+	m := basichost.NewNATManager(n)
+	d.mu.Lock()
+	d.natmgr = m
+	d.mu.Unlock()
+	return m
+}
+
+// Trace implements holepunch.EventTracer, the host's HolePunchTracer passes its events on
+func (d *Diagnostics) Trace(evt *holepunch.Event) {
+	at := time.Unix(0, evt.Timestamp)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch e := evt.Evt.(type) {
+	case *holepunch.DirectDialEvt:
+		d.addHolePunch(HolePunchAttempt{Peer: evt.Remote.String(), Type: HolePunchDirectDial, Started: at.Add(-e.EllapsedTime),
+			Elapsed: e.EllapsedTime, Done: true, Success: e.Success, Error: e.Error})
+	case *holepunch.ProtocolErrorEvt:
+		d.addHolePunch(HolePunchAttempt{Peer: evt.Remote.String(), Type: HolePunchProtocolError, Started: at, Done: true, Error: e.Error})
+	case *holepunch.StartHolePunchEvt:
+		d.addHolePunch(HolePunchAttempt{Peer: evt.Remote.String(), Type: HolePunchHolePunch, Started: at, Addrs: e.RemoteAddrs, RTT: e.RTT})
+	case *holepunch.HolePunchAttemptEvt:
+		if a := d.openHolePunch(evt.Remote); a != nil {
+			a.Rounds = e.Attempt
+		}
+	case *holepunch.EndHolePunchEvt:
+		if a := d.openHolePunch(evt.Remote); a != nil {
+			a.Elapsed, a.Done, a.Success, a.Error = e.EllapsedTime, true, e.Success, e.Error
+		}
+	}
+}
+
+func (d *Diagnostics) addHolePunch(a HolePunchAttempt) {
+	if len(d.holePunches) >= maxHolePunchHistory {
+		d.holePunches = d.holePunches[1:]
+	}
+	d.holePunches = append(d.holePunches, a)
+}
+
+// relayClosed marks the last hole punch with pid once its relayed connection closed
+func (d *Diagnostics) relayClosed(pid peer.ID, direct bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := len(d.holePunches) - 1; i >= 0; i-- {
+		a := &d.holePunches[i]
+		if a.Peer == pid.String() && a.Type == HolePunchHolePunch {
+			a.RelayClosed, a.Direct = true, direct
+			return
+		}
+	}
+}
+
+// holePunchHistory is a copy of the hole punch history, oldest first
+func (d *Diagnostics) holePunchHistory() []HolePunchAttempt {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]HolePunchAttempt{}, d.holePunches...)
+}
+
+// HolePunchStats are the hole punch stats of the host, empty when it does not hole punch
+func (d *Diagnostics) HolePunchStats() HolePunchSummary {
+	if d.tracer == nil {
+		return HolePunchSummary{}
+	}
+	return d.tracer.Stats()
+}
+
+// NATType is the NAT mapping behavior guessed from the addrs peers observe us on
+func (d *Diagnostics) NATType() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return mappingBehavior(d.observed)
+}
+
+// openHolePunch is the running hole punch with pid, nil when there is none
+func (d *Diagnostics) openHolePunch(pid peer.ID) *HolePunchAttempt {
+	for i := len(d.holePunches) - 1; i >= 0; i-- {
+		a := &d.holePunches[i]
+		if a.Peer == pid.String() && a.Type == HolePunchHolePunch && !a.Done {
+			return a
+		}
+	}
+	return nil
+}
+
+// start follows h until ctx is done, with AutoNAT v2 when cfg enables it
+func (d *Diagnostics) start(ctx context.Context, h host.Host, cfg HostConfig) error {
+	d.host = h
+	sub, err := h.EventBus().Subscribe([]any{
+		new(event.EvtPeerIdentificationCompleted),
+		new(event.EvtPeerConnectednessChanged),
+		new(event.EvtLocalReachabilityChanged),
+	})
+	if err != nil {
+		return err
+	}
+	if cfg.AutoNATv2 {
+		if err := d.startAutoNAT(h, cfg); err != nil {
+			sub.Close()
+			return err
+		}
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case e := <-sub.Out():
+				d.mu.Lock()
+				switch e := e.(type) {
+				case event.EvtPeerIdentificationCompleted:
+					if e.ObservedAddr != nil {
+						d.observed[e.Peer] = e.ObservedAddr
+					}
+				case event.EvtPeerConnectednessChanged:
+					// what a peer saw is stale once it is gone, our NAT may have rebound since
+					if e.Connectedness == network.NotConnected {
+						delete(d.observed, e.Peer)
+					}
+				case event.EvtLocalReachabilityChanged:
+					d.reachability = e.Reachability
+				}
+				d.mu.Unlock()
+			case <-ctx.Done():
+				if d.autonat != nil {
+					d.autonat.Close()
+				}
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// startAutoNAT runs AutoNAT v2 ourselves rather than through libp2p.EnableAutoNATv2,
+// which keeps its client out of reach. like libp2p, dial backs for others go out
+// through a second host on the same transports so they can't reuse our connections
+func (d *Diagnostics) startAutoNAT(h host.Host, cfg HostConfig) error {
+	opts := []libp2p.Option{
+		libp2p.NoListenAddrs,
+		libp2p.DisableRelay(),
+		libp2p.ResourceManager(&network.NullResourceManager{}),
+	}
+	for _, t := range cfg.Transports {
+		opts = append(opts, t.option())
+	}
+	for _, sec := range cfg.Security {
+		opts = append(opts, sec.option())
+	}
+	if len(cfg.PSK) > 0 {
+		opts = append(opts, libp2p.PrivateNetwork(cfg.PSK))
+	}
+	dialer, err := libp2p.New(opts...)
+	if err != nil {
+		return fmt.Errorf("autonat dialer host error: %w", err)
+	}
+	an, err := autonatv2.New(h, dialer)
+	if err == nil {
+		err = an.Start()
+	}
+	if err != nil {
+		dialer.Close()
+		return fmt.Errorf("autonat v2 error: %w", err)
+	}
+	d.autonat = an
+	return nil
+}
+
+// Report checks every addr we advertise with AutoNAT v2 and reports it together with
+// what the host learned so far. relays are the relays we should hold a reservation on
+func (d *Diagnostics) Report(ctx context.Context, relays ...peer.AddrInfo) (NATReport, error) {
+	if d.host == nil {
+		return NATReport{}, errors.New("diagnostics are not attached to a host")
+	}
+	h := d.host
+	report := NATReport{Peer: h.ID().String(), Time: time.Now()}
+	for _, a := range h.Network().ListenAddresses() {
+		report.ListenAddrs = append(report.ListenAddrs, a.String())
+	}
+	for _, a := range h.Addrs() {
+		report.Addrs = append(report.Addrs, a.String())
+	}
+
+	d.mu.Lock()
+	report.Reachability = d.reachability.String()
+	observed := make(map[peer.ID]multiaddr.Multiaddr, len(d.observed))
+	for pid, a := range d.observed {
+		observed[pid] = a
+	}
+	report.HolePunches = append([]HolePunchAttempt{}, d.holePunches...)
+	natmgr := d.natmgr
+	d.mu.Unlock()
+
+	report.Observed = countObserved(observed)
+	report.Mapping = mappingBehavior(observed)
+	report.PortMapping = portMappings(natmgr, h.Network().ListenAddresses())
+	report.Relays = relayReports(h, relays)
+	report.AutoNAT = d.checkAddrs(ctx, h.Addrs())
+	if d.tracer != nil {
+		stats := d.HolePunchStats()
+		report.HolePunchStats = &stats
+	}
+	return report, nil
+}
+
+// checkAddrs asks AutoNAT v2 servers to dial each public addr back, all at once
+func (d *Diagnostics) checkAddrs(ctx context.Context, addrs []multiaddr.Multiaddr) []AddrCheck {
+	// room for every addr up front, the goroutines write through pointers into checks
+	checks := make([]AddrCheck, 0, len(addrs))
+	var wg sync.WaitGroup
+	for _, a := range addrs {
+		if IsCircuitAddr(a) {
+			continue
+		}
+		checks = append(checks, AddrCheck{Addr: a.String()})
+		check := &checks[len(checks)-1]
+		switch {
+		case d.autonat == nil:
+			check.Error = "autonat v2 is disabled"
+		case !manet.IsPublicAddr(a):
+			check.Error = "private addr, not checked"
+		default:
+			wg.Add(1)
+			go func(a multiaddr.Multiaddr) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(ctx, autonatCheckTimeout)
+				defer cancel()
+				res, err := d.autonat.GetReachability(ctx, []autonatv2.Request{{Addr: a, SendDialData: true}})
+				if err != nil {
+					check.Error = err.Error()
+					return
+				}
+				check.Reachability = res.Reachability.String()
+				check.DialStatus = autonatpb.DialStatus_name[int32(res.Status)]
+			}(a)
+		}
+	}
+	wg.Wait()
+	return checks
+}
+
+func countObserved(observed map[peer.ID]multiaddr.Multiaddr) []ObservedAddr {
+	counts := make(map[string]int)
+	for _, a := range observed {
+		counts[a.String()]++
+	}
+	out := make([]ObservedAddr, 0, len(counts))
+	for a, n := range counts {
+		out = append(out, ObservedAddr{Addr: a, Observers: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Observers != out[j].Observers {
+			return out[i].Observers > out[j].Observers
+		}
+		return out[i].Addr < out[j].Addr
+	})
+	return out
+}
+
+// mappingBehavior compares the ports different peers see for the same public ip and
+// transport. we dial from our listen port, so a NAT that maps it to one port for every
+// destination is endpoint independent and hole punching works, one that picks a port
+// per destination is endpoint dependent and hole punching mostly fails. peers that see
+// a private or loopback addr reach us without crossing the NAT and don't count
+func mappingBehavior(observed map[peer.ID]multiaddr.Multiaddr) string {
+	type endpoint struct{ ip, transport string }
+	ports := make(map[endpoint]map[string]bool)
+	observers := make(map[endpoint]int)
+	for _, a := range observed {
+		if !manet.IsPublicAddr(a) {
+			continue
+		}
+		var ep endpoint
+		var port string
+		multiaddr.ForEach(a, func(c multiaddr.Component) bool {
+			switch c.Protocol().Code {
+			case multiaddr.P_IP4, multiaddr.P_IP6:
+				ep.ip = c.Value()
+				return true
+			case multiaddr.P_TCP, multiaddr.P_UDP:
+				ep.transport, port = c.Protocol().Name, c.Value()
+			}
+			return false
+		})
+		if ep.ip == "" || port == "" {
+			continue
+		}
+		if ports[ep] == nil {
+			ports[ep] = make(map[string]bool)
+		}
+		ports[ep][port] = true
+		observers[ep]++
+	}
+
+	mapping := MappingUnknown
+	for ep, n := range observers {
+		if n < 2 {
+			continue
+		}
+		if len(ports[ep]) > 1 {
+			return MappingEndpointDependent
+		}
+		mapping = MappingEndpointIndependent
+	}
+	return mapping
+}
+
+func portMappings(natmgr basichost.NATManager, listenAddrs []multiaddr.Multiaddr) PortMapReport {
+	if natmgr == nil {
+		return PortMapReport{}
+	}
+	report := PortMapReport{Enabled: true, NATDiscovered: natmgr.HasDiscoveredNAT()}
+	if !report.NATDiscovered {
+		return report
+	}
+	for _, a := range listenAddrs {
+		if manet.IsIPLoopback(a) {
+			continue
+		}
+		m := PortMapped{Internal: a.String()}
+		if external := natmgr.GetMapping(a); external != nil {
+			m.External = external.String()
+		}
+		report.Mappings = append(report.Mappings, m)
+	}
+	return report
+}
+
+func relayReports(h host.Host, relays []peer.AddrInfo) []RelayReport {
+	var out []RelayReport
+	for _, relay := range relays {
+		r := RelayReport{
+			Relay:     relay.ID.String(),
+			Connected: h.Network().Connectedness(relay.ID) == network.Connected,
+		}
+		for _, a := range h.Addrs() {
+			if !IsCircuitAddr(a) {
+				continue
+			}
+			if id, err := a.ValueForProtocol(multiaddr.P_P2P); err == nil && id == relay.ID.String() {
+				r.Reserved = true
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
@@ -0,0 +1,85 @@
+package common
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// CommonFlags are the optional flags every binary accepts before its positional args
+type CommonFlags struct {
+	BootstrapList string
+	OperatorKey   string
+	Manifest      string
+	DrainTimeout  time.Duration
+	ReadyTimeout  time.Duration
+	HealthAddr    string
+	Transports    string
+	Security      string
+	SwarmKeyFile  string
+	DataDir       string
+	Reachability  string
+}
+
+func RegisterCommonFlags(fs *flag.FlagSet) *CommonFlags {
+	f := &CommonFlags{}
+	fs.StringVar(&f.BootstrapList, "bootstrap-list", "", "path to a signed bootstrap list file")
+	fs.StringVar(&f.OperatorKey, "operator-key", "", "base64 operator public key that signs the bootstrap list and network manifest")
+	fs.StringVar(&f.Manifest, "manifest", "", "path to a signed network manifest, bootstrap nodes serve it to everyone")
+	fs.DurationVar(&f.DrainTimeout, "drain-timeout", 10*time.Second, "how long shutdown may take before the process exits")
+	fs.DurationVar(&f.ReadyTimeout, "ready-timeout", 0, "timeout of each startup readiness step, 0 keeps the defaults")
+	fs.StringVar(&f.HealthAddr, "health-addr", "", "serve liveness and readiness probes on this address, e.g. 127.0.0.1:8090")
+	fs.StringVar(&f.Transports, "transports", "", "comma separated transports: tcp,quic,webtransport,ws, empty enables all")
+	fs.StringVar(&f.Security, "security", "", "comma separated security protocols, most preferred first: noise,tls, empty enables both")
+	fs.StringVar(&f.SwarmKeyFile, "swarm-key", "", "path to a swarm.key, only peers with the same key can connect")
+	fs.StringVar(&f.DataDir, "data-dir", "", "keep the peerstore and DHT records in this directory across restarts")
+	fs.StringVar(&f.Reachability, "reachability", "", "auto lets AutoNAT decide whether we are publicly reachable, public or private force it, empty keeps the role default")
+	return f
+}
+
+// Readiness is the default readiness config with the -ready-timeout override applied
+func (f *CommonFlags) Readiness() ReadinessConfig {
+	return DefaultReadinessConfig().WithTimeout(f.ReadyTimeout)
+}
+
+// ApplyHost applies -transports, -security, -reachability and -swarm-key to a host config
+func (f *CommonFlags) ApplyHost(cfg *HostConfig) error {
+	if err := cfg.UseReachability(f.Reachability); err != nil {
+		return err
+	}
+	if err := cfg.UseTransports(f.Transports); err != nil {
+		return err
+	}
+	if err := cfg.UseSecurity(f.Security); err != nil {
+		return err
+	}
+	if f.SwarmKeyFile == "" {
+		return nil
+	}
+	psk, err := LoadPSK(f.SwarmKeyFile)
+	if err != nil {
+		return err
+	}
+	return cfg.UsePrivateNetwork(psk)
+}
+
+// SwarmKey is the content of the -swarm-key file, empty without one
+func (f *CommonFlags) SwarmKey() (string, error) {
+	if f.SwarmKeyFile == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(f.SwarmKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("swarm key error: %w", err)
+	}
+	return string(b), nil
+}
+
+// OpenStore opens the -data-dir store, nil without one
+func (f *CommonFlags) OpenStore() (*Store, error) {
+	if f.DataDir == "" {
+		return nil, nil
+	}
+	return OpenStore(f.DataDir)
+}
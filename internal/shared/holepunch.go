@@ -0,0 +1,253 @@
+package common
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// keys a node puts in InfoResponse.SystemConfig to publish its hole punch totals
+const (
+	AttrHolePunchAttempts  = "holepunch_attempts"
+	AttrHolePunchSuccesses = "holepunch_successes"
+	AttrHolePunchStuck     = "holepunch_stuck_on_relay"
+)
+
+var (
+	holePunchOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mnwarm",
+		Subsystem: "holepunch",
+		Name:      "outcomes_total",
+		Help:      "DCUtR direct dials and hole punches by our NAT mapping behavior and outcome",
+	}, []string{"nat_type", "outcome"})
+	holePunchRelayClosed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mnwarm",
+		Subsystem: "holepunch",
+		Name:      "relay_closed_total",
+		Help:      "relayed connections closed after a hole punch, direct is false when the peer never left the relay",
+	}, []string{"nat_type", "direct"})
+)
+
+func init() {
+	prometheus.MustRegister(holePunchOutcomes, holePunchRelayClosed)
+}
+
+// hole punch outcomes, the outcome label of the metrics
+const (
+	outcomeSuccess          = "success"
+	outcomeFailed           = "failed"
+	outcomeDirectDial       = "direct_dial"
+	outcomeDirectDialFailed = "direct_dial_failed"
+	outcomeProtocolError    = "protocol_error"
+)
+
+// HolePunchStats counts the DCUtR outcomes with a peer or behind a NAT type
+type HolePunchStats struct {
+	// DirectDials are the direct dials DCUtR tries before punching
+	DirectDials         int `json:"direct_dials"`
+	DirectDialSuccesses int `json:"direct_dial_successes"`
+	// Attempts are the hole punches started, Successes and Failures how they ended
+	Attempts       int `json:"attempts"`
+	Successes      int `json:"successes"`
+	Failures       int `json:"failures"`
+	ProtocolErrors int `json:"protocol_errors"`
+	// RelayClosed counts relayed connections that closed after a hole punch,
+	// StuckOnRelay those of them that never got a direct connection next to them
+	RelayClosed  int           `json:"relay_closed"`
+	StuckOnRelay int           `json:"stuck_on_relay"`
+	LastRTT      time.Duration `json:"last_rtt,omitempty"`
+	LastError    string        `json:"last_error,omitempty"`
+	LastAttempt  time.Time     `json:"last_attempt,omitempty"`
+}
+
+// SystemConfig encodes the totals for InfoResponse.SystemConfig
+func (s HolePunchStats) SystemConfig() map[string]string {
+	return map[string]string{
+		AttrHolePunchAttempts:  strconv.Itoa(s.Attempts),
+		AttrHolePunchSuccesses: strconv.Itoa(s.Successes),
+		AttrHolePunchStuck:     strconv.Itoa(s.StuckOnRelay),
+	}
+}
+
+// HolePunchSummary is a snapshot of a HolePunchTracer
+type HolePunchSummary struct {
+	Total HolePunchStats `json:"total"`
+	// ByPeer is keyed by remote peer id, ByNAT by our mapping behavior, see MappingUnknown
+	ByPeer map[string]HolePunchStats `json:"by_peer,omitempty"`
+	ByNAT  map[string]HolePunchStats `json:"by_nat,omitempty"`
+}
+
+// HolePunchTracer follows the DCUtR hole punches of a host and whether the relayed
+// connections they started from were ever left. NewHost installs one on every host
+// that hole punches, set HostConfig.HolePunchTracer to read it back
+type HolePunchTracer struct {
+	diagnostics *Diagnostics
+
+	mu     sync.Mutex
+	total  HolePunchStats
+	byPeer map[peer.ID]*HolePunchStats
+	byNAT  map[string]*HolePunchStats
+	// relayed are the peers we hole punched with while their relayed connection is
+	// open, with the NAT type the hole punch was counted under
+	relayed map[peer.ID]string
+}
+
+func NewHolePunchTracer() *HolePunchTracer {
+	return &HolePunchTracer{
+		byPeer:  make(map[peer.ID]*HolePunchStats),
+		byNAT:   make(map[string]*HolePunchStats),
+		relayed: make(map[peer.ID]string),
+	}
+}
+
+// attach watches the relayed connections of h, d gets every event as well when set
+func (t *HolePunchTracer) attach(h host.Host, d *Diagnostics) {
+	t.mu.Lock()
+	t.diagnostics = d
+	t.mu.Unlock()
+	h.Network().Notify(&network.NotifyBundle{DisconnectedF: t.disconnected})
+}
+
+func (t *HolePunchTracer) natType() string {
+	t.mu.Lock()
+	d := t.diagnostics
+	t.mu.Unlock()
+	if d == nil {
+		return MappingUnknown
+	}
+	return d.NATType()
+}
+
+// record applies fn to the totals and the stats of pid and nat
+func (t *HolePunchTracer) record(pid peer.ID, nat string, fn func(s *HolePunchStats)) {
+	if t.byPeer[pid] == nil {
+		t.byPeer[pid] = new(HolePunchStats)
+	}
+	if t.byNAT[nat] == nil {
+		t.byNAT[nat] = new(HolePunchStats)
+	}
+	fn(&t.total)
+	fn(t.byPeer[pid])
+	fn(t.byNAT[nat])
+}
+
+// Trace implements holepunch.EventTracer
+func (t *HolePunchTracer) Trace(evt *holepunch.Event) {
+	nat := t.natType()
+	at := time.Unix(0, evt.Timestamp)
+	pid := evt.Remote
+
+	t.mu.Lock()
+	d := t.diagnostics
+	switch e := evt.Evt.(type) {
+	case *holepunch.DirectDialEvt:
+		outcome := outcomeDirectDialFailed
+		if e.Success {
+			outcome = outcomeDirectDial
+		}
+		holePunchOutcomes.WithLabelValues(nat, outcome).Inc()
+		t.record(pid, nat, func(s *HolePunchStats) {
+			s.DirectDials++
+			if e.Success {
+				s.DirectDialSuccesses++
+			}
+		})
+	case *holepunch.ProtocolErrorEvt:
+		holePunchOutcomes.WithLabelValues(nat, outcomeProtocolError).Inc()
+		t.record(pid, nat, func(s *HolePunchStats) {
+			s.ProtocolErrors++
+			s.LastError = e.Error
+		})
+	case *holepunch.StartHolePunchEvt:
+		t.record(pid, nat, func(s *HolePunchStats) {
+			s.Attempts++
+			s.LastRTT = e.RTT
+			s.LastAttempt = at
+		})
+	case *holepunch.EndHolePunchEvt:
+		outcome := outcomeFailed
+		if e.Success {
+			outcome = outcomeSuccess
+		}
+		holePunchOutcomes.WithLabelValues(nat, outcome).Inc()
+		t.record(pid, nat, func(s *HolePunchStats) {
+			if e.Success {
+				s.Successes++
+			} else {
+				s.Failures++
+				s.LastError = e.Error
+			}
+		})
+		t.relayed[pid] = nat
+	}
+	t.mu.Unlock()
+
+	if d != nil {
+		d.Trace(evt)
+	}
+}
+
+// disconnected counts the relayed connection to a peer we hole punched with once
+// its last one closed, and whether a direct connection took over
+func (t *HolePunchTracer) disconnected(n network.Network, c network.Conn) {
+	if !c.Stat().Limited {
+		return
+	}
+	pid := c.RemotePeer()
+	direct := false
+	for _, conn := range n.ConnsToPeer(pid) {
+		if conn.Stat().Limited {
+			return
+		}
+		direct = true
+	}
+
+	t.mu.Lock()
+	nat, ok := t.relayed[pid]
+	if ok {
+		delete(t.relayed, pid)
+		t.record(pid, nat, func(s *HolePunchStats) {
+			s.RelayClosed++
+			if !direct {
+				s.StuckOnRelay++
+			}
+		})
+	}
+	d := t.diagnostics
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	holePunchRelayClosed.WithLabelValues(nat, strconv.FormatBool(direct)).Inc()
+	if !direct {
+		log.Infof("relayed connection to %s closed without a direct connection after hole punching", pid)
+	}
+	if d != nil {
+		d.relayClosed(pid, direct)
+	}
+}
+
+// Stats is a snapshot of the stats so far
+func (t *HolePunchTracer) Stats() HolePunchSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := HolePunchSummary{
+		Total:  t.total,
+		ByPeer: make(map[string]HolePunchStats, len(t.byPeer)),
+		ByNAT:  make(map[string]HolePunchStats, len(t.byNAT)),
+	}
+	for pid, s := range t.byPeer {
+		out.ByPeer[pid.String()] = *s
+	}
+	for nat, s := range t.byNAT {
+		out.ByNAT[nat] = *s
+	}
+	return out
+}
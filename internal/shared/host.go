@@ -0,0 +1,316 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/p2p/host/autorelay"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// HostConfig is everything that differs between the hosts of our roles,
+// start from one of the presets and adjust
+type HostConfig struct {
+	Role PeerRole
+	// Identity is the libp2p.Identity option, nil picks a random one
+	Identity libp2p.Option
+	// Transports are listened and dialed on, ipv4 listeners take ListenPort
+	Transports []Transport
+	ListenPort int
+	// ListenAddrs replace the addrs derived from Transports and ListenPort when set
+	ListenAddrs []string
+	// Security protocols for TCP and WebSocket, most preferred first
+	Security    []Security
+	ConnManager ConnManagerConfig
+
+	// RelayTransport lets us dial and accept circuit connections through relays
+	RelayTransport bool
+	// StaticRelays enables autorelay on these relays, we reserve a slot on them
+	StaticRelays []peer.AddrInfo
+	// AddrsFactory rewrites the addrs we advertise. autorelay, when on, keeps only the
+	// private addrs and its own circuit addrs out of what it returns
+	AddrsFactory func([]multiaddr.Multiaddr) []multiaddr.Multiaddr
+	// RelayService serves circuits for others while we are publicly reachable, without
+	// limits for the relay role and with the libp2p default limits otherwise
+	RelayService bool
+
+	// Reachability is forced when not unknown, otherwise AutoNAT works it out
+	Reachability network.Reachability
+	NATPortMap   bool
+	NATService   bool
+	AutoNATv2    bool
+	HolePunching bool
+
+	// PSK puts the host in a private network, see UsePrivateNetwork
+	PSK pnet.PSK
+	// Store keeps the peerstore and DHT records on disk, nil keeps them in memory.
+	// NewHost reconnects to the peers it remembers, closing it is up to the caller
+	Store *Store
+	// Diagnostics follows the NAT traversal of the host when set, see NATReport
+	Diagnostics *Diagnostics
+	// HolePunchTracer collects the hole punch stats, NewHost makes one when it is nil
+	// and HolePunching is on
+	HolePunchTracer *HolePunchTracer
+
+	// DHTMode is the mode of the DHT used for routing
+	DHTMode dht.ModeOpt
+	// DHTPrefix replaces the default /ipfs protocol prefix of the DHT when set
+	DHTPrefix protocol.ID
+}
+
+// BootstrapHostConfig listens on a fixed port and serves the DHT
+func BootstrapHostConfig(port int) HostConfig {
+	return HostConfig{
+		Role:           RoleBootstrap,
+		Transports:     AllTransports,
+		ListenPort:     port,
+		Security:       AllSecurity,
+		ConnManager:    InfrastructureConnManagerConfig(),
+		RelayTransport: true,
+		Reachability:   network.ReachabilityPublic,
+		NATPortMap:     true,
+		NATService:     true,
+		AutoNATv2:      true,
+		HolePunching:   true,
+		DHTMode:        dht.ModeServer,
+	}
+}
+
+// RelayHostConfig listens on a fixed port and relays circuits over every transport
+func RelayHostConfig(port int) HostConfig {
+	return HostConfig{
+		Role:           RoleRelay,
+		Transports:     AllTransports,
+		ListenPort:     port,
+		Security:       AllSecurity,
+		ConnManager:    InfrastructureConnManagerConfig(),
+		RelayTransport: true,
+		RelayService:   true,
+		Reachability:   network.ReachabilityPublic,
+		NATPortMap:     true,
+		NATService:     true,
+		AutoNATv2:      true,
+		HolePunching:   true,
+		DHTMode:        dht.ModeServer,
+	}
+}
+
+// RunnerHostConfig is a private host reachable through its relays
+func RunnerHostConfig(relays ...peer.AddrInfo) HostConfig {
+	return privateHostConfig(RoleRunner, relays)
+}
+
+// ClientHostConfig is a private host like a runner's, clients dial out through the relays
+func ClientHostConfig(relays ...peer.AddrInfo) HostConfig {
+	return privateHostConfig(RoleClient, relays)
+}
+
+func privateHostConfig(role PeerRole, relays []peer.AddrInfo) HostConfig {
+	return HostConfig{
+		Role:           role,
+		Transports:     AllTransports,
+		Security:       AllSecurity,
+		ConnManager:    DefaultConnManagerConfig(),
+		RelayTransport: true,
+		StaticRelays:   relays,
+		Reachability:   network.ReachabilityPrivate,
+		NATPortMap:     true,
+		NATService:     true,
+		AutoNATv2:      true,
+		HolePunching:   true,
+		DHTMode:        dht.ModeClient,
+	}
+}
+
+// UseTransports replaces the preset transports with a comma separated list, empty keeps them
+func (cfg *HostConfig) UseTransports(names string) error {
+	transports, err := ParseTransports(names)
+	if err != nil || len(transports) == 0 {
+		return err
+	}
+	cfg.Transports = transports
+	return nil
+}
+
+// UseSecurity replaces the preset security protocols with a comma separated list, empty keeps them
+func (cfg *HostConfig) UseSecurity(names string) error {
+	security, err := ParseSecurity(names)
+	if err != nil || len(security) == 0 {
+		return err
+	}
+	cfg.Security = security
+	return nil
+}
+
+func (cfg HostConfig) listenAddrs() []string {
+	if len(cfg.ListenAddrs) > 0 {
+		return cfg.ListenAddrs
+	}
+	var addrs []string
+	for _, t := range cfg.Transports {
+		addrs = append(addrs, t.listenAddrs(cfg.ListenPort)...)
+	}
+	return addrs
+}
+
+// options turns the config into libp2p options, routing is left to NewHost
+func (cfg HostConfig) options() ([]libp2p.Option, error) {
+	if len(cfg.Transports) == 0 || len(cfg.Security) == 0 {
+		return nil, errors.New("host needs at least one transport and security protocol")
+	}
+	rm, err := NewResourceManager()
+	if err != nil {
+		return nil, err
+	}
+	cm, err := NewConnManager(cfg.ConnManager)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.PSK) > 0 {
+		for _, t := range cfg.Transports {
+			if !t.supportsPSK() {
+				return nil, fmt.Errorf("transport %s can't run in a private network", t)
+			}
+		}
+	}
+
+	opts := []libp2p.Option{
+		libp2p.ListenAddrStrings(cfg.listenAddrs()...),
+		libp2p.UserAgent(RoleUserAgent(cfg.Role)),
+		libp2p.ResourceManager(rm),
+		libp2p.ConnectionManager(cm),
+	}
+	for _, t := range cfg.Transports {
+		opts = append(opts, t.option())
+	}
+	for _, sec := range cfg.Security {
+		opts = append(opts, sec.option())
+	}
+	if len(cfg.PSK) > 0 {
+		opts = append(opts, libp2p.PrivateNetwork(cfg.PSK))
+	}
+	if cfg.Identity != nil {
+		opts = append(opts, cfg.Identity)
+	}
+	if cfg.RelayTransport {
+		opts = append(opts, libp2p.EnableRelay())
+	} else {
+		opts = append(opts, libp2p.DisableRelay())
+	}
+	if cfg.AddrsFactory != nil {
+		opts = append(opts, libp2p.AddrsFactory(cfg.AddrsFactory))
+	}
+	if len(cfg.StaticRelays) > 0 {
+		opts = append(opts, libp2p.EnableAutoRelayWithStaticRelays(cfg.StaticRelays,
+			autorelay.WithMetricsTracer(autorelay.NewMetricsTracer())))
+	}
+	if cfg.RelayService && cfg.Role == RoleRelay {
+		opts = append(opts, libp2p.EnableRelayService(relay.WithInfiniteLimits()))
+	} else if cfg.RelayService {
+		opts = append(opts, libp2p.EnableRelayService())
+	}
+	switch cfg.Reachability {
+	case network.ReachabilityPublic:
+		opts = append(opts, libp2p.ForceReachabilityPublic())
+	case network.ReachabilityPrivate:
+		opts = append(opts, libp2p.ForceReachabilityPrivate())
+	}
+	if cfg.NATPortMap && cfg.Diagnostics != nil {
+		opts = append(opts, libp2p.NATManager(cfg.Diagnostics.natManager))
+	} else if cfg.NATPortMap {
+		opts = append(opts, libp2p.NATPortMap())
+	}
+	if cfg.NATService {
+		opts = append(opts, libp2p.EnableNATService())
+	}
+	// Diagnostics runs AutoNAT v2 itself once the host is up
+	if cfg.AutoNATv2 && cfg.Diagnostics == nil {
+		opts = append(opts, libp2p.EnableAutoNATv2())
+	}
+	if cfg.HolePunching {
+		tracer := cfg.HolePunchTracer
+		if tracer == nil {
+			tracer = NewHolePunchTracer()
+		}
+		opts = append(opts, libp2p.EnableHolePunching(
+			holepunch.WithMetricsAndEventTracer(holepunch.NewMetricsTracer(), tracer)))
+	}
+	return opts, nil
+}
+
+// NewHost builds the host and the DHT it routes with, the DHT lives until closed
+func NewHost(ctx context.Context, cfg HostConfig) (host.Host, *dht.IpfsDHT, error) {
+	if cfg.HolePunching && cfg.HolePunchTracer == nil {
+		cfg.HolePunchTracer = NewHolePunchTracer()
+	}
+	opts, err := cfg.options()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dhtOpts := []dht.Option{dht.Mode(cfg.DHTMode)}
+	if cfg.DHTPrefix != "" {
+		dhtOpts = append(dhtOpts, dht.ProtocolPrefix(cfg.DHTPrefix))
+	}
+	if cfg.Store != nil {
+		ps, err := cfg.Store.peerstore(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, libp2p.Peerstore(ps))
+		dhtOpts = append(dhtOpts, dht.Datastore(cfg.Store.dhtDatastore()))
+	}
+	var kademliaDHT *dht.IpfsDHT
+	opts = append(opts, libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
+		var err error
+		kademliaDHT, err = dht.New(ctx, h, dhtOpts...)
+		return kademliaDHT, err
+	}))
+
+	// our swarm is small, trust an observed address once a single peer reports it
+	identify.ActivationThresh = 1
+	h, err := libp2p.New(opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create libp2p host: %w", err)
+	}
+
+	log.Infof("%s host created, we are %s", cfg.Role, h.ID())
+	if cfg.HolePunchTracer != nil {
+		cfg.HolePunchTracer.attach(h, cfg.Diagnostics)
+	}
+	if cfg.Reachability == network.ReachabilityUnknown {
+		role := cfg.Role
+		err := WatchReachability(ctx, h, func(r network.Reachability) {
+			log.Infof("AutoNAT finds our %s %s", role, r)
+		})
+		if err != nil {
+			h.Close()
+			return nil, nil, err
+		}
+	}
+	if cfg.Diagnostics != nil {
+		cfg.Diagnostics.tracer = cfg.HolePunchTracer
+		if err := cfg.Diagnostics.start(ctx, h, cfg); err != nil {
+			h.Close()
+			return nil, nil, err
+		}
+	}
+	if cfg.Store != nil {
+		go cfg.Store.Reconnect(ctx, h)
+		cfg.Store.KeepRoutingTable(ctx, kademliaDHT)
+	}
+	return h, kademliaDHT, nil
+}
@@ -0,0 +1,144 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Manifest describes the network: where the infrastructure lives, which protocols
+// it speaks and the policy values nodes should run with. a higher Version replaces
+// a lower one, so moving a bootstrap or relay node is a matter of signing a new one
+type Manifest struct {
+	Version    uint64    `json:"version"`
+	Issued     time.Time `json:"issued"`
+	Bootstraps []string  `json:"bootstraps"`
+	Relays     []string  `json:"relays"`
+	// Protocols are the protocol ids the network runs, a node missing one is outdated
+	Protocols []string          `json:"protocols,omitempty"`
+	Policy    map[string]string `json:"policy,omitempty"`
+}
+
+// SignedManifest keeps the manifest bytes as signed, so verifying never depends on
+// how a peer re-encodes the JSON. the signature covers the compact form, which keeps
+// an indented manifest file valid
+type SignedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+}
+
+// SignManifest signs m with the operator key
+func SignManifest(m *Manifest, privKey crypto.PrivKey) (*SignedManifest, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := privKey.Sign(b)
+	if err != nil {
+		return nil, fmt.Errorf("sign manifest failed: %w", err)
+	}
+	return &SignedManifest{Manifest: b, Signature: base64.StdEncoding.EncodeToString(sig)}, nil
+}
+
+// Open checks the signature against the pinned operator key and decodes the manifest
+func (s *SignedManifest) Open(pubKey crypto.PubKey) (*Manifest, error) {
+	if pubKey == nil {
+		return nil, errors.New("no operator key to verify manifest")
+	}
+	sig, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("bad manifest signature encoding: %w", err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, s.Manifest); err != nil {
+		return nil, fmt.Errorf("manifest decode error: %w", err)
+	}
+	ok, err := pubKey.Verify(compact.Bytes(), sig)
+	if err != nil {
+		return nil, fmt.Errorf("manifest verify error: %w", err)
+	}
+	if !ok {
+		return nil, errors.New("manifest signature does not match operator key")
+	}
+	var m Manifest
+	if err := json.Unmarshal(s.Manifest, &m); err != nil {
+		return nil, fmt.Errorf("manifest decode error: %w", err)
+	}
+	return &m, nil
+}
+
+// ReadManifest reads a signed manifest file, Open verifies it
+func ReadManifest(path string) (*SignedManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("manifest read error: %w", err)
+	}
+	var signed SignedManifest
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("manifest decode error: %w", err)
+	}
+	return &signed, nil
+}
+
+// BootstrapPeers parses the bootstrap addrs of the manifest
+func (m *Manifest) BootstrapPeers() ([]peer.AddrInfo, error) {
+	return ParseBootstrap(m.Bootstraps)
+}
+
+// RelayPeers parses the relay addrs of the manifest
+func (m *Manifest) RelayPeers() ([]peer.AddrInfo, error) {
+	return ParseBootstrap(m.Relays)
+}
+
+// MissingProtocols are the manifest protocols h has no handler for
+func (m *Manifest) MissingProtocols(h host.Host) []string {
+	ours := make(map[protocol.ID]struct{})
+	for _, p := range h.Mux().Protocols() {
+		ours[p] = struct{}{}
+	}
+	var missing []string
+	for _, p := range m.Protocols {
+		if _, ok := ours[protocol.ID(p)]; !ok {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// PolicyInt is an integer policy value, def when it is missing or malformed
+func (m *Manifest) PolicyInt(key string, def int) int {
+	v, ok := m.Policy[key]
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Warnf("manifest policy %s=%q is not an integer", key, v)
+		return def
+	}
+	return n
+}
+
+// PolicyDuration is a duration policy value such as "30s", def when it is missing or malformed
+func (m *Manifest) PolicyDuration(key string, def time.Duration) time.Duration {
+	v, ok := m.Policy[key]
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Warnf("manifest policy %s=%q is not a duration", key, v)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,214 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// PeerRole is the part a peer plays in our swarm
+type PeerRole int
+
+const (
+	RoleUnknown PeerRole = iota
+	RoleBootstrap
+	RoleRelay
+	RoleRunner
+	RoleClient
+)
+
+// agentPrefix marks identify agent versions set by our own binaries
+const agentPrefix = "mnwarm-"
+
+func (r PeerRole) String() string {
+	switch r {
+	case RoleBootstrap:
+		return "bootstrap"
+	case RoleRelay:
+		return "relay"
+	case RoleRunner:
+		return "runner"
+	case RoleClient:
+		return "client"
+	default:
+		return "unknown"
+	}
+}
+
+// IsInfrastructure is true for roles that should never get ping/stream RPCs
+func (r PeerRole) IsInfrastructure() bool {
+	return r == RoleBootstrap || r == RoleRelay
+}
+
+// ParsePeerRole is the inverse of PeerRole.String
+func ParsePeerRole(s string) (PeerRole, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "bootstrap", "boot":
+		return RoleBootstrap, nil
+	case "relay":
+		return RoleRelay, nil
+	case "runner", "node_runner":
+		return RoleRunner, nil
+	case "client", "mobile_client":
+		return RoleClient, nil
+	case "unknown", "":
+		return RoleUnknown, nil
+	}
+	return RoleUnknown, fmt.Errorf("unknown peer role '%s'", s)
+}
+
+// RoleUserAgent is the identify agent version a binary of the given role announces,
+// it lets other nodes classify us once identify has run
+func RoleUserAgent(role PeerRole) string {
+	return fmt.Sprintf("%s%s/0.0.1", agentPrefix, role)
+}
+
+// roleFromUserAgent reverses RoleUserAgent, anything not ours is unknown
+func roleFromUserAgent(agent string) PeerRole {
+	if !strings.HasPrefix(agent, agentPrefix) {
+		return RoleUnknown
+	}
+	name := strings.TrimPrefix(agent, agentPrefix)
+	if i := strings.Index(name, "/"); i >= 0 {
+		name = name[:i]
+	}
+	role, err := ParsePeerRole(name)
+	if err != nil {
+		return RoleUnknown
+	}
+	return role
+}
+
+// SetBootstrapPeers replaces BootstrapPeerIDs with the ids of the parsed bootstrap addrs
+func SetBootstrapPeers(bootstrapPeers []peer.AddrInfo) {
+	ids := make([]peer.ID, 0, len(bootstrapPeers))
+	seen := make(map[peer.ID]struct{}, len(bootstrapPeers))
+	for _, p := range bootstrapPeers {
+		if _, ok := seen[p.ID]; ok {
+			continue
+		}
+		seen[p.ID] = struct{}{}
+		ids = append(ids, p.ID)
+	}
+	bootstrapMu.Lock()
+	BootstrapPeerIDs = ids
+	bootstrapMu.Unlock()
+	log.Infof("bootstrap peer set: %v", ids)
+}
+
+// AddBootstrapPeers adds peers to BootstrapPeerIDs and returns the ones that were new
+func AddBootstrapPeers(peers ...peer.AddrInfo) []peer.AddrInfo {
+	bootstrapMu.Lock()
+	defer bootstrapMu.Unlock()
+	var added []peer.AddrInfo
+	for _, p := range peers {
+		known := false
+		for _, id := range BootstrapPeerIDs {
+			if id == p.ID {
+				known = true
+				break
+			}
+		}
+		if !known {
+			BootstrapPeerIDs = append(BootstrapPeerIDs, p.ID)
+			added = append(added, p)
+		}
+	}
+	if len(added) > 0 {
+		log.Infof("bootstrap peer set: %v", BootstrapPeerIDs)
+	}
+	return added
+}
+
+// BootstrapPeerSet is a copy of BootstrapPeerIDs
+func BootstrapPeerSet() []peer.ID {
+	bootstrapMu.RLock()
+	defer bootstrapMu.RUnlock()
+	return append([]peer.ID{}, BootstrapPeerIDs...)
+}
+
+// PeerClassifier tells bootstrap, relay, runner, client and unknown peers apart.
+// bootstrap peers come from BootstrapPeerIDs, relays from AddRelays, and everything
+// else from explicit SetRole calls or the identify agent version in the peerstore
+type PeerClassifier struct {
+	host   host.Host
+	mu     sync.RWMutex
+	relays map[peer.ID]struct{}
+	roles  map[peer.ID]PeerRole
+}
+
+func NewPeerClassifier(h host.Host) *PeerClassifier {
+	return &PeerClassifier{
+		host:   h,
+		relays: make(map[peer.ID]struct{}),
+		roles:  make(map[peer.ID]PeerRole),
+	}
+}
+
+func (c *PeerClassifier) AddRelays(relays ...peer.AddrInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range relays {
+		c.relays[r.ID] = struct{}{}
+	}
+}
+
+// SetRole pins the role of a peer, it wins over the identify agent version
+func (c *PeerClassifier) SetRole(pid peer.ID, role PeerRole) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if role == RoleUnknown {
+		delete(c.roles, pid)
+		return
+	}
+	c.roles[pid] = role
+}
+
+func (c *PeerClassifier) Classify(pid peer.ID) PeerRole {
+	if IsBootstrapPeer(pid) {
+		return RoleBootstrap
+	}
+
+	c.mu.RLock()
+	_, isRelay := c.relays[pid]
+	role, pinned := c.roles[pid]
+	c.mu.RUnlock()
+
+	if isRelay {
+		return RoleRelay
+	}
+	if pinned {
+		return role
+	}
+
+	if c.host == nil {
+		return RoleUnknown
+	}
+	agent, err := c.host.Peerstore().Get(pid, "AgentVersion")
+	if err != nil {
+		return RoleUnknown
+	}
+	agentStr, ok := agent.(string)
+	if !ok {
+		return RoleUnknown
+	}
+	return roleFromUserAgent(agentStr)
+}
+
+// IsInfrastructure is true for bootstrap and relay peers
+func (c *PeerClassifier) IsInfrastructure(pid peer.ID) bool {
+	return c.Classify(pid).IsInfrastructure()
+}
+
+// IsValidTarget is true for peers we may send ping/stream RPCs to.
+// unknown peers are allowed so older runners without our agent still work
+func (c *PeerClassifier) IsValidTarget(pid peer.ID) bool {
+	if c.host != nil && pid == c.host.ID() {
+		return false
+	}
+	role := c.Classify(pid)
+	return role == RoleRunner || role == RoleUnknown
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// PrivateDHTPrefix replaces /ipfs in the DHT protocol ids of a private network,
+// so our DHT never queries or answers nodes outside the swarm
+const PrivateDHTPrefix = protocol.ID("/mnwarm/private")
+
+// ParsePSK reads a swarm key in the go-ipfs swarm.key format:
+//
+//	/key/swarm/psk/1.0.0/
+//	/base16/
+//	<64 hex chars>
+func ParsePSK(swarmKey string) (pnet.PSK, error) {
+	psk, err := pnet.DecodeV1PSK(strings.NewReader(swarmKey))
+	if err != nil {
+		return nil, fmt.Errorf("swarm key error: %w", err)
+	}
+	return psk, nil
+}
+
+// LoadPSK reads a swarm.key file
+func LoadPSK(path string) (pnet.PSK, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("swarm key error: %w", err)
+	}
+	return ParsePSK(string(b))
+}
+
+// GenerateSwarmKey returns a new random swarm key in the swarm.key format
+func GenerateSwarmKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return "/key/swarm/psk/1.0.0/\n/base16/\n" + hex.EncodeToString(key) + "\n", nil
+}
+
+// supportsPSK is false for transports with built in encryption, libp2p can't wrap them in a pnet
+func (t Transport) supportsPSK() bool {
+	return t == TransportTCP || t == TransportWebSocket
+}
+
+// UsePrivateNetwork joins the private network of psk: only peers with the same key can
+// connect and the DHT switches to PrivateDHTPrefix. QUIC and WebTransport are dropped
+// since they can't run inside a pnet
+func (cfg *HostConfig) UsePrivateNetwork(psk pnet.PSK) error {
+	var transports []Transport
+	for _, t := range cfg.Transports {
+		if t.supportsPSK() {
+			transports = append(transports, t)
+		} else {
+			log.Infof("private network: not listening on %s", t)
+		}
+	}
+	if len(transports) == 0 {
+		return fmt.Errorf("private network needs tcp or ws, transports are %v", cfg.Transports)
+	}
+	cfg.Transports = transports
+	cfg.PSK = psk
+	cfg.DHTPrefix = PrivateDHTPrefix
+	return nil
+}
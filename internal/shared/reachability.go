@@ -0,0 +1,58 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// reachability modes of the -reachability flag, see HostConfig.UseReachability
+const (
+	ReachabilityAuto    = "auto"
+	ReachabilityPublic  = "public"
+	ReachabilityPrivate = "private"
+)
+
+// UseReachability replaces the preset reachability: auto lets AutoNAT work it out,
+// public and private force it and empty keeps the preset
+func (cfg *HostConfig) UseReachability(mode string) error {
+	switch mode {
+	case "":
+	case ReachabilityAuto:
+		cfg.Reachability = network.ReachabilityUnknown
+	case ReachabilityPublic:
+		cfg.Reachability = network.ReachabilityPublic
+	case ReachabilityPrivate:
+		cfg.Reachability = network.ReachabilityPrivate
+	default:
+		return fmt.Errorf("unknown reachability '%s', want %s, %s or %s", mode, ReachabilityAuto, ReachabilityPublic, ReachabilityPrivate)
+	}
+	return nil
+}
+
+// WatchReachability calls fn with every reachability AutoNAT settles on until ctx is
+// done, starting with the current one when it is already known
+func WatchReachability(ctx context.Context, h host.Host, fn func(network.Reachability)) error {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+				fn(e.(event.EvtLocalReachabilityChanged).Reachability)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
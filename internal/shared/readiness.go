@@ -0,0 +1,146 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+)
+
+// how often steps without an event to wait on are retried or polled
+const readinessPoll = 250 * time.Millisecond
+
+// ReadinessConfig bounds every startup step on its own, so a bad network fails
+// at the step that is stuck instead of somewhere after a fixed sleep
+type ReadinessConfig struct {
+	BootstrapTimeout    time.Duration
+	MinRoutingPeers     int
+	RoutingTableTimeout time.Duration
+	ReservationTimeout  time.Duration
+	RelayAddrsTimeout   time.Duration
+}
+
+func DefaultReadinessConfig() ReadinessConfig {
+	return ReadinessConfig{
+		BootstrapTimeout:    15 * time.Second,
+		MinRoutingPeers:     1,
+		RoutingTableTimeout: 15 * time.Second,
+		ReservationTimeout:  20 * time.Second,
+		RelayAddrsTimeout:   15 * time.Second,
+	}
+}
+
+// WithTimeout sets the timeout of every step, zero keeps the defaults
+func (c ReadinessConfig) WithTimeout(d time.Duration) ReadinessConfig {
+	if d <= 0 {
+		return c
+	}
+	c.BootstrapTimeout = d
+	c.RoutingTableTimeout = d
+	c.ReservationTimeout = d
+	c.RelayAddrsTimeout = d
+	return c
+}
+
+// WaitForBootstrap keeps dialing the bootstrap peers until at least one is connected
+func WaitForBootstrap(ctx context.Context, h host.Host, bootstrapPeers []peer.AddrInfo, timeout time.Duration) error {
+	if len(bootstrapPeers) == 0 {
+		return errors.New("no bootstrap peers to connect to")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	for {
+		if ok, _ := ConnectToBootstrapPeers(ctx, h, bootstrapPeers); ok {
+			log.Infof("ready: bootstrap connected after %s", time.Since(start))
+			return nil
+		}
+		select {
+		case <-time.After(readinessPoll):
+		case <-ctx.Done():
+			return fmt.Errorf("no bootstrap connection within %s: %w", timeout, ctx.Err())
+		}
+	}
+}
+
+// WaitForRoutingTable waits until the DHT routing table holds at least minPeers peers
+func WaitForRoutingTable(ctx context.Context, kademliaDHT *dht.IpfsDHT, minPeers int, timeout time.Duration) error {
+	if kademliaDHT == nil {
+		return errors.New("DHT not initialized properly")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	ticker := time.NewTicker(readinessPoll)
+	defer ticker.Stop()
+	for {
+		size := kademliaDHT.RoutingTable().Size()
+		if size >= minPeers {
+			log.Infof("ready: routing table has %d peers after %s", size, time.Since(start))
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("routing table has %d of %d peers after %s: %w", size, minPeers, timeout, ctx.Err())
+		}
+	}
+}
+
+// WaitForReservation retries the relay reservation until the relay confirms one
+func WaitForReservation(ctx context.Context, h host.Host, relayInfo *peer.AddrInfo, timeout time.Duration) (*client.Reservation, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	for {
+		rsvp, err := ReserveRelay(ctx, h, relayInfo)
+		if err == nil {
+			log.Infof("ready: relay reservation confirmed after %s, expires %s", time.Since(start), rsvp.Expiration)
+			return rsvp, nil
+		}
+		if relayInfo == nil {
+			return nil, err
+		}
+		select {
+		case <-time.After(readinessPoll):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no relay reservation within %s: %w", timeout, err)
+		}
+	}
+}
+
+// WaitForRelayAddrs waits until the host advertises at least one circuit address
+func WaitForRelayAddrs(ctx context.Context, h host.Host, timeout time.Duration) error {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalAddressesUpdated))
+	if err != nil {
+		return fmt.Errorf("address subscription error: %w", err)
+	}
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	for {
+		for _, addr := range h.Addrs() {
+			if IsCircuitAddr(addr) {
+				log.Infof("ready: relay address %s after %s", addr, time.Since(start))
+				return nil
+			}
+		}
+		select {
+		case <-sub.Out():
+		case <-ctx.Done():
+			return fmt.Errorf("no relay address within %s: %w", timeout, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	pbv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/pb"
+)
+
+// how long a keeper waits before retrying a failed renewal, doubled up to maxRenewBackoff
+const (
+	minRenewBackoff = 2 * time.Second
+	maxRenewBackoff = time.Minute
+)
+
+// ReservationEventType is what happened to a kept reservation
+type ReservationEventType int
+
+const (
+	// ReservationRenewed means the relay granted or extended the reservation
+	ReservationRenewed ReservationEventType = iota
+	// ReservationRefused means the relay answered a reservation request with a refusal
+	ReservationRefused
+	// ReservationLost means the connection to the relay dropped or the reservation
+	// expired before it could be renewed
+	ReservationLost
+)
+
+func (t ReservationEventType) String() string {
+	switch t {
+	case ReservationRenewed:
+		return "renewed"
+	case ReservationRefused:
+		return "refused"
+	case ReservationLost:
+		return "lost"
+	default:
+		return "unknown"
+	}
+}
+
+// ReservationEvent reports a change of a kept reservation
+type ReservationEvent struct {
+	Type  ReservationEventType
+	Relay peer.ID
+	// Reservation is the new reservation when renewed, nil otherwise
+	Reservation *client.Reservation
+	Err         error
+}
+
+// IsReservationRefused tells whether err is the relay turning down a reservation,
+// as opposed to failing to reach it
+func IsReservationRefused(err error) bool {
+	var rerr client.ReservationError
+	return errors.As(err, &rerr) && rerr.Status != pbv2.Status_CONNECTION_FAILED
+}
+
+// ReservationKeeper holds a reservation on one relay: it renews the reservation before
+// it expires, re-reserves when the connection to the relay comes back and reports
+// refusals and losses so the caller can move to another relay
+type ReservationKeeper struct {
+	host  host.Host
+	relay peer.AddrInfo
+
+	current atomic.Pointer[client.Reservation]
+
+	mu      sync.Mutex
+	onEvent []func(ReservationEvent)
+}
+
+// NewReservationKeeper keeps a reservation on relay, call Keep to start
+func NewReservationKeeper(h host.Host, relay peer.AddrInfo) *ReservationKeeper {
+	return &ReservationKeeper{host: h, relay: relay}
+}
+
+// Relay is the relay the reservation is held on
+func (k *ReservationKeeper) Relay() peer.AddrInfo {
+	return k.relay
+}
+
+// Current is the live reservation, nil while we hold none. Expiration, LimitDuration
+// and LimitData are the terms the relay granted
+func (k *ReservationKeeper) Current() *client.Reservation {
+	rsvp := k.current.Load()
+	if rsvp == nil || time.Now().After(rsvp.Expiration) {
+		return nil
+	}
+	return rsvp
+}
+
+// OnEvent registers fn to run on every renewal, refusal and loss, register before Keep
+func (k *ReservationKeeper) OnEvent(fn func(ReservationEvent)) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.onEvent = append(k.onEvent, fn)
+}
+
+func (k *ReservationKeeper) emit(ev ReservationEvent) {
+	ev.Relay = k.relay.ID
+	if ev.Err != nil {
+		log.Warnf("relay reservation on %s %s: %v", k.relay.ID, ev.Type, ev.Err)
+	} else {
+		log.Debugf("relay reservation on %s %s", k.relay.ID, ev.Type)
+	}
+	k.mu.Lock()
+	callbacks := append([]func(ReservationEvent){}, k.onEvent...)
+	k.mu.Unlock()
+	for _, fn := range callbacks {
+		fn(ev)
+	}
+}
+
+// Keep renews rsvp, a reservation already granted by the relay, until ctx is done
+func (k *ReservationKeeper) Keep(ctx context.Context, rsvp *client.Reservation) error {
+	sub, err := k.host.EventBus().Subscribe(new(event.EvtPeerConnectednessChanged))
+	if err != nil {
+		return err
+	}
+	k.current.Store(rsvp)
+	go k.loop(ctx, sub)
+	return nil
+}
+
+func (k *ReservationKeeper) loop(ctx context.Context, sub event.Subscription) {
+	defer sub.Close()
+
+	backoff := minRenewBackoff
+	lost := false
+	next := renewAt(k.current.Load())
+	for {
+		select {
+		case <-time.After(time.Until(next)):
+		case e := <-sub.Out():
+			ev := e.(event.EvtPeerConnectednessChanged)
+			if ev.Peer != k.relay.ID || ev.Connectedness == network.Connected || lost {
+				continue
+			}
+			// the relay forgets the reservation together with the connection
+			lost = true
+			k.current.Store(nil)
+			k.emit(ReservationEvent{Type: ReservationLost, Err: errors.New("disconnected from relay")})
+			next = time.Now()
+			continue
+		case <-ctx.Done():
+			return
+		}
+
+		rsvp, err := ReserveRelay(ctx, k.host, &k.relay)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			lost = false
+			backoff = minRenewBackoff
+			k.current.Store(rsvp)
+			k.emit(ReservationEvent{Type: ReservationRenewed, Reservation: rsvp})
+			next = renewAt(rsvp)
+			continue
+		}
+
+		if IsReservationRefused(err) {
+			k.emit(ReservationEvent{Type: ReservationRefused, Err: err})
+		}
+		if !lost && k.Current() == nil {
+			lost = true
+			k.current.Store(nil)
+			k.emit(ReservationEvent{Type: ReservationLost, Err: err})
+		}
+		next = time.Now().Add(backoff)
+		backoff = min(2*backoff, maxRenewBackoff)
+	}
+}
+
+// renewAt is when to renew rsvp, three quarters into its remaining lifetime
+func renewAt(rsvp *client.Reservation) time.Time {
+	if rsvp == nil {
+		return time.Now()
+	}
+	return time.Now().Add(time.Until(rsvp.Expiration) * 3 / 4)
+}
@@ -3,10 +3,13 @@ package common
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p"
@@ -22,8 +25,8 @@ var log = logging.Logger("sharedlog")
 
 var BootstrapPeerIDs = []peer.ID{}
 
-var Shearing = "hehele"
-var private = "private"
+// bootstrapMu guards BootstrapPeerIDs once peer exchange and manifests update it at runtime
+var bootstrapMu sync.RWMutex
 
 var RelayerPrivateKeys = []string{
 	//boots
@@ -80,6 +83,8 @@ func GetLibp2pIdentity(keyIndex int) (libp2p.Option, error) {
 }
 
 func IsBootstrapPeer(peerID peer.ID) bool {
+	bootstrapMu.RLock()
+	defer bootstrapMu.RUnlock()
 	for _, bootstrapID := range BootstrapPeerIDs {
 		if peerID == bootstrapID {
 			return true
@@ -134,16 +139,22 @@ func ParseBootstrap(bootstrapAddrs []string) ([]peer.AddrInfo, error) {
 	return bootstrapPeers, nil
 }
 
+// ParseCmdArgs reads <relay> <key index> [bootstrap...], if flag.Parse
+// has been called the positional args after the flags are used
 func ParseCmdArgs() (string, int, []string, error) {
-	if len(os.Args) < 3 {
+	args := os.Args[1:]
+	if flag.Parsed() {
+		args = flag.Args()
+	}
+	if len(args) < 2 {
 		errMsg := "need a bootstrap node and relay"
 		log.Error(errMsg)
 		return "", 0, nil, errors.New(errMsg)
 	}
 
-	relayAddrStr := os.Args[1]
-	keyIndexStr := os.Args[2]
-	bootstrapAddrs := os.Args[3:]
+	relayAddrStr := args[0]
+	keyIndexStr := args[1]
+	bootstrapAddrs := args[2:]
 
 	keyIndexInt, err := strconv.Atoi(keyIndexStr)
 	if err != nil {
@@ -175,51 +186,24 @@ func ParseRelayAddress(relayAddrStr string) (*peer.AddrInfo, error) {
 	return relayInfo, nil
 }
 
+// AssembleRelay adds a circuit addr of p through the relay to p's addrs for every relay
+// addr, so each transport the relay listens on can be dialed
 func AssembleRelay(relayAddrInfo peer.AddrInfo, p peer.AddrInfo) (peer.AddrInfo, error) {
 	if len(relayAddrInfo.Addrs) == 0 {
-		errMsg := fmt.Sprintf("relay %s has no addresses!!!!", relayAddrInfo.ID)
-		log.Error(errMsg)
-		return peer.AddrInfo{}, fmt.Errorf(errMsg)
-	}
-
-	relayAddr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/p2p-circuit/p2p/%s", p.ID))
-	if err != nil {
-		errMsg := fmt.Sprintf("failed to create relay circuit multiaddr: %v", err)
-		log.Error(errMsg)
-		return peer.AddrInfo{}, fmt.Errorf(errMsg)
-	}
-
-	combinedRelayAddr := relayAddrInfo.Addrs[0].Encapsulate(relayAddr)
-	p.Addrs = append(p.Addrs, combinedRelayAddr)
-
-	log.Infof("trying to connect to peer %s via relay %s", p.ID, relayAddrInfo.ID)
-	log.Infof("relay address: %s", combinedRelayAddr)
-
-	targetInfo, err := peer.AddrInfoFromP2pAddr(combinedRelayAddr)
-	if err != nil {
-		errMsg := fmt.Sprintf("failed to create peer.AddrInfo from combined relay address '%s': %v", combinedRelayAddr, err)
-		log.Error(errMsg)
-		return peer.AddrInfo{}, fmt.Errorf(errMsg)
+		return peer.AddrInfo{}, fmt.Errorf("relay %s has no addresses", relayAddrInfo.ID)
 	}
-	targetID := targetInfo.ID
-
-	newRelayAddr, err := multiaddr.NewMultiaddr("/p2p/" + relayAddrInfo.ID.String() + "/p2p-circuit/p2p/" + targetID.String())
+	circuits, err := CircuitAddrs(relayAddrInfo, p.ID)
 	if err != nil {
-		errMsg := fmt.Sprintf("failed to create new relay multiaddr: %v", err)
-		log.Error(errMsg)
-		return peer.AddrInfo{}, fmt.Errorf(errMsg)
+		return peer.AddrInfo{}, err
 	}
-
-	log.Infof("newRelayAddr: %v", newRelayAddr)
-
-	targetRelayedInfo := peer.AddrInfo{
-		ID:    targetID,
-		Addrs: []multiaddr.Multiaddr{newRelayAddr},
+	if len(circuits) == 0 {
+		return peer.AddrInfo{}, fmt.Errorf("relay %s has no dialable addresses", relayAddrInfo.ID)
 	}
-
-	log.Infof("targetRelayedInfo: %v", targetRelayedInfo)
-
-	return targetRelayedInfo, nil
+	log.Infof("circuit addrs of %s through relay %s: %v", p.ID, relayAddrInfo.ID, circuits)
+	return peer.AddrInfo{
+		ID:    p.ID,
+		Addrs: append(append([]multiaddr.Multiaddr{}, p.Addrs...), circuits...),
+	}, nil
 }
 
 func ConnectToBootstrapPeers(ctx context.Context, host host.Host, bootstrapPeers []peer.AddrInfo) (bool, []error) {
@@ -321,20 +305,21 @@ func ConstructRelayAddresses(host host.Host, relayInfo *peer.AddrInfo) ([]peer.A
 	return relayAddresses, nil
 }
 
-func ReserveRelay(ctx context.Context, host host.Host, relayInfo *peer.AddrInfo) error {
+// ReserveRelay asks the relay for a reservation once, ReservationKeeper renews it
+func ReserveRelay(ctx context.Context, host host.Host, relayInfo *peer.AddrInfo) (*client.Reservation, error) {
 	if relayInfo == nil {
 		errMsg := "relayInfo is nil"
 		log.Error(errMsg)
-		return errors.New(errMsg)
+		return nil, errors.New(errMsg)
 	}
 
-	cli, err := client.Reserve(ctx, host, *relayInfo)
+	rsvp, err := client.Reserve(ctx, host, *relayInfo)
 	if err != nil {
 		errMsg := fmt.Sprintf("failed to receive a relay reservation from relay: %v", err)
 		log.Error(errMsg)
-		return fmt.Errorf("relay reservation error: %w", err)
+		return nil, fmt.Errorf("relay reservation error: %w", err)
 	}
-	log.Infof("Relay reservation details: %+v", cli)
-	log.Info("relay reservation successful")
-	return nil
+	log.Infof("relay reservation on %s successful, expires %s, circuits limited to %s and %d bytes",
+		relayInfo.ID, rsvp.Expiration.Format(time.RFC3339), rsvp.LimitDuration, rsvp.LimitData)
+	return rsvp, nil
 }
@@ -1,11 +1,32 @@
 package common
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/version"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	connmgr "github.com/libp2p/go-libp2p/core/connmgr"
 	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	relay "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	noise "github.com/libp2p/go-libp2p/p2p/security/noise"
+	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
 	"github.com/multiformats/go-multiaddr"
 )
 
@@ -495,4 +516,1253 @@ func TestAssembleRelay(t *testing.T) {
 			}
 		})
 	}
+
+	// every relay addr gives a circuit addr that keeps its transport
+	relayAddrInfo.Addrs = append(relayAddrInfo.Addrs,
+		multiaddr.StringCast("/ip4/127.0.0.1/udp/1234/quic-v1"),
+		multiaddr.StringCast("/ip4/127.0.0.1/tcp/1234/p2p/"+relayPeerID.String()))
+	got, err := AssembleRelay(relayAddrInfo, targetAddrInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		targetMaddr.String(),
+		"/ip4/127.0.0.1/tcp/1234/p2p/" + relayPeerID.String() + "/p2p-circuit/p2p/" + targetPeerID.String(),
+		"/ip4/127.0.0.1/udp/1234/quic-v1/p2p/" + relayPeerID.String() + "/p2p-circuit/p2p/" + targetPeerID.String(),
+	}
+	if len(got.Addrs) != len(want) {
+		t.Fatalf("AssembleRelay() addrs = %v, want %v", got.Addrs, want)
+	}
+	for i, a := range got.Addrs {
+		if a.String() != want[i] {
+			t.Errorf("AssembleRelay() addr %d = %s, want %s", i, a, want[i])
+		}
+	}
+}
+
+func randomPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pid
+}
+
+func TestRankCircuitCandidates(t *testing.T) {
+	mn, err := mocknet.FullMeshLinked(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	h := mn.Hosts()[0]
+
+	near, far, unmeasured, target := randomPeerID(t), randomPeerID(t), randomPeerID(t), randomPeerID(t)
+	h.Peerstore().RecordLatency(near, 10*time.Millisecond)
+	h.Peerstore().RecordLatency(far, 200*time.Millisecond)
+	relays := []peer.AddrInfo{
+		{ID: unmeasured, Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/192.0.2.3/udp/4001/quic-v1")}},
+		{ID: far, Addrs: []multiaddr.Multiaddr{
+			multiaddr.StringCast("/ip4/192.0.2.2/tcp/4001"),
+			multiaddr.StringCast("/ip4/192.0.2.2/udp/4001/quic-v1"),
+		}},
+		{ID: near, Addrs: []multiaddr.Multiaddr{
+			multiaddr.StringCast("/ip4/192.0.2.1/tcp/4001/ws"),
+			multiaddr.StringCast("/ip4/192.0.2.1/tcp/4001"),
+			multiaddr.StringCast("/ip4/192.0.2.1/udp/4001/quic-v1"),
+		}},
+	}
+
+	type candidate struct {
+		relay     peer.ID
+		transport string
+	}
+	want := []candidate{
+		{near, "quic-v1"}, {far, "quic-v1"}, {unmeasured, "quic-v1"},
+		{near, "tcp"}, {far, "tcp"},
+		{near, "ws"},
+	}
+	got := RankCircuitCandidates(h, target, relays...)
+	if len(got) != len(want) {
+		t.Fatalf("RankCircuitCandidates() = %+v, want %d candidates", got, len(want))
+	}
+	for i, c := range got {
+		if (candidate{c.Relay, c.Transport}) != want[i] {
+			t.Errorf("candidate %d = %s over %s, want %s over %s", i, c.Relay, c.Transport, want[i].relay, want[i].transport)
+		}
+		if !IsCircuitAddr(c.Addr) {
+			t.Errorf("candidate %d addr %s is no circuit addr", i, c.Addr)
+		}
+	}
+}
+
+func TestConnectViaRelays(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	relayHost, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.EnableRelayService(), libp2p.ForceReachabilityPublic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relayHost.Close()
+	runnerHost, err := libp2p.New(libp2p.NoListenAddrs, libp2p.EnableRelay())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runnerHost.Close()
+	clientHost, err := libp2p.New(libp2p.NoListenAddrs, libp2p.EnableRelay())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientHost.Close()
+
+	relayInfo := peer.AddrInfo{ID: relayHost.ID(), Addrs: relayHost.Addrs()}
+	if _, err := ReserveRelay(ctx, runnerHost, &relayInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing listens for the dead relay, its QUIC candidate is ranked first and
+	// the race moves on to the TCP circuit long before the dial times out
+	deadRelay := peer.AddrInfo{ID: randomPeerID(t), Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/udp/9/quic-v1")}}
+	start := time.Now()
+	got, err := ConnectViaRelays(ctx, clientHost, runnerHost.ID(), deadRelay, relayInfo)
+	if err != nil {
+		t.Fatalf("ConnectViaRelays() error = %v", err)
+	}
+	if got.Relay != relayHost.ID() || got.Transport != "tcp" {
+		t.Errorf("ConnectViaRelays() = %+v, want the TCP circuit", got)
+	}
+	if took := time.Since(start); took > 3*time.Second {
+		t.Errorf("ConnectViaRelays() waited %s for the dead relay", took)
+	}
+	if !IsRelayedPeer(clientHost, runnerHost.ID()) {
+		t.Error("client not connected to the runner through the relay")
+	}
+
+	if _, err := ConnectViaRelays(ctx, clientHost, runnerHost.ID()); err == nil {
+		t.Error("ConnectViaRelays() without relays succeeded")
+	}
+}
+
+func TestSetBootstrapPeers(t *testing.T) {
+	originalBootstrapPeerIDs := BootstrapPeerIDs
+	defer func() { BootstrapPeerIDs = originalBootstrapPeerIDs }()
+
+	bootstrapPeers, err := ParseBootstrap([]string{
+		"/ip4/127.0.0.1/tcp/1237/p2p/12D3KooWLr1gYejUTeriAsSu6roR2aQ423G3Q4fFTqzqSwTsMz9n",
+		"/ip4/127.0.0.1/tcp/1238/p2p/12D3KooWBnext3VBZZuBwGn3YahAZjf49oqYckfx64VpzH6dyU1p",
+		"/ip4/10.0.0.1/tcp/1237/p2p/12D3KooWLr1gYejUTeriAsSu6roR2aQ423G3Q4fFTqzqSwTsMz9n",
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse bootstrap addrs: %v", err)
+	}
+
+	SetBootstrapPeers(bootstrapPeers)
+
+	if len(BootstrapPeerIDs) != 2 {
+		t.Fatalf("SetBootstrapPeers() got %d ids, want 2", len(BootstrapPeerIDs))
+	}
+	for _, p := range bootstrapPeers {
+		if !IsBootstrapPeer(p.ID) {
+			t.Errorf("IsBootstrapPeer(%s) = false after SetBootstrapPeers", p.ID)
+		}
+	}
+}
+
+func TestPeerClassifier(t *testing.T) {
+	originalBootstrapPeerIDs := BootstrapPeerIDs
+	defer func() { BootstrapPeerIDs = originalBootstrapPeerIDs }()
+
+	bootstrapPeerID, err := peer.Decode("12D3KooWLr1gYejUTeriAsSu6roR2aQ423G3Q4fFTqzqSwTsMz9n")
+	if err != nil {
+		t.Fatalf("Failed to decode bootstrap peer ID: %v", err)
+	}
+	relayPeerID, err := peer.Decode("12D3KooWRnBKUEkAEpsoCoEiuhxKBJ5j2Bdop6PGxFMvd4PwoevM")
+	if err != nil {
+		t.Fatalf("Failed to decode relay peer ID: %v", err)
+	}
+	runnerPeerID, err := peer.Decode("12D3KooWJuteouY1d5SYFcAUAYDVPjFD8MUBgqsdjZfBkAecCS2Y")
+	if err != nil {
+		t.Fatalf("Failed to decode runner peer ID: %v", err)
+	}
+	clientPeerID, err := peer.Decode("12D3KooWQaZ9Ppi8A2hcEspJhewfPqKjtXu4vx7FQPaUGnHXWpNL")
+	if err != nil {
+		t.Fatalf("Failed to decode client peer ID: %v", err)
+	}
+	unknownPeerID, err := peer.Decode("12D3KooWNS4QQxwNURwoYoXmGjH9AQkagcGTjRUQT33P4i4FKQsi")
+	if err != nil {
+		t.Fatalf("Failed to decode unknown peer ID: %v", err)
+	}
+
+	SetBootstrapPeers([]peer.AddrInfo{{ID: bootstrapPeerID}})
+	classifier := NewPeerClassifier(nil)
+	classifier.AddRelays(peer.AddrInfo{ID: relayPeerID})
+	classifier.SetRole(runnerPeerID, RoleRunner)
+	classifier.SetRole(clientPeerID, RoleClient)
+
+	tests := []struct {
+		name        string
+		pid         peer.ID
+		want        PeerRole
+		validTarget bool
+	}{
+		{name: "Bootstrap peer", pid: bootstrapPeerID, want: RoleBootstrap, validTarget: false},
+		{name: "Relay peer", pid: relayPeerID, want: RoleRelay, validTarget: false},
+		{name: "Runner peer", pid: runnerPeerID, want: RoleRunner, validTarget: true},
+		{name: "Client peer", pid: clientPeerID, want: RoleClient, validTarget: false},
+		{name: "Unknown peer", pid: unknownPeerID, want: RoleUnknown, validTarget: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifier.Classify(tt.pid); got != tt.want {
+				t.Errorf("Classify() = %v, want %v", got, tt.want)
+			}
+			if got := classifier.IsValidTarget(tt.pid); got != tt.validTarget {
+				t.Errorf("IsValidTarget() = %v, want %v", got, tt.validTarget)
+			}
+		})
+	}
+}
+
+func TestRoleFromUserAgent(t *testing.T) {
+	tests := []struct {
+		name  string
+		agent string
+		want  PeerRole
+	}{
+		{name: "Runner agent", agent: RoleUserAgent(RoleRunner), want: RoleRunner},
+		{name: "Relay agent", agent: RoleUserAgent(RoleRelay), want: RoleRelay},
+		{name: "Foreign agent", agent: "kubo/0.30.0", want: RoleUnknown},
+		{name: "Bad role", agent: "mnwarm-toaster/0.0.1", want: RoleUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := roleFromUserAgent(tt.agent); got != tt.want {
+				t.Errorf("roleFromUserAgent(%q) = %v, want %v", tt.agent, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadBootstrapList(t *testing.T) {
+	operatorKey, operatorPub, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate operator key: %v", err)
+	}
+	_, otherPub, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate other key: %v", err)
+	}
+
+	addrs := []string{
+		"/ip4/127.0.0.1/tcp/1237/p2p/12D3KooWLr1gYejUTeriAsSu6roR2aQ423G3Q4fFTqzqSwTsMz9n",
+		"/ip4/127.0.0.1/tcp/1238/p2p/12D3KooWBnext3VBZZuBwGn3YahAZjf49oqYckfx64VpzH6dyU1p",
+	}
+	list, err := SignBootstrapList(addrs, operatorKey)
+	if err != nil {
+		t.Fatalf("Failed to sign bootstrap list: %v", err)
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		t.Fatalf("Failed to marshal bootstrap list: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "bootstrap.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("Failed to write bootstrap list: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		pubKey  crypto.PubKey
+		want    int
+		wantErr bool
+	}{
+		{name: "Signed by operator", pubKey: operatorPub, want: 2, wantErr: false},
+		{name: "Signed by someone else", pubKey: otherPub, want: 0, wantErr: true},
+		{name: "No operator key", pubKey: nil, want: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadBootstrapList(path, tt.pubKey)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadBootstrapList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != tt.want {
+				t.Errorf("LoadBootstrapList() got %d peers, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestSignedManifest(t *testing.T) {
+	operatorKey, operatorPub, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate operator key: %v", err)
+	}
+	_, otherPub, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate other key: %v", err)
+	}
+
+	m := &Manifest{
+		Version:    3,
+		Bootstraps: []string{"/ip4/127.0.0.1/tcp/1237/p2p/12D3KooWLr1gYejUTeriAsSu6roR2aQ423G3Q4fFTqzqSwTsMz9n"},
+		Policy:     map[string]string{"sessions": "4", "interval": "30s", "broken": "x"},
+	}
+	signed, err := SignManifest(m, operatorKey)
+	if err != nil {
+		t.Fatalf("Failed to sign manifest: %v", err)
+	}
+	// operators keep the file indented, the signature covers the compact form
+	data, err := json.MarshalIndent(signed, "", "  ")
+	if err != nil {
+		t.Fatalf("Failed to marshal manifest: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	read, err := ReadManifest(path)
+	if err != nil {
+		t.Fatalf("ReadManifest() error = %v", err)
+	}
+	tampered := &SignedManifest{
+		Manifest:  []byte(strings.Replace(string(read.Manifest), `"version": 3`, `"version": 4`, 1)),
+		Signature: read.Signature,
+	}
+
+	tests := []struct {
+		name    string
+		signed  *SignedManifest
+		pubKey  crypto.PubKey
+		wantErr bool
+	}{
+		{name: "Signed by operator", signed: read, pubKey: operatorPub, wantErr: false},
+		{name: "Signed by someone else", signed: read, pubKey: otherPub, wantErr: true},
+		{name: "No operator key", signed: read, pubKey: nil, wantErr: true},
+		{name: "Tampered version", signed: tampered, pubKey: operatorPub, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.signed.Open(tt.pubKey)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Open() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Version != 3 {
+				t.Errorf("Open() version = %d, want 3", got.Version)
+			}
+		})
+	}
+
+	opened, err := read.Open(operatorPub)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if got := opened.PolicyInt("sessions", 1); got != 4 {
+		t.Errorf("PolicyInt() = %d, want 4", got)
+	}
+	if got := opened.PolicyInt("broken", 1); got != 1 {
+		t.Errorf("PolicyInt() on a malformed value = %d, want the default", got)
+	}
+	if got := opened.PolicyDuration("interval", time.Minute); got != 30*time.Second {
+		t.Errorf("PolicyDuration() = %s, want 30s", got)
+	}
+	if peers, err := opened.BootstrapPeers(); err != nil || len(peers) != 1 {
+		t.Errorf("BootstrapPeers() = %v, %v, want one peer", peers, err)
+	}
+}
+
+func TestPeerScorer(t *testing.T) {
+	scorer := NewPeerScorer(connmgr.NullConnMgr{})
+
+	reliable := peer.ID("reliable")
+	slow := peer.ID("slow")
+	failing := peer.ID("failing")
+
+	for i := 0; i < 5; i++ {
+		scorer.RecordRPC(reliable, true, 20*time.Millisecond)
+		scorer.RecordRPC(slow, true, 2*time.Second)
+		scorer.RecordRPC(failing, i == 0, 20*time.Millisecond)
+	}
+
+	tests := []struct {
+		name   string
+		better peer.ID
+		worse  peer.ID
+	}{
+		{name: "Fast peer beats slow peer", better: reliable, worse: slow},
+		{name: "Slow peer beats failing peer", better: slow, worse: failing},
+		{name: "Unknown peer beats failing peer", better: peer.ID("unknown"), worse: failing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if scorer.Score(tt.better) <= scorer.Score(tt.worse) {
+				t.Errorf("Score(%s) = %d, want above Score(%s) = %d", tt.better, scorer.Score(tt.better), tt.worse, scorer.Score(tt.worse))
+			}
+		})
+	}
+
+	scorer.Forget(failing)
+	if got := scorer.Score(failing); got != 0 {
+		t.Errorf("Score() after Forget = %d, want 0", got)
+	}
+}
+
+func TestPeerScorerWatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mn, err := mocknet.FullMeshLinked(2)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+	h, other := mn.Hosts()[0], mn.Hosts()[1]
+	scorer := NewPeerScorer(h.ConnManager())
+	if err := scorer.Watch(ctx, h); err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	tracked := func() int {
+		scorer.mu.Lock()
+		defer scorer.mu.Unlock()
+		return len(scorer.stats)
+	}
+	waitUntil := func(what string, cond func() bool) {
+		t.Helper()
+		for !cond() {
+			select {
+			case <-time.After(20 * time.Millisecond):
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	if _, err := mn.ConnectPeers(h.ID(), other.ID()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	waitUntil("identify to score the peer", func() bool { return scorer.Score(other.ID()) > 0 })
+	if err := mn.DisconnectPeers(h.ID(), other.ID()); err != nil {
+		t.Fatalf("Failed to disconnect: %v", err)
+	}
+	waitUntil("the peer to be forgotten", func() bool { return tracked() == 0 })
+
+	// a failed dial leaves nothing behind either
+	scorer.RecordRPC(peer.ID("never connected"), false, 0)
+	if n := tracked(); n != 0 {
+		t.Errorf("scorer keeps %d peers we are not connected to", n)
+	}
+}
+
+func TestWaitForBootstrap(t *testing.T) {
+	mn, err := mocknet.FullMeshLinked(2)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+	hosts := mn.Hosts()
+	boot := peer.AddrInfo{ID: hosts[1].ID(), Addrs: hosts[1].Addrs()}
+
+	if err := WaitForBootstrap(context.Background(), hosts[0], []peer.AddrInfo{boot}, 2*time.Second); err != nil {
+		t.Fatalf("WaitForBootstrap() error = %v", err)
+	}
+
+	unreachable, err := mn.GenPeer()
+	if err != nil {
+		t.Fatalf("Failed to create peer: %v", err)
+	}
+	info := peer.AddrInfo{ID: unreachable.ID(), Addrs: unreachable.Addrs()}
+	start := time.Now()
+	if err := WaitForBootstrap(context.Background(), hosts[0], []peer.AddrInfo{info}, 500*time.Millisecond); err == nil {
+		t.Fatal("expected an error for an unlinked bootstrap peer")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("WaitForBootstrap() ignored its timeout, took %s", time.Since(start))
+	}
+}
+
+func TestWaitForRelayAddrsTimeout(t *testing.T) {
+	mn, err := mocknet.FullMeshLinked(1)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+
+	if err := WaitForRelayAddrs(context.Background(), mn.Hosts()[0], 200*time.Millisecond); err == nil {
+		t.Fatal("expected an error for a host without circuit addrs")
+	}
+}
+
+func TestReservationKeeper(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(3)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+	relayHost, runnerHost, otherHost := mn.Hosts()[0], mn.Hosts()[1], mn.Hosts()[2]
+
+	resources := relay.DefaultResources()
+	resources.ReservationTTL = 2 * time.Second
+	resources.MaxReservations = 1
+	if _, err := relay.New(relayHost, relay.WithResources(resources)); err != nil {
+		t.Fatalf("Failed to start relay: %v", err)
+	}
+	relayInfo := peer.AddrInfo{ID: relayHost.ID(), Addrs: relayHost.Addrs()}
+
+	rsvp, err := ReserveRelay(ctx, runnerHost, &relayInfo)
+	if err != nil {
+		t.Fatalf("ReserveRelay() error = %v", err)
+	}
+	// the relay has room for one reservation only
+	if _, err := ReserveRelay(ctx, otherHost, &relayInfo); !IsReservationRefused(err) {
+		t.Errorf("second reservation error = %v, want a refusal", err)
+	}
+	if _, err := ReserveRelay(ctx, runnerHost, nil); IsReservationRefused(err) {
+		t.Error("a nil relay counts as a refusal")
+	}
+
+	keeper := NewReservationKeeper(runnerHost, relayInfo)
+	events := make(chan ReservationEvent, 8)
+	keeper.OnEvent(func(ev ReservationEvent) { events <- ev })
+	if err := keeper.Keep(ctx, rsvp); err != nil {
+		t.Fatalf("Keep() error = %v", err)
+	}
+
+	next := func(want ReservationEventType) ReservationEvent {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.Type != want || ev.Relay != relayHost.ID() {
+				t.Fatalf("event = %s from %s, want %s from %s", ev.Type, ev.Relay, want, relayHost.ID())
+			}
+			return ev
+		case <-ctx.Done():
+			t.Fatalf("no %s event", want)
+			return ReservationEvent{}
+		}
+	}
+
+	renewed := next(ReservationRenewed)
+	if !renewed.Reservation.Expiration.After(rsvp.Expiration) {
+		t.Errorf("renewed reservation expires %s, not after %s", renewed.Reservation.Expiration, rsvp.Expiration)
+	}
+	if keeper.Current() != renewed.Reservation {
+		t.Error("Current() is not the renewed reservation")
+	}
+
+	if err := mn.DisconnectPeers(runnerHost.ID(), relayHost.ID()); err != nil {
+		t.Fatalf("Failed to disconnect: %v", err)
+	}
+	next(ReservationLost)
+	// the relay is still reachable, so the keeper reserves again
+	next(ReservationRenewed)
+	if keeper.Current() == nil {
+		t.Error("Current() = nil after the reservation came back")
+	}
+}
+
+func TestOpenStreamOverLimitedConn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	defer func(d time.Duration) { DirectConnTimeout = d }(DirectConnTimeout)
+	DirectConnTimeout = 300 * time.Millisecond
+
+	relayHost, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.EnableRelayService(), libp2p.ForceReachabilityPublic())
+	if err != nil {
+		t.Fatalf("Failed to create relay: %v", err)
+	}
+	defer relayHost.Close()
+	// the runner has no listen addrs, only the relay reaches it
+	runnerHost, err := libp2p.New(libp2p.NoListenAddrs, libp2p.EnableRelay())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	defer runnerHost.Close()
+	clientHost, err := libp2p.New(libp2p.NoListenAddrs, libp2p.EnableRelay())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer clientHost.Close()
+
+	const proto = protocol.ID("/mnwarm/test/1.0.0")
+	runnerHost.SetStreamHandler(proto, func(s network.Stream) { s.Close() })
+
+	relayInfo := peer.AddrInfo{ID: relayHost.ID(), Addrs: relayHost.Addrs()}
+	if _, err := ReserveRelay(ctx, runnerHost, &relayInfo); err != nil {
+		t.Fatalf("ReserveRelay() error = %v", err)
+	}
+	circuit, err := multiaddr.NewMultiaddr(fmt.Sprintf("%s/p2p/%s/p2p-circuit", relayHost.Addrs()[0], relayHost.ID()))
+	if err != nil {
+		t.Fatalf("Failed to build circuit addr: %v", err)
+	}
+	err = clientHost.Connect(network.WithAllowLimitedConn(ctx, "test"), peer.AddrInfo{ID: runnerHost.ID(), Addrs: []multiaddr.Multiaddr{circuit}})
+	if err != nil {
+		t.Fatalf("Failed to connect through the relay: %v", err)
+	}
+	if !IsLimitedPeer(clientHost, runnerHost.ID()) {
+		t.Fatal("IsLimitedPeer() = false for a peer reached through the relay")
+	}
+
+	tests := []struct {
+		kind    StreamKind
+		wantErr error
+	}{
+		{kind: ControlStream},
+		{kind: BulkStream},
+		{kind: DirectStream, wantErr: ErrLimitedConn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind.String(), func(t *testing.T) {
+			s, err := OpenStream(ctx, clientHost, runnerHost.ID(), tt.kind, proto)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("OpenStream() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenStream() error = %v", err)
+			}
+			defer s.Close()
+			if !s.Conn().Stat().Limited {
+				t.Error("stream did not go over the limited connection")
+			}
+		})
+	}
+}
+
+func TestNewHost(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	bootCfg := BootstrapHostConfig(0)
+	bootCfg.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+	boot, bootDHT, err := NewHost(ctx, bootCfg)
+	if err != nil {
+		t.Fatalf("NewHost(bootstrap) error = %v", err)
+	}
+	defer boot.Close()
+	defer bootDHT.Close()
+	if bootDHT.Mode() != dht.ModeServer {
+		t.Errorf("bootstrap DHT mode = %v, want server", bootDHT.Mode())
+	}
+
+	bootInfo := peer.AddrInfo{ID: boot.ID(), Addrs: boot.Addrs()}
+	runnerCfg := RunnerHostConfig(bootInfo)
+	runnerCfg.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+	runner, runnerDHT, err := NewHost(ctx, runnerCfg)
+	if err != nil {
+		t.Fatalf("NewHost(runner) error = %v", err)
+	}
+	defer runner.Close()
+	defer runnerDHT.Close()
+	if runnerDHT.Mode() != dht.ModeClient {
+		t.Errorf("runner DHT mode = %v, want client", runnerDHT.Mode())
+	}
+
+	if err := runner.Connect(ctx, bootInfo); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	// identify tells the bootstrap node our role through the user agent
+	classifier := NewPeerClassifier(boot)
+	for classifier.Classify(runner.ID()) != RoleRunner {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("bootstrap classified the runner as %s", classifier.Classify(runner.ID()))
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestParseTransports(t *testing.T) {
+	got, err := ParseTransports(" tcp, QUIC,,ws ")
+	if err != nil {
+		t.Fatalf("ParseTransports() error = %v", err)
+	}
+	want := []Transport{TransportTCP, TransportQUIC, TransportWebSocket}
+	if len(got) != len(want) {
+		t.Fatalf("ParseTransports() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ParseTransports()[%d] = %s, want %s", i, got[i], want[i])
+		}
+	}
+	if _, err := ParseTransports("tcp,udp"); err == nil {
+		t.Error("expected an error for an unknown transport")
+	}
+	if _, err := ParseSecurity("tls,plaintext"); err == nil {
+		t.Error("expected an error for an unknown security protocol")
+	}
+}
+
+func TestHostConfigListenAddrs(t *testing.T) {
+	cfg := RelayHostConfig(1240)
+	addrs := strings.Join(cfg.listenAddrs(), " ")
+	for _, want := range []string{
+		"/ip4/0.0.0.0/tcp/1240",
+		"/ip4/0.0.0.0/udp/1240/quic-v1",
+		"/ip4/0.0.0.0/udp/1240/quic-v1/webtransport",
+		"/ip4/0.0.0.0/tcp/1241/ws",
+	} {
+		if !strings.Contains(addrs, want) {
+			t.Errorf("relay listen addrs %s miss %s", addrs, want)
+		}
+	}
+
+	if err := cfg.UseTransports("quic"); err != nil {
+		t.Fatal(err)
+	}
+	if addrs := cfg.listenAddrs(); len(addrs) != 2 || !strings.HasSuffix(addrs[0], "/quic-v1") {
+		t.Errorf("quic only listen addrs = %v", addrs)
+	}
+	if err := cfg.UseTransports(""); err != nil || len(cfg.Transports) != 1 {
+		t.Errorf("empty transports should keep the current ones, got %v, %v", cfg.Transports, err)
+	}
+}
+
+func TestNewHostTransports(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		transport string
+		security  string
+		listen    string
+		// negotiated security, quic brings its own
+		wantSecurity protocol.ID
+	}{
+		{"quic", "noise", "/ip4/127.0.0.1/udp/0/quic-v1", ""},
+		{"tcp", "tls", "/ip4/127.0.0.1/tcp/0", libp2ptls.ID},
+		{"ws", "noise", "/ip4/127.0.0.1/tcp/0/ws", noise.ID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.transport+"/"+tt.security, func(t *testing.T) {
+			// the pinned quic-go panics in its handshake from go1.24 on, the images build with go1.23
+			if tt.transport == "quic" && version.Compare(runtime.Version(), "go1.24") >= 0 {
+				t.Skipf("quic-go v0.48 does not support %s", runtime.Version())
+			}
+			var hosts []peer.AddrInfo
+			for i := 0; i < 2; i++ {
+				cfg := ClientHostConfig()
+				cfg.ListenAddrs = []string{tt.listen}
+				if err := cfg.UseTransports(tt.transport); err != nil {
+					t.Fatal(err)
+				}
+				if err := cfg.UseSecurity(tt.security); err != nil {
+					t.Fatal(err)
+				}
+				h, d, err := NewHost(ctx, cfg)
+				if err != nil {
+					t.Fatalf("NewHost() error = %v", err)
+				}
+				defer h.Close()
+				defer d.Close()
+				hosts = append(hosts, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})
+				if i == 1 {
+					if err := h.Connect(ctx, hosts[0]); err != nil {
+						t.Fatalf("Connect() over %s error = %v", tt.transport, err)
+					}
+					conns := h.Network().ConnsToPeer(hosts[0].ID)
+					if len(conns) == 0 {
+						t.Fatal("no connection after Connect()")
+					}
+					if tt.wantSecurity != "" && conns[0].ConnState().Security != tt.wantSecurity {
+						t.Errorf("connection security = %s, want %s", conns[0].ConnState().Security, tt.wantSecurity)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPrivateNetwork(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	newKey := func() pnet.PSK {
+		key, err := GenerateSwarmKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		psk, err := ParsePSK(key)
+		if err != nil {
+			t.Fatalf("ParsePSK(GenerateSwarmKey()) error = %v", err)
+		}
+		return psk
+	}
+	ours, theirs := newKey(), newKey()
+
+	newHost := func(psk pnet.PSK) peer.AddrInfo {
+		cfg := BootstrapHostConfig(0)
+		cfg.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+		if psk != nil {
+			if err := cfg.UsePrivateNetwork(psk); err != nil {
+				t.Fatalf("UsePrivateNetwork() error = %v", err)
+			}
+			for _, tr := range cfg.Transports {
+				if !tr.supportsPSK() {
+					t.Errorf("transport %s kept in a private network", tr)
+				}
+			}
+		}
+		h, d, err := NewHost(ctx, cfg)
+		if err != nil {
+			t.Fatalf("NewHost() error = %v", err)
+		}
+		t.Cleanup(func() {
+			d.Close()
+			h.Close()
+		})
+		if psk != nil {
+			kad := protocol.ID(string(PrivateDHTPrefix) + "/kad/1.0.0")
+			found := false
+			for _, p := range h.Mux().Protocols() {
+				found = found || p == kad
+			}
+			if !found {
+				t.Errorf("private host does not serve %s", kad)
+			}
+		}
+		return peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}
+	}
+
+	a := newHost(ours)
+	bCfg := BootstrapHostConfig(0)
+	bCfg.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+	if err := bCfg.UsePrivateNetwork(ours); err != nil {
+		t.Fatal(err)
+	}
+	b, bDHT, err := NewHost(ctx, bCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	defer bDHT.Close()
+	if err := b.Connect(ctx, a); err != nil {
+		t.Fatalf("same swarm key: Connect() error = %v", err)
+	}
+
+	shortCtx, shortCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer shortCancel()
+	if err := b.Connect(shortCtx, newHost(theirs)); err == nil {
+		t.Error("connected to a host with another swarm key")
+	}
+	if err := b.Connect(shortCtx, newHost(nil)); err == nil {
+		t.Error("connected to a host outside the private network")
+	}
+}
+
+func TestStoreReconnects(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	bootCfg := BootstrapHostConfig(0)
+	bootCfg.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+	boot, bootDHT, err := NewHost(ctx, bootCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boot.Close()
+	defer bootDHT.Close()
+	bootInfo := peer.AddrInfo{ID: boot.ID(), Addrs: boot.Addrs()}
+
+	dir := t.TempDir()
+	start := func() (*Store, host.Host, *dht.IpfsDHT) {
+		store, err := OpenStore(dir)
+		if err != nil {
+			t.Fatalf("OpenStore() error = %v", err)
+		}
+		cfg := ClientHostConfig()
+		cfg.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+		cfg.Store = store
+		h, d, err := NewHost(ctx, cfg)
+		if err != nil {
+			t.Fatalf("NewHost() error = %v", err)
+		}
+		return store, h, d
+	}
+
+	store, h, d := start()
+	if err := h.Connect(ctx, bootInfo); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitForRoutingTable(ctx, d, 1, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveRoutingTable(ctx, d); err != nil {
+		t.Fatalf("SaveRoutingTable() error = %v", err)
+	}
+	// the addrs of peers we are no longer connected to expire from the peerstore
+	h.Peerstore().ClearAddrs(boot.ID())
+	d.Close()
+	h.Close()
+	store.Close()
+
+	// the restarted host dials the bootstrap node on its own
+	store, h, d = start()
+	defer store.Close()
+	defer h.Close()
+	defer d.Close()
+	for h.Network().Connectedness(boot.ID()) != network.Connected {
+		select {
+		case <-ctx.Done():
+			t.Fatal("restarted host never reconnected to the peer it knew")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestMappingBehavior(t *testing.T) {
+	observed := func(addrs ...string) map[peer.ID]multiaddr.Multiaddr {
+		m := make(map[peer.ID]multiaddr.Multiaddr)
+		for i, a := range addrs {
+			m[peer.ID(fmt.Sprintf("peer%d", i))] = multiaddr.StringCast(a)
+		}
+		return m
+	}
+	tests := []struct {
+		name     string
+		observed map[peer.ID]multiaddr.Multiaddr
+		want     string
+	}{
+		{"nothing observed", observed(), MappingUnknown},
+		{"single observer", observed("/ip4/93.184.216.34/tcp/4001"), MappingUnknown},
+		{"same port", observed("/ip4/93.184.216.34/tcp/4001", "/ip4/93.184.216.34/tcp/4001"), MappingEndpointIndependent},
+		{"port per peer", observed("/ip4/93.184.216.34/udp/4001/quic-v1", "/ip4/93.184.216.34/udp/5123/quic-v1"), MappingEndpointDependent},
+		{"tcp and udp apart", observed("/ip4/93.184.216.34/tcp/4001", "/ip4/93.184.216.34/udp/5123/quic-v1"), MappingUnknown},
+		{"private observers", observed("/ip4/192.168.1.20/tcp/4001", "/ip4/192.168.1.20/tcp/4001", "/ip4/127.0.0.1/tcp/4001"), MappingUnknown},
+		{"one transport dependent", observed("/ip4/93.184.216.34/tcp/4001", "/ip4/93.184.216.34/tcp/4001",
+			"/ip4/93.184.216.34/udp/4001/quic-v1", "/ip4/93.184.216.34/udp/6000/quic-v1"), MappingEndpointDependent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mappingBehavior(tt.observed); got != tt.want {
+				t.Errorf("mappingBehavior() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiagnosticsForgetsDisconnectedObservers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mn, err := mocknet.FullMeshLinked(2)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+	h, other := mn.Hosts()[0], mn.Hosts()[1]
+	d := NewDiagnostics()
+	if err := d.start(ctx, h, HostConfig{}); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+
+	observedBy := func(pid peer.ID) bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		_, ok := d.observed[pid]
+		return ok
+	}
+	waitUntil := func(what string, cond func() bool) {
+		t.Helper()
+		for !cond() {
+			select {
+			case <-time.After(20 * time.Millisecond):
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	if _, err := mn.ConnectPeers(other.ID(), h.ID()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	waitUntil("the observed addr", func() bool { return observedBy(other.ID()) })
+	if err := mn.DisconnectPeers(other.ID(), h.ID()); err != nil {
+		t.Fatalf("Failed to disconnect: %v", err)
+	}
+	waitUntil("the observation to be dropped", func() bool { return !observedBy(other.ID()) })
+}
+
+func TestDiagnosticsTrace(t *testing.T) {
+	d := NewDiagnostics()
+	remote := peer.ID("remote")
+	at := time.Now()
+	trace := func(evt any) {
+		d.Trace(&holepunch.Event{Timestamp: at.UnixNano(), Remote: remote, Evt: evt})
+	}
+	trace(&holepunch.DirectDialEvt{Success: false, Error: "no good addrs", EllapsedTime: time.Second})
+	trace(&holepunch.StartHolePunchEvt{RemoteAddrs: []string{"/ip4/203.0.113.7/udp/4001/quic-v1"}, RTT: 80 * time.Millisecond})
+	trace(&holepunch.HolePunchAttemptEvt{Attempt: 2})
+	trace(&holepunch.EndHolePunchEvt{Success: false, Error: "all retries failed", EllapsedTime: 3 * time.Second})
+
+	if len(d.holePunches) != 2 {
+		t.Fatalf("history = %+v, want a direct dial and a hole punch", d.holePunches)
+	}
+	dial, hp := d.holePunches[0], d.holePunches[1]
+	if dial.Type != HolePunchDirectDial || !dial.Done || dial.Error != "no good addrs" {
+		t.Errorf("direct dial = %+v", dial)
+	}
+	if hp.Type != HolePunchHolePunch || !hp.Done || hp.Success || hp.Rounds != 2 ||
+		hp.RTT != 80*time.Millisecond || hp.Error != "all retries failed" || len(hp.Addrs) != 1 {
+		t.Errorf("hole punch = %+v", hp)
+	}
+
+	for i := 0; i < maxHolePunchHistory+10; i++ {
+		trace(&holepunch.ProtocolErrorEvt{Error: "stream reset"})
+	}
+	if len(d.holePunches) != maxHolePunchHistory {
+		t.Errorf("history holds %d attempts, want %d", len(d.holePunches), maxHolePunchHistory)
+	}
+}
+
+func TestDiagnosticsReport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	bootCfg := BootstrapHostConfig(0)
+	bootCfg.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+	boot, bootDHT, err := NewHost(ctx, bootCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boot.Close()
+	defer bootDHT.Close()
+
+	bootInfo := peer.AddrInfo{ID: boot.ID(), Addrs: boot.Addrs()}
+	diag := NewDiagnostics()
+	runnerCfg := RunnerHostConfig(bootInfo)
+	runnerCfg.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+	runnerCfg.Diagnostics = diag
+	runner, runnerDHT, err := NewHost(ctx, runnerCfg)
+	if err != nil {
+		t.Fatalf("NewHost() error = %v", err)
+	}
+	defer runner.Close()
+	defer runnerDHT.Close()
+	if err := runner.Connect(ctx, bootInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	// identify reports what the bootstrap node sees us as
+	var report NATReport
+	for len(report.Observed) == 0 {
+		if report, err = diag.Report(ctx, bootInfo); err != nil {
+			t.Fatalf("Report() error = %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("no observed addr reported")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if report.Peer != runner.ID().String() || report.Observed[0].Observers != 1 {
+		t.Errorf("report = %+v", report)
+	}
+	if len(report.AutoNAT) == 0 || report.AutoNAT[0].Error != "private addr, not checked" {
+		t.Errorf("autonat checks = %+v, want our loopback addr skipped", report.AutoNAT)
+	}
+	if !report.PortMapping.Enabled {
+		t.Error("port mapping not reported")
+	}
+	if len(report.Relays) != 1 || !report.Relays[0].Connected || report.Relays[0].Reserved {
+		t.Errorf("relays = %+v, want connected without a reservation", report.Relays)
+	}
+}
+
+func TestConnectViaRelaysReportsUsedCircuit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	newRelay := func(listen ...string) host.Host {
+		t.Helper()
+		h, err := libp2p.New(libp2p.ListenAddrStrings(listen...), libp2p.EnableRelayService(), libp2p.ForceReachabilityPublic())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+	relayHost := newRelay("/ip4/127.0.0.1/tcp/0", "/ip4/127.0.0.1/tcp/0/ws")
+	refusing := newRelay("/ip4/127.0.0.1/tcp/0")
+	runnerHost, err := libp2p.New(libp2p.NoListenAddrs, libp2p.EnableRelay())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runnerHost.Close()
+	relayInfo := peer.AddrInfo{ID: relayHost.ID(), Addrs: relayHost.Addrs()}
+	if _, err := ReserveRelay(ctx, runnerHost, &relayInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("held relay connection", func(t *testing.T) {
+		clientHost, err := libp2p.New(libp2p.NoListenAddrs, libp2p.EnableRelay())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer clientHost.Close()
+
+		// the TCP candidate ranks first, but the circuit rides on the WebSocket connection we hold
+		var wsAddrs []multiaddr.Multiaddr
+		for _, a := range relayHost.Addrs() {
+			if AddrTransport(a) == "ws" {
+				wsAddrs = append(wsAddrs, a)
+			}
+		}
+		if err := clientHost.Connect(ctx, peer.AddrInfo{ID: relayHost.ID(), Addrs: wsAddrs}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ConnectViaRelays(ctx, clientHost, runnerHost.ID(), relayInfo)
+		if err != nil {
+			t.Fatalf("ConnectViaRelays() error = %v", err)
+		}
+		if got.Relay != relayHost.ID() || got.Transport != "ws" {
+			t.Errorf("ConnectViaRelays() = %+v, want the WebSocket circuit we already had", got)
+		}
+	})
+
+	t.Run("losing relay connection closed", func(t *testing.T) {
+		clientHost, err := libp2p.New(libp2p.NoListenAddrs, libp2p.EnableRelay())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer clientHost.Close()
+
+		// the runner holds no reservation on the refusing relay, its candidate goes first and loses
+		refusingInfo := peer.AddrInfo{ID: refusing.ID(), Addrs: refusing.Addrs()}
+		got, err := ConnectViaRelays(ctx, clientHost, runnerHost.ID(), refusingInfo, relayInfo)
+		if err != nil {
+			t.Fatalf("ConnectViaRelays() error = %v", err)
+		}
+		if got.Relay != relayHost.ID() {
+			t.Errorf("ConnectViaRelays() = %+v, want the circuit through %s", got, relayHost.ID())
+		}
+		for clientHost.Network().Connectedness(refusing.ID()) == network.Connected {
+			select {
+			case <-ctx.Done():
+				t.Fatal("connection to the losing relay still open")
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+		if clientHost.Network().Connectedness(relayHost.ID()) != network.Connected {
+			t.Error("connection to the relay the circuit rides on was closed")
+		}
+	})
+}
+
+func TestHolePunchTracer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	relayHost, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.EnableRelayService(), libp2p.ForceReachabilityPublic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relayHost.Close()
+	runnerHost, err := libp2p.New(libp2p.NoListenAddrs, libp2p.EnableRelay())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runnerHost.Close()
+	clientHost, err := libp2p.New(libp2p.NoListenAddrs, libp2p.EnableRelay())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientHost.Close()
+
+	d := NewDiagnostics()
+	d.observed["a"] = multiaddr.StringCast("/ip4/93.184.216.34/tcp/4001")
+	d.observed["b"] = multiaddr.StringCast("/ip4/93.184.216.34/tcp/4001")
+	tracer := NewHolePunchTracer()
+	tracer.attach(clientHost, d)
+
+	relayInfo := peer.AddrInfo{ID: relayHost.ID(), Addrs: relayHost.Addrs()}
+	if _, err := ReserveRelay(ctx, runnerHost, &relayInfo); err != nil {
+		t.Fatal(err)
+	}
+	circuit := multiaddr.StringCast(fmt.Sprintf("%s/p2p/%s/p2p-circuit", relayHost.Addrs()[0], relayHost.ID()))
+	err = clientHost.Connect(network.WithAllowLimitedConn(ctx, "test"), peer.AddrInfo{ID: runnerHost.ID(), Addrs: []multiaddr.Multiaddr{circuit}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trace := func(evt any) {
+		tracer.Trace(&holepunch.Event{Timestamp: time.Now().UnixNano(), Remote: runnerHost.ID(), Evt: evt})
+	}
+	trace(&holepunch.DirectDialEvt{Success: false, Error: "no addrs"})
+	trace(&holepunch.StartHolePunchEvt{RTT: 20 * time.Millisecond})
+	trace(&holepunch.EndHolePunchEvt{Success: false, Error: "all retries failed"})
+
+	// the runner was never left, closing the relayed connection leaves the client stuck
+	if err := clientHost.Network().ClosePeer(runnerHost.ID()); err != nil {
+		t.Fatal(err)
+	}
+	var stats HolePunchSummary
+	for stats = tracer.Stats(); stats.Total.RelayClosed == 0; stats = tracer.Stats() {
+		select {
+		case <-ctx.Done():
+			t.Fatal("relayed connection close not counted")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	want := HolePunchStats{DirectDials: 1, Attempts: 1, Failures: 1, RelayClosed: 1, StuckOnRelay: 1, LastRTT: 20 * time.Millisecond, LastError: "all retries failed"}
+	for name, got := range map[string]HolePunchStats{
+		"total": stats.Total,
+		"peer":  stats.ByPeer[runnerHost.ID().String()],
+		"nat":   stats.ByNAT[MappingEndpointIndependent],
+	} {
+		got.LastAttempt = time.Time{}
+		if got != want {
+			t.Errorf("%s stats = %+v, want %+v", name, got, want)
+		}
+	}
+	if got := stats.Total.SystemConfig()[AttrHolePunchStuck]; got != "1" {
+		t.Errorf("SystemConfig()[%s] = %q, want 1", AttrHolePunchStuck, got)
+	}
+	// the tracer counts the close before it marks the history
+	history := d.holePunchHistory()
+	for len(history) == 2 && !history[1].RelayClosed {
+		select {
+		case <-ctx.Done():
+			t.Fatal("relayed connection close not in the diagnostics history")
+		case <-time.After(20 * time.Millisecond):
+		}
+		history = d.holePunchHistory()
+	}
+	if len(history) != 2 || !history[1].RelayClosed || history[1].Direct {
+		t.Errorf("diagnostics history = %+v, want the hole punch marked stuck", history)
+	}
+}
+
+func TestUseReachability(t *testing.T) {
+	tests := []struct {
+		mode    string
+		want    network.Reachability
+		wantErr bool
+	}{
+		{mode: "", want: network.ReachabilityPrivate},
+		{mode: ReachabilityAuto, want: network.ReachabilityUnknown},
+		{mode: ReachabilityPublic, want: network.ReachabilityPublic},
+		{mode: ReachabilityPrivate, want: network.ReachabilityPrivate},
+		{mode: "sometimes", want: network.ReachabilityPrivate, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg := RunnerHostConfig()
+			err := cfg.UseReachability(tt.mode)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UseReachability(%q) error = %v, wantErr %v", tt.mode, err, tt.wantErr)
+			}
+			if cfg.Reachability != tt.want {
+				t.Errorf("UseReachability(%q) reachability = %s, want %s", tt.mode, cfg.Reachability, tt.want)
+			}
+		})
+	}
 }
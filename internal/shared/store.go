@@ -0,0 +1,154 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoreds"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// RoutingTableSaveInterval is how often a Store snapshots the routing table while running
+const RoutingTableSaveInterval = time.Minute
+
+var routingTableKey = ds.NewKey("/routing-table")
+
+// Store keeps a node's peerstore, DHT records and last routing table on disk,
+// so a restarted node reconnects to the peers it knew instead of starting over
+type Store struct {
+	ds ds.Batching
+}
+
+// OpenStore opens or creates the leveldb store in dir
+func OpenStore(dir string) (*Store, error) {
+	d, err := leveldb.NewDatastore(dir, nil)
+	if err != nil {
+		return nil, fmt.Errorf("datastore error: %w", err)
+	}
+	return &Store{ds: d}, nil
+}
+
+// NewMemoryStore is a Store that forgets everything on exit, for tests
+func NewMemoryStore() *Store {
+	return &Store{ds: ds.NewMapDatastore()}
+}
+
+func (s *Store) Close() error {
+	return s.ds.Close()
+}
+
+func (s *Store) peerstore(ctx context.Context) (peerstore.Peerstore, error) {
+	ps, err := pstoreds.NewPeerstore(ctx, namespace.Wrap(s.ds, ds.NewKey("/peerstore")), pstoreds.DefaultOpts())
+	if err != nil {
+		return nil, fmt.Errorf("peerstore error: %w", err)
+	}
+	return ps, nil
+}
+
+func (s *Store) dhtDatastore() ds.Batching {
+	return namespace.Wrap(s.ds, ds.NewKey("/dht"))
+}
+
+// SaveRoutingTable snapshots the peers of the routing table with their addrs. the
+// peerstore drops the addrs of a peer soon after it disconnects, so it can't be relied
+// on after a long downtime
+func (s *Store) SaveRoutingTable(ctx context.Context, d *dht.IpfsDHT) error {
+	ps := d.Host().Peerstore()
+	var peers []peer.AddrInfo
+	for _, id := range d.RoutingTable().ListPeers() {
+		if info := ps.PeerInfo(id); len(info.Addrs) > 0 {
+			peers = append(peers, info)
+		}
+	}
+	if len(peers) == 0 {
+		// keep the last snapshot rather than forgetting everyone during an outage
+		return nil
+	}
+	b, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+	return s.ds.Put(ctx, routingTableKey, b)
+}
+
+// KeepRoutingTable saves the routing table every RoutingTableSaveInterval until ctx is done
+func (s *Store) KeepRoutingTable(ctx context.Context, d *dht.IpfsDHT) {
+	go func() {
+		for {
+			select {
+			case <-time.After(RoutingTableSaveInterval):
+			case <-ctx.Done():
+				return
+			}
+			if err := s.SaveRoutingTable(ctx, d); err != nil && !errors.Is(err, context.Canceled) {
+				log.Warnf("could not save routing table: %v", err)
+			}
+		}
+	}()
+}
+
+// KnownPeers are the peers of the last saved routing table, with their saved addrs and
+// the ones the peerstore has now
+func (s *Store) KnownPeers(ctx context.Context, ps peerstore.Peerstore) ([]peer.AddrInfo, error) {
+	b, err := s.ds.Get(ctx, routingTableKey)
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []peer.AddrInfo
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return nil, fmt.Errorf("saved routing table error: %w", err)
+	}
+	out := make([]peer.AddrInfo, 0, len(saved))
+	for _, info := range saved {
+		info.Addrs = multiaddr.Unique(append(info.Addrs, ps.Addrs(info.ID)...))
+		out = append(out, info)
+	}
+	return out, nil
+}
+
+// Reconnect dials the peers we knew before the restart and returns how many answered
+func (s *Store) Reconnect(ctx context.Context, h host.Host) int {
+	known, err := s.KnownPeers(ctx, h.Peerstore())
+	if err != nil {
+		log.Warnf("could not load known peers: %v", err)
+		return 0
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	connected := 0
+	for _, info := range known {
+		wg.Add(1)
+		go func(info peer.AddrInfo) {
+			defer wg.Done()
+			dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			if err := h.Connect(dialCtx, info); err != nil {
+				log.Debugf("known peer %s is gone: %v", info.ID, err)
+				return
+			}
+			mu.Lock()
+			connected++
+			mu.Unlock()
+		}(info)
+	}
+	wg.Wait()
+	if len(known) > 0 {
+		log.Infof("reconnected to %d of %d known peers", connected, len(known))
+	}
+	return connected
+}
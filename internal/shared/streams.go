@@ -0,0 +1,79 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// DirectConnTimeout is how long a bulk or direct stream waits for a hole punch when
+// the only connection to the peer is a limited relayed one
+var DirectConnTimeout = 15 * time.Second
+
+// ErrLimitedConn is returned for a direct stream when no hole punch succeeded in time
+var ErrLimitedConn = errors.New("only a limited relayed connection to peer")
+
+// StreamKind is what a stream carries, it decides whether a limited relayed
+// connection, which the relay cuts after a few minutes or bytes, may carry it
+type StreamKind int
+
+const (
+	// ControlStream carries small requests and responses, any connection will do
+	ControlStream StreamKind = iota
+	// BulkStream carries a transfer, it waits for a hole punch and only falls back
+	// to the relayed connection when none succeeds in time
+	BulkStream
+	// DirectStream never goes over a relayed connection
+	DirectStream
+)
+
+func (k StreamKind) String() string {
+	switch k {
+	case ControlStream:
+		return "control"
+	case BulkStream:
+		return "bulk"
+	case DirectStream:
+		return "direct"
+	default:
+		return "unknown"
+	}
+}
+
+// IsLimitedPeer is true when we are connected to pid only over limited connections
+func IsLimitedPeer(h host.Host, pid peer.ID) bool {
+	return h.Network().Connectedness(pid) == network.Limited
+}
+
+// OpenStream opens a stream to pid the way kind needs it, see StreamKind
+func OpenStream(ctx context.Context, h host.Host, pid peer.ID, kind StreamKind, protos ...protocol.ID) (network.Stream, error) {
+	if len(protos) == 0 {
+		return nil, errors.New("no protocol given")
+	}
+	if kind == ControlStream {
+		return h.NewStream(network.WithAllowLimitedConn(ctx, string(protos[0])), pid, protos...)
+	}
+
+	// without the limited conn option the swarm dials the peer directly or waits for
+	// the hole punch the relayed connection started
+	directCtx, cancel := context.WithTimeout(ctx, DirectConnTimeout)
+	s, err := h.NewStream(directCtx, pid, protos...)
+	cancel()
+	if err == nil {
+		return s, nil
+	}
+	if ctx.Err() != nil || !IsLimitedPeer(h, pid) {
+		return nil, err
+	}
+	if kind == DirectStream {
+		return nil, fmt.Errorf("%w %s after %s: %v", ErrLimitedConn, pid, DirectConnTimeout, err)
+	}
+	log.Warnf("no direct connection to %s after %s, %s stream falls back to the relay: %v", pid, DirectConnTimeout, kind, err)
+	return h.NewStream(network.WithAllowLimitedConn(ctx, string(protos[0])), pid, protos...)
+}
@@ -0,0 +1,124 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p"
+	noise "github.com/libp2p/go-libp2p/p2p/security/noise"
+	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	webtransport "github.com/libp2p/go-libp2p/p2p/transport/webtransport"
+)
+
+// Transport is a transport a host listens and dials on
+type Transport string
+
+const (
+	TransportTCP          Transport = "tcp"
+	TransportQUIC         Transport = "quic"
+	TransportWebTransport Transport = "webtransport"
+	TransportWebSocket    Transport = "ws"
+)
+
+// AllTransports is every transport we support, in the order they are listened on
+var AllTransports = []Transport{TransportTCP, TransportQUIC, TransportWebTransport, TransportWebSocket}
+
+// Security is a security protocol for TCP and WebSocket connections,
+// QUIC and WebTransport always bring their own TLS
+type Security string
+
+const (
+	SecurityNoise Security = "noise"
+	SecurityTLS   Security = "tls"
+)
+
+// AllSecurity is every security protocol we support, noise preferred
+var AllSecurity = []Security{SecurityNoise, SecurityTLS}
+
+// ParseTransports reads a comma separated list of transport names
+func ParseTransports(s string) ([]Transport, error) {
+	var out []Transport
+	for _, name := range splitNames(s) {
+		t := Transport(name)
+		switch t {
+		case TransportTCP, TransportQUIC, TransportWebTransport, TransportWebSocket:
+			out = append(out, t)
+		default:
+			return nil, fmt.Errorf("unknown transport %q, want one of %v", name, AllTransports)
+		}
+	}
+	return out, nil
+}
+
+// ParseSecurity reads a comma separated list of security protocols, most preferred first
+func ParseSecurity(s string) ([]Security, error) {
+	var out []Security
+	for _, name := range splitNames(s) {
+		sec := Security(name)
+		switch sec {
+		case SecurityNoise, SecurityTLS:
+			out = append(out, sec)
+		default:
+			return nil, fmt.Errorf("unknown security protocol %q, want one of %v", name, AllSecurity)
+		}
+	}
+	return out, nil
+}
+
+func splitNames(s string) []string {
+	var out []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func (t Transport) option() libp2p.Option {
+	switch t {
+	case TransportTCP:
+		return libp2p.Transport(tcp.NewTCPTransport)
+	case TransportQUIC:
+		return libp2p.Transport(quic.NewTransport)
+	case TransportWebTransport:
+		return libp2p.Transport(webtransport.New)
+	case TransportWebSocket:
+		return libp2p.Transport(websocket.New)
+	}
+	return nil
+}
+
+// listenAddrs are the addrs t listens on. ipv4 takes the fixed port, ipv6 a random one.
+// WebSocket can't share the tcp port, it takes the next one
+func (t Transport) listenAddrs(port int) []string {
+	wsPort := 0
+	if port != 0 {
+		wsPort = port + 1
+	}
+	switch t {
+	case TransportTCP:
+		return []string{fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port), "/ip6/::/tcp/0"}
+	case TransportQUIC:
+		return []string{fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic-v1", port), "/ip6/::/udp/0/quic-v1"}
+	case TransportWebTransport:
+		// shares the quic port when both are enabled
+		return []string{fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic-v1/webtransport", port), "/ip6/::/udp/0/quic-v1/webtransport"}
+	case TransportWebSocket:
+		return []string{fmt.Sprintf("/ip4/0.0.0.0/tcp/%d/ws", wsPort), "/ip6/::/tcp/0/ws"}
+	}
+	return nil
+}
+
+func (s Security) option() libp2p.Option {
+	switch s {
+	case SecurityNoise:
+		return libp2p.Security(noise.ID, noise.New)
+	case SecurityTLS:
+		return libp2p.Security(libp2ptls.ID, libp2ptls.New)
+	}
+	return nil
+}
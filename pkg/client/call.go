@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// Call bounds one request for callers that can't pass a context.Context, gomobile
+// can't bind those. it times out after the milliseconds it was created with and
+// Cancel aborts it from any thread. a nil *Call neither times out nor can be cancelled
+type Call struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewCall starts a call that times out after timeoutMs milliseconds, never when 0
+func NewCall(timeoutMs int) *Call {
+	c := &Call{}
+	if timeoutMs > 0 {
+		c.ctx, c.cancel = context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+	} else {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+	}
+	return c
+}
+
+// Cancel aborts the requests running with this call, the call can't be used after
+func (c *Call) Cancel() {
+	if c != nil {
+		c.cancel()
+	}
+}
+
+func (c *Call) context() context.Context {
+	if c == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// ConnectCall is Connect bounded by call
+func (c *Client) ConnectCall(call *Call, runner string) error {
+	return c.Connect(call.context(), runner)
+}
+
+// InfoCall is Info bounded by call
+func (c *Client) InfoCall(call *Call, runner string) (*RunnerInfo, error) {
+	return c.Info(call.context(), runner)
+}
+
+// DiagnoseCall is Diagnose bounded by call
+func (c *Client) DiagnoseCall(call *Call) (string, error) {
+	return c.Diagnose(call.context())
+}
+
+// DiscoverCall is Discover bounded by call, DiscoverTimeout applies without a timeout
+func (c *Client) DiscoverCall(call *Call) (*RunnerList, error) {
+	return c.Discover(call.context())
+}
+
+// WatchCall is Watch until call times out or is cancelled
+func (c *Client) WatchCall(call *Call, h RunnerHandler) error {
+	return c.Watch(call.context(), h)
+}
+
+// StartStreamCall is StartStream bounded by call
+func (c *Client) StartStreamCall(call *Call, req *StreamRequest) (*Session, error) {
+	return c.StartStream(call.context(), req)
+}
+
+// AttachSessionCall is AttachSession bounded by call
+func (c *Client) AttachSessionCall(call *Call, req *StreamRequest) (*Session, error) {
+	return c.AttachSession(call.context(), req)
+}
+
+// StatusCall is Status bounded by call
+func (s *Session) StatusCall(call *Call) (*StreamStatus, error) {
+	return s.Status(call.context())
+}
+
+// StopCall is Stop bounded by call
+func (s *Session) StopCall(call *Call) error {
+	return s.Stop(call.context())
+}
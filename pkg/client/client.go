@@ -0,0 +1,448 @@
+// Package client embeds a mnwarm mobile client: it joins the network through the
+// bootstrap peers and a relay, finds runners and starts streams on them.
+//
+// Go callers pass a context.Context to every request. gomobile can't bind those
+// methods, so each has a variant taking a *Call, a millisecond timeout with a
+// Cancel handle. the rest of the exported surface sticks to types gomobile can
+// bind (strings, ints, bools, pointers to structs, interfaces with such methods),
+// so through the Call variants the package can be embedded in iOS and Android apps.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	libp2p "github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+
+	discovery "mnwarm/internal/discovery"
+	"mnwarm/internal/health"
+	"mnwarm/internal/membership"
+	ping "mnwarm/internal/ping"
+	"mnwarm/internal/presence"
+	cmn "mnwarm/internal/shared"
+)
+
+var log = logging.Logger("clientlog")
+
+// how long a single dial or request may take before we give up on a runner
+const requestTimeout = 10 * time.Second
+
+// how often the client asks its bootstrap peers for a newer network manifest
+const manifestInterval = time.Minute
+
+// Config is what a Client needs to join the network
+type Config struct {
+	// Relay is the multiaddr of the relay, /ip4/.../p2p/<relay id>
+	Relay string
+	// Bootstrap is a comma separated list of bootstrap multiaddrs
+	Bootstrap string
+	// BootstrapList and OperatorKey optionally add peers from a signed bootstrap list,
+	// OperatorKey also pins the key of the network manifest the client follows
+	BootstrapList string
+	OperatorKey   string
+	// PrivateKey is a base64 libp2p private key, an ephemeral one is used when empty
+	// and KeyIndex is negative
+	PrivateKey string
+	// KeyIndex picks one of the built in identities when PrivateKey is empty
+	KeyIndex int
+	// Project limits discovery to runners serving it, empty finds runners of any project
+	Project string
+	// ReadyTimeoutMs bounds each startup step, 0 keeps the defaults
+	ReadyTimeoutMs int
+	// HealthAddr serves liveness and readiness probes when set
+	HealthAddr string
+	// Transports and Security are comma separated, empty enables everything.
+	// transports: tcp, quic, webtransport, ws. security: noise, tls
+	Transports string
+	Security   string
+	// SwarmKey is the content of a swarm.key, it joins the private network of that key
+	SwarmKey string
+	// DataDir keeps the peerstore and DHT records across restarts, empty keeps them in memory
+	DataDir string
+	// Reachability is auto, public or private, empty keeps the client private. with
+	// auto the client only reserves on its relay while AutoNAT finds it private
+	Reachability string
+}
+
+// NewConfig returns a config with an ephemeral identity
+func NewConfig() *Config {
+	return &Config{KeyIndex: -1}
+}
+
+func (cfg *Config) identity() (libp2p.Option, error) {
+	if cfg.PrivateKey != "" {
+		b, err := crypto.ConfigDecodeKey(cfg.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("private key error: %w", err)
+		}
+		priv, err := crypto.UnmarshalPrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("private key error: %w", err)
+		}
+		return libp2p.Identity(priv), nil
+	}
+	if cfg.KeyIndex >= 0 {
+		return cmn.GetLibp2pIdentity(cfg.KeyIndex)
+	}
+	return libp2p.RandomIdentity, nil
+}
+
+// Client is a mobile client on the network, it is safe for concurrent use
+type Client struct {
+	cfg    Config
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	host           host.Host
+	dht            *dht.IpfsDHT
+	protocol       *ping.PingProtocol
+	classifier     *cmn.PeerClassifier
+	manifest       *membership.ManifestWatcher
+	runners        *presence.View
+	relayMu        sync.RWMutex
+	relayAddresses []peer.AddrInfo
+
+	store       *cmn.Store
+	diagnostics *cmn.Diagnostics
+	closeOnce   sync.Once
+	stopProbes  func(ctx context.Context) error
+}
+
+// New joins the network and returns once the client can reach runners
+func New(cfg *Config) (*Client, error) {
+	if cfg == nil || cfg.Relay == "" {
+		return nil, errors.New("relay address is required")
+	}
+	relayInfo, err := cmn.ParseRelayAddress(cfg.Relay)
+	if err != nil {
+		return nil, err
+	}
+	nodeOpt, err := cfg.identity()
+	if err != nil {
+		return nil, err
+	}
+	bootstrapPeers, err := cmn.ResolveBootstrapPeers(discovery.SplitList(cfg.Bootstrap), cfg.BootstrapList, cfg.OperatorKey)
+	if err != nil {
+		log.Errorf("error in startup %v", err)
+	}
+	if len(bootstrapPeers) == 0 {
+		return nil, errors.New("no valid bootstrap addrs")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{cfg: *cfg, ctx: ctx, cancel: cancel, diagnostics: cmn.NewDiagnostics()}
+
+	if cfg.DataDir != "" {
+		if c.store, err = cmn.OpenStore(cfg.DataDir); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	c.host, c.dht, err = newHost(ctx, cfg, c.store, c.diagnostics, nodeOpt, relayInfo)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	ready := cmn.DefaultReadinessConfig().WithTimeout(time.Duration(cfg.ReadyTimeoutMs) * time.Millisecond)
+	if cfg.HealthAddr != "" {
+		checker := health.NewChecker()
+		// the client dials through the relay without holding a reservation
+		checker.Add("bootstrap", health.BootstrapCheck(c.host, bootstrapPeers))
+		checker.Add("routing_table", health.RoutingTableCheck(c.dht, ready.MinRoutingPeers))
+		checker.Add("relay_connection", health.RelayConnectionCheck(c.host, relayInfo.ID))
+		if c.stopProbes, err = checker.Serve(cfg.HealthAddr); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if err := c.join(ready, bootstrapPeers, relayInfo); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) join(ready cmn.ReadinessConfig, bootstrapPeers []peer.AddrInfo, relayInfo *peer.AddrInfo) error {
+	if err := cmn.WaitForBootstrap(c.ctx, c.host, bootstrapPeers, ready.BootstrapTimeout); err != nil {
+		return fmt.Errorf("not ready: %w", err)
+	}
+	var learnedRelays []peer.AddrInfo
+	if px, err := membership.Expand(c.ctx, c.host, bootstrapPeers); err != nil {
+		log.Warnf("peer exchange failed, using the configured bootstrap peers: %v", err)
+	} else {
+		bootstrapPeers = px.Bootstraps
+		learnedRelays = px.Relays
+	}
+	cmn.BootstrapDHT(c.ctx, c.dht)
+	if err := cmn.WaitForRoutingTable(c.ctx, c.dht, ready.MinRoutingPeers, ready.RoutingTableTimeout); err != nil {
+		return fmt.Errorf("not ready: %w", err)
+	}
+	if err := cmn.ConnectToRelay(c.ctx, c.host, relayInfo); err != nil {
+		return fmt.Errorf("not ready: %w", err)
+	}
+	relayAddresses, err := cmn.ConstructRelayAddresses(c.host, relayInfo)
+	if err != nil {
+		return err
+	}
+	// we dial through every addr of the relay, not the circuit addrs we listen on
+	c.relayAddresses = []peer.AddrInfo{*relayInfo}
+
+	c.classifier = cmn.NewPeerClassifier(c.host)
+	c.classifier.AddRelays(append(relayAddresses, *relayInfo)...)
+	c.addRelays(learnedRelays)
+	cmn.ProtectInfrastructure(c.host.ConnManager(), append(bootstrapPeers, *relayInfo)...)
+
+	if c.cfg.OperatorKey != "" {
+		operatorKey, err := cmn.DecodeOperatorKey(c.cfg.OperatorKey)
+		if err != nil {
+			return err
+		}
+		c.manifest = membership.NewManifestWatcher(c.host, operatorKey, manifestInterval)
+		c.manifest.OnUpdate(func(m *cmn.Manifest) {
+			relays, err := m.RelayPeers()
+			if err != nil {
+				log.Warnf("manifest relay addrs: %v", err)
+			}
+			c.addRelays(relays)
+		})
+		c.manifest.Start(c.ctx)
+	}
+
+	c.protocol = ping.NewPingProtocol(c.host, make(chan bool))
+	scorer := cmn.NewPeerScorer(c.host.ConnManager())
+	if err := scorer.Watch(c.ctx, c.host); err != nil {
+		return err
+	}
+	c.protocol.SetRPCObserver(scorer)
+
+	ps, err := presence.NewGossipSub(c.ctx, c.host)
+	if err != nil {
+		return err
+	}
+	channel, err := presence.Join(c.host, ps)
+	if err != nil {
+		return err
+	}
+	if c.runners, err = channel.Watch(c.ctx, 3*presence.DefaultInterval); err != nil {
+		return err
+	}
+	return nil
+}
+
+// addRelays keeps relays learned after startup as fallback paths after our own relay
+func (c *Client) addRelays(relays []peer.AddrInfo) {
+	c.relayMu.Lock()
+	defer c.relayMu.Unlock()
+	for _, r := range relays {
+		if cmn.ContainsPeer(c.relayAddresses, r.ID) {
+			continue
+		}
+		c.host.Peerstore().AddAddrs(r.ID, r.Addrs, peerstore.AddressTTL)
+		c.relayAddresses = append(c.relayAddresses, r)
+		c.classifier.AddRelays(r)
+	}
+}
+
+func (c *Client) relays() []peer.AddrInfo {
+	c.relayMu.RLock()
+	defer c.relayMu.RUnlock()
+	return append([]peer.AddrInfo{}, c.relayAddresses...)
+}
+
+// ID is our peer id
+func (c *Client) ID() string {
+	return c.host.ID().String()
+}
+
+// ManifestVersion is the network manifest in use, 0 without one
+func (c *Client) ManifestVersion() int {
+	if c.manifest == nil {
+		return 0
+	}
+	if m := c.manifest.Current(); m != nil {
+		return int(m.Version)
+	}
+	return 0
+}
+
+// Diagnose reports our NAT traversal as a JSON cmn.NATReport: the addrs peers see us
+// on, AutoNAT v2 checks of our addrs, the NAT mapping behavior, port mappings, our
+// relays and the recent hole punch attempts. the checks may take a few seconds
+func (c *Client) Diagnose(ctx context.Context) (string, error) {
+	report, err := c.diagnostics.Report(ctx, c.relays()...)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// HolePunchStats reports as JSON how our hole punches with runners went, per runner
+// and per NAT type, see cmn.HolePunchSummary
+func (c *Client) HolePunchStats() (string, error) {
+	b, err := json.Marshal(c.diagnostics.HolePunchStats())
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Close leaves the network. streams started by this client keep running on their
+// runners until stopped, call Session.Stop first to end them
+func (c *Client) Close() error {
+	var errs []error
+	c.closeOnce.Do(func() {
+		c.cancel()
+		if c.stopProbes != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			errs = append(errs, c.stopProbes(ctx))
+			cancel()
+		}
+		if c.dht != nil {
+			if c.store != nil {
+				errs = append(errs, c.store.SaveRoutingTable(context.Background(), c.dht))
+			}
+			errs = append(errs, c.dht.Close())
+		}
+		if c.host != nil {
+			errs = append(errs, c.host.Close())
+		}
+		if c.store != nil {
+			errs = append(errs, c.store.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// parsePeer accepts a bare peer ID or a full /p2p/ multiaddr
+func parsePeer(s string) (peer.AddrInfo, error) {
+	if strings.HasPrefix(s, "/") {
+		info, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			return peer.AddrInfo{}, fmt.Errorf("bad peer address '%s': %w", s, err)
+		}
+		return *info, nil
+	}
+	pid, err := peer.Decode(s)
+	if err != nil {
+		return peer.AddrInfo{}, fmt.Errorf("bad peer id '%s': %w", s, err)
+	}
+	return peer.AddrInfo{ID: pid}, nil
+}
+
+// Connect dials a runner given by peer id or multiaddr, directly first and through
+// our relays otherwise. a runner without addresses is looked up in the DHT
+func (c *Client) Connect(ctx context.Context, runner string) error {
+	p, err := parsePeer(runner)
+	if err != nil {
+		return err
+	}
+	return c.connect(ctx, p)
+}
+
+func (c *Client) connect(ctx context.Context, p peer.AddrInfo) error {
+	if c.host.Network().Connectedness(p.ID) == network.Connected {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	if len(p.Addrs) == 0 {
+		if found, err := c.dht.FindPeer(ctx, p.ID); err == nil {
+			p = found
+		} else {
+			log.Infof("could not find addrs of %s in the dht: %v", p.ID, err)
+		}
+	}
+
+	var errs []error
+	if len(p.Addrs) > 0 {
+		err := c.host.Connect(ctx, p)
+		if err == nil {
+			log.Infof("connected to %s", p.ID)
+			return nil
+		}
+		log.Warnf("failed to connect to peer directly %s : %v", p.ID, err)
+		errs = append(errs, err)
+	}
+
+	if _, err := cmn.ConnectViaRelays(ctx, c.host, p.ID, c.relays()...); err != nil {
+		errs = append(errs, err)
+		return fmt.Errorf("could not connect to %s: %w", p.ID, errors.Join(errs...))
+	}
+	return nil
+}
+
+// connectRunner parses and connects to a runner
+func (c *Client) connectRunner(ctx context.Context, runner string) (peer.ID, error) {
+	p, err := parsePeer(runner)
+	if err != nil {
+		return "", err
+	}
+	if err := c.connect(ctx, p); err != nil {
+		return "", err
+	}
+	return p.ID, nil
+}
+
+// RunnerInfo is what a runner reports about itself
+type RunnerInfo struct {
+	ID            string
+	HostID        string
+	PublicIP      string
+	PrivateIP     string
+	IsPublic      bool
+	ClientVersion string
+	Relayed       bool
+	RTTMs         int64
+	// SystemConfig is not visible through gomobile, use Config there
+	SystemConfig map[string]string
+}
+
+// Config returns one system config value the runner advertised
+func (i *RunnerInfo) Config(key string) string {
+	return i.SystemConfig[key]
+}
+
+// Info connects to a runner and asks for its info
+func (c *Client) Info(ctx context.Context, runner string) (*RunnerInfo, error) {
+	pid, err := c.connectRunner(ctx, runner)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, rtt, err := c.protocol.RequestInfo(ctx, pid, c.ID())
+	if err != nil {
+		return nil, err
+	}
+	return &RunnerInfo{
+		ID:            pid.String(),
+		HostID:        resp.HostId,
+		PublicIP:      resp.PublicIp,
+		PrivateIP:     resp.PrivateIp,
+		IsPublic:      resp.IsPublic,
+		ClientVersion: resp.ClientVersion,
+		Relayed:       cmn.IsRelayedPeer(c.host, pid),
+		RTTMs:         rtt.Milliseconds(),
+		SystemConfig:  resp.SystemConfig,
+	}, nil
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestParsePeer(t *testing.T) {
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := parsePeer(pid.String())
+	if err != nil || info.ID != pid || len(info.Addrs) != 0 {
+		t.Errorf("parsePeer(id) = %+v, %v", info, err)
+	}
+
+	info, err = parsePeer("/ip4/127.0.0.1/tcp/4001/p2p/" + pid.String())
+	if err != nil || info.ID != pid || len(info.Addrs) != 1 {
+		t.Errorf("parsePeer(addr) = %+v, %v", info, err)
+	}
+
+	if _, err := parsePeer("not-a-peer"); err == nil {
+		t.Error("expected an error for a bad peer id")
+	}
+}
+
+func TestConfigIdentity(t *testing.T) {
+	cfg := NewConfig()
+	if _, err := cfg.identity(); err != nil {
+		t.Errorf("ephemeral identity error = %v", err)
+	}
+
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.PrivateKey = crypto.ConfigEncodeKey(b)
+	if _, err := cfg.identity(); err != nil {
+		t.Errorf("private key identity error = %v", err)
+	}
+
+	cfg.PrivateKey = "garbage"
+	if _, err := cfg.identity(); err == nil {
+		t.Error("expected an error for a bad private key")
+	}
+}
+
+func TestNewRequiresRelay(t *testing.T) {
+	if _, err := New(NewConfig()); err == nil {
+		t.Error("expected an error without a relay")
+	}
+}
+
+func TestStreamRequestOptions(t *testing.T) {
+	req := NewStreamRequest("p1")
+	req.SetOption("res", "720p")
+	req.SetOption("fps", "30")
+	sreq := req.schedulerRequest()
+	if sreq.ProjectID != "p1" || len(sreq.ConfigOptions) != 2 || sreq.ConfigOptions["res"] != "720p" {
+		t.Errorf("schedulerRequest() = %+v", sreq)
+	}
+}
+
+func TestRunnerList(t *testing.T) {
+	l := &RunnerList{runners: []*Runner{{ID: "a"}, {ID: "b"}}}
+	if l.Len() != 2 || l.Get(1).ID != "b" {
+		t.Errorf("unexpected list %+v", l)
+	}
+	if l.Get(2) != nil || l.Get(-1) != nil {
+		t.Error("out of range Get should return nil")
+	}
+}
+
+func TestCall(t *testing.T) {
+	var none *Call
+	none.Cancel()
+	if err := none.context().Err(); err != nil {
+		t.Errorf("nil call context error = %v", err)
+	}
+
+	call := NewCall(0)
+	if err := call.context().Err(); err != nil {
+		t.Errorf("call without timeout error = %v before Cancel", err)
+	}
+	call.Cancel()
+	if err := call.context().Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled call error = %v, want canceled", err)
+	}
+
+	call = NewCall(10)
+	defer call.Cancel()
+	select {
+	case <-call.context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("call did not time out")
+	}
+	if err := call.context().Err(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("timed out call error = %v, want deadline exceeded", err)
+	}
+}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	disc "github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	"github.com/multiformats/go-multiaddr"
+
+	discovery "mnwarm/internal/discovery"
+	scheduler "mnwarm/internal/scheduler"
+	cmn "mnwarm/internal/shared"
+)
+
+// DiscoverTimeout bounds Discover when the context has no deadline
+const DiscoverTimeout = 10 * time.Second
+
+// Runner is a discovered runner and what it advertised
+type Runner struct {
+	ID string
+	// Projects is comma separated, empty when the runner serves any project
+	Projects  string
+	Region    string
+	Capacity  int
+	Sessions  int
+	Relayed   bool
+	LatencyMs int64
+	Score     float64
+}
+
+func newRunner(c scheduler.Candidate) *Runner {
+	return &Runner{
+		ID:        c.ID.String(),
+		Projects:  strings.Join(c.Attrs.Projects, ","),
+		Region:    c.Attrs.Region,
+		Capacity:  c.Attrs.Capacity,
+		Sessions:  c.Sessions,
+		Relayed:   c.Relayed,
+		LatencyMs: c.Latency.Milliseconds(),
+		Score:     scheduler.Score(c),
+	}
+}
+
+// RunnerList is a list of runners, best first. gomobile can't bind slices of structs
+type RunnerList struct {
+	runners []*Runner
+}
+
+func (l *RunnerList) Len() int {
+	return len(l.runners)
+}
+
+func (l *RunnerList) Get(i int) *Runner {
+	if i < 0 || i >= len(l.runners) {
+		return nil
+	}
+	return l.runners[i]
+}
+
+// Available is the live view of runners serving our project with a free slot, as they
+// announce themselves on the presence channel. unlike Discover it asks no runner anything,
+// it is empty for the first seconds after New until runners have been heard from
+func (c *Client) Available() *RunnerList {
+	list := &RunnerList{}
+	if c.runners == nil {
+		return list
+	}
+	for _, p := range c.runners.Available(c.cfg.Project) {
+		// the announced addrs let Connect skip the DHT lookup
+		for _, s := range p.Addrs {
+			if a, err := multiaddr.NewMultiaddr(s); err == nil {
+				c.host.Peerstore().AddAddr(p.ID, a, peerstore.TempAddrTTL)
+			}
+		}
+		list.runners = append(list.runners, newRunner(scheduler.Candidate{
+			ID:       p.ID,
+			Attrs:    p.Attrs,
+			Sessions: p.Sessions,
+			Relayed:  cmn.IsRelayedPeer(c.host, p.ID),
+			LastSeen: p.Sent,
+		}))
+	}
+	sort.SliceStable(list.runners, func(i, j int) bool { return list.runners[i].Score > list.runners[j].Score })
+	return list
+}
+
+func (c *Client) newScheduler() *scheduler.Scheduler {
+	return scheduler.New(c.host, c.protocol, c.cfg.Project, c.ID(), requestTimeout)
+}
+
+// observeRunners looks runners up once, connects to each and asks for its info
+func (c *Client) observeRunners(ctx context.Context, sched *scheduler.Scheduler) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DiscoverTimeout)
+		defer cancel()
+	}
+
+	found, err := discovery.FindRunners(ctx, drouting.NewRoutingDiscovery(c.dht), c.cfg.Project)
+	if err != nil {
+		return fmt.Errorf("runner lookup error: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	for p := range found {
+		if !c.classifier.IsValidTarget(p.ID) {
+			continue
+		}
+		wg.Add(1)
+		go func(p peer.AddrInfo) {
+			defer wg.Done()
+			if err := c.connect(ctx, p); err != nil {
+				log.Warnf("skipping runner: %v", err)
+				return
+			}
+			if err := sched.Observe(ctx, p.ID); err != nil {
+				log.Warnf("could not collect runner info: %v", err)
+			}
+		}(p)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Discover finds the runners serving our project, the context deadline bounds the
+// lookup and defaults to DiscoverTimeout
+func (c *Client) Discover(ctx context.Context) (*RunnerList, error) {
+	sched := c.newScheduler()
+	if err := c.observeRunners(ctx, sched); err != nil {
+		return nil, err
+	}
+	list := &RunnerList{}
+	for _, cand := range sched.Candidates() {
+		list.runners = append(list.runners, newRunner(cand))
+	}
+	return list, nil
+}
+
+// RunnerHandler is told about runners as they come and go
+type RunnerHandler interface {
+	OnRunner(r *Runner)
+	OnRunnerLost(id string)
+}
+
+// Watch keeps discovering runners and calls h until ctx is done.
+// calls to h come from a single goroutine
+func (c *Client) Watch(ctx context.Context, h RunnerHandler) error {
+	svc := discovery.NewService(c.host, drouting.NewRoutingDiscovery(c.dht),
+		discovery.WithInterval(30*time.Second, 5*time.Second),
+		discovery.WithAdvertise(discovery.ClientNamespace()),
+		discovery.WithFilter(c.classifier.IsValidTarget),
+		discovery.WithLookup(func(ctx context.Context, d disc.Discoverer) (<-chan peer.AddrInfo, error) {
+			return discovery.FindRunners(ctx, d, c.cfg.Project)
+		}),
+	)
+	events := svc.Subscribe()
+	svc.Start(ctx)
+
+	sched := c.newScheduler()
+	for ev := range events {
+		switch ev.Type {
+		case discovery.PeerLost:
+			sched.Forget(ev.Peer.ID)
+			h.OnRunnerLost(ev.Peer.ID.String())
+		case discovery.PeerDiscovered:
+			if err := c.connect(ctx, ev.Peer); err != nil {
+				log.Warnf("skipping runner: %v", err)
+				continue
+			}
+			if err := sched.Observe(ctx, ev.Peer.ID); err != nil {
+				log.Warnf("could not collect runner info: %v", err)
+				continue
+			}
+			for _, cand := range sched.Candidates() {
+				if cand.ID == ev.Peer.ID {
+					h.OnRunner(newRunner(cand))
+				}
+			}
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	cmn "mnwarm/internal/shared"
+)
+
+// newHost creates the client host, a dht client and autorelay on our relay
+func newHost(ctx context.Context, c *Config, store *cmn.Store, diagnostics *cmn.Diagnostics, nodeOpt libp2p.Option, relayInfo *peer.AddrInfo) (host.Host, *dht.IpfsDHT, error) {
+	cfg := cmn.ClientHostConfig(*relayInfo)
+	cfg.Identity = nodeOpt
+	cfg.Store = store
+	cfg.Diagnostics = diagnostics
+	if err := cfg.UseReachability(c.Reachability); err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.UseTransports(c.Transports); err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.UseSecurity(c.Security); err != nil {
+		return nil, nil, err
+	}
+	if c.SwarmKey != "" {
+		psk, err := cmn.ParsePSK(c.SwarmKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := cfg.UsePrivateNetwork(psk); err != nil {
+			return nil, nil, err
+		}
+	}
+	h, kademliaDHT, err := cmn.NewHost(ctx, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, conn network.Conn) {
+			log.Debugf("connected to %s", conn.RemotePeer())
+		},
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			log.Debugf("disconnected from %s", conn.RemotePeer())
+		},
+	})
+	return h, kademliaDHT, nil
+}
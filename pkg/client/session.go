@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	ping "mnwarm/internal/ping"
+	p2p "mnwarm/internal/ping/pb"
+	scheduler "mnwarm/internal/scheduler"
+	cmn "mnwarm/internal/shared"
+)
+
+// StreamRequest describes the stream we want from a runner
+type StreamRequest struct {
+	// Runner is the peer id or multiaddr of the runner, empty lets the client pick one
+	Runner    string
+	ProjectID string
+	DevID     string
+	APIKey    string
+	IssueNeed string
+	options   map[string]string
+}
+
+func NewStreamRequest(projectID string) *StreamRequest {
+	return &StreamRequest{ProjectID: projectID}
+}
+
+// SetOption adds a config option sent to the runner
+func (r *StreamRequest) SetOption(key, value string) {
+	if r.options == nil {
+		r.options = make(map[string]string)
+	}
+	r.options[key] = value
+}
+
+func (r *StreamRequest) schedulerRequest() scheduler.StreamRequest {
+	return scheduler.StreamRequest{
+		ProjectID:     r.ProjectID,
+		DevID:         r.DevID,
+		APIKey:        r.APIKey,
+		IssueNeed:     r.IssueNeed,
+		ConfigOptions: r.options,
+	}
+}
+
+// Session is a stream running on a runner
+type Session struct {
+	client *Client
+	runner peer.ID
+	req    StreamRequest
+	// StatusMessage is what the runner answered when the stream started
+	StatusMessage string
+}
+
+// Runner is the peer id of the runner streaming to us
+func (s *Session) Runner() string {
+	return s.runner.String()
+}
+
+// StartStream starts a stream on req.Runner, or on the best runner found when it is empty
+func (c *Client) StartStream(ctx context.Context, req *StreamRequest) (*Session, error) {
+	if req == nil || req.ProjectID == "" {
+		return nil, errors.New("project id is required")
+	}
+	sreq := req.schedulerRequest()
+
+	var pid peer.ID
+	var resp *p2p.StartStreamResponse
+	if req.Runner != "" {
+		var err error
+		if pid, err = c.connectRunner(ctx, req.Runner); err != nil {
+			return nil, err
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+		resp, err = c.protocol.RequestStartStream(reqCtx, pid, sreq.ProjectID, sreq.DevID, sreq.APIKey, sreq.IssueNeed, sreq.ConfigOptions)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusMessage != ping.StatusSuccess {
+			return nil, fmt.Errorf("runner %s refused the stream: %s", pid, resp.StatusMessage)
+		}
+	} else {
+		sched := c.newScheduler()
+		if err := c.observeRunners(ctx, sched); err != nil {
+			return nil, err
+		}
+		var err error
+		if pid, resp, err = sched.Place(ctx, sreq); err != nil {
+			return nil, err
+		}
+	}
+
+	c.host.ConnManager().Protect(pid, cmn.StreamingTag)
+	return &Session{client: c, runner: pid, req: *req, StatusMessage: resp.StatusMessage}, nil
+}
+
+// AttachSession returns the session of a stream started earlier, for example by
+// another run of the app with the same identity
+func (c *Client) AttachSession(ctx context.Context, req *StreamRequest) (*Session, error) {
+	if req == nil || req.Runner == "" {
+		return nil, errors.New("runner is required")
+	}
+	pid, err := c.connectRunner(ctx, req.Runner)
+	if err != nil {
+		return nil, err
+	}
+	c.host.ConnManager().Protect(pid, cmn.StreamingTag)
+	return &Session{client: c, runner: pid, req: *req}, nil
+}
+
+// StreamStatus is what the runner reports about the stream
+type StreamStatus struct {
+	IsStreaming   bool
+	StatusMessage string
+}
+
+// Status asks the runner about the stream
+func (s *Session) Status(ctx context.Context) (*StreamStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := s.client.protocol.RequestStatus(ctx, s.runner, s.req.ProjectID, s.req.DevID, s.req.APIKey)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamStatus{IsStreaming: resp.IsStreaming, StatusMessage: resp.StatusMessage}, nil
+}
+
+// Stop ends the stream on the runner
+func (s *Session) Stop(ctx context.Context) error {
+	defer s.client.host.ConnManager().Unprotect(s.runner, cmn.StreamingTag)
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	_, err := s.client.protocol.RequestStopStream(ctx, s.runner, s.req.ProjectID, s.req.DevID, s.req.APIKey)
+	return err
+}
+
+// Data opens the stream carrying the session content. it waits up to
+// cmn.DirectConnTimeout for a direct connection to the runner before it goes through
+// the relay, whose limits may cut it short
+func (s *Session) Data(ctx context.Context) (io.ReadCloser, error) {
+	return s.client.protocol.OpenDataStream(ctx, s.runner)
+}
+
+// Relayed is true while the only connection to the runner is a limited relayed one,
+// the relay cuts it after a few minutes or bytes so bulk data should wait for a hole punch
+func (s *Session) Relayed() bool {
+	return cmn.IsLimitedPeer(s.client.host, s.runner)
+}
@@ -0,0 +1,167 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// control API routes, all JSON
+const (
+	ControlStatusPath       = "/v1/status"
+	ControlSessionsPath     = "/v1/sessions"
+	ControlPeersPath        = "/v1/peers"
+	ControlReservationsPath = "/v1/reservations"
+	ControlCapacityPath     = "/v1/capacity"
+	ControlAdvertisePath    = "/v1/advertise"
+	ControlDiagnosePath     = "/v1/diagnose"
+)
+
+// CapacityRequest is the body of PUT /v1/capacity
+type CapacityRequest struct {
+	Capacity int `json:"capacity"`
+}
+
+// controlError is the body of every failed control request
+type controlError struct {
+	Error string `json:"error"`
+}
+
+// ControlHandler serves the local control API:
+//
+//	GET    /v1/status           Status
+//	GET    /v1/sessions         running sessions
+//	DELETE /v1/sessions/{id}    force stop the session of client id
+//	GET    /v1/peers            connections and their transport
+//	GET    /v1/reservations     relay reservations
+//	PUT    /v1/capacity         change the advertised capacity
+//	POST   /v1/advertise        advertise again now
+//	GET    /v1/diagnose         NAT traversal report, see cmn.NATReport
+func (r *Runner) ControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+ControlStatusPath, func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, r.Status())
+	})
+	mux.HandleFunc("GET "+ControlSessionsPath, func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, r.Status().Sessions)
+	})
+	mux.HandleFunc("DELETE "+ControlSessionsPath+"/{id}", func(w http.ResponseWriter, req *http.Request) {
+		if err := r.EndSession(req.Context(), req.PathValue("id")); err != nil {
+			writeJSON(w, http.StatusNotFound, controlError{err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET "+ControlPeersPath, func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, r.Peers())
+	})
+	mux.HandleFunc("GET "+ControlReservationsPath, func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, r.Reservations())
+	})
+	mux.HandleFunc("PUT "+ControlCapacityPath, func(w http.ResponseWriter, req *http.Request) {
+		var body CapacityRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, controlError{fmt.Sprintf("bad request: %v", err)})
+			return
+		}
+		if err := r.SetCapacity(body.Capacity); err != nil {
+			writeJSON(w, http.StatusBadRequest, controlError{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, body)
+	})
+	mux.HandleFunc("POST "+ControlAdvertisePath, func(w http.ResponseWriter, req *http.Request) {
+		r.Readvertise()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("GET "+ControlDiagnosePath, func(w http.ResponseWriter, req *http.Request) {
+		report, err := r.Diagnose(req.Context())
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, controlError{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("could not write control response: %v", err)
+	}
+}
+
+// ServeControl serves the control API on a unix socket only the current user can use,
+// a stale socket left at path is replaced. the returned func stops it
+func (r *Runner) ServeControl(path string) (func(ctx context.Context) error, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, fmt.Errorf("control socket error: %w", err)
+	}
+	ln, err := listenPrivate(path)
+	if err != nil {
+		return nil, fmt.Errorf("control socket error: %w", err)
+	}
+
+	srv := &http.Server{Handler: r.ControlHandler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("control server stopped: %v", err)
+		}
+	}()
+	log.Infof("control API on unix socket %s", path)
+	return func(ctx context.Context) error {
+		err := srv.Shutdown(ctx)
+		return errors.Join(err, removeStaleSocket(path))
+	}, nil
+}
+
+// removeStaleSocket removes the socket at path, anything else there is left alone
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// listenPrivate listens on a unix socket at path with 0600 permissions. the socket is
+// created in a 0700 directory and only then moved to path, so nobody else can connect
+// in between. the umask would do too but it is process wide
+func listenPrivate(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".control-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// the socket won't be at tmp anymore, ServeControl removes it from path
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,123 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestControlHandler(t *testing.T) {
+	r := newTestRunner(t)
+	c := controller{r}
+	if err := c.StartStream(peer.ID("client"), startRequest("p1", nil)); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(r.ControlHandler())
+	defer srv.Close()
+
+	do := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	var sessions []SessionStatus
+	resp := do(http.MethodGet, ControlSessionsPath, "")
+	if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ProjectID != "p1" {
+		t.Errorf("sessions = %+v", sessions)
+	}
+
+	if resp := do(http.MethodPut, ControlCapacityPath, `{"capacity": 3}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("PUT capacity = %s", resp.Status)
+	}
+	if got := r.Status().Capacity; got != 3 {
+		t.Errorf("capacity = %d after PUT, want 3", got)
+	}
+	if resp := do(http.MethodPut, ControlCapacityPath, `{"capacity": 0}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("PUT capacity 0 = %s, want 400", resp.Status)
+	}
+
+	if resp := do(http.MethodDelete, ControlSessionsPath+"/not-a-peer", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("DELETE unknown session = %s, want 404", resp.Status)
+	}
+	if resp := do(http.MethodPost, ControlAdvertisePath, ""); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("POST advertise = %s, want 202", resp.Status)
+	}
+	if resp := do(http.MethodGet, ControlAdvertisePath, ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET advertise = %s, want 405", resp.Status)
+	}
+	if resp := do(http.MethodGet, ControlDiagnosePath, ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("GET diagnose before start = %s, want 503", resp.Status)
+	}
+}
+
+func TestServeControlSocket(t *testing.T) {
+	r := newTestRunner(t)
+	dir := t.TempDir()
+
+	// whatever else is at the path is not ours to delete
+	notASocket := filepath.Join(dir, "runner.conf")
+	if err := os.WriteFile(notASocket, []byte("keep me"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ServeControl(notASocket); err == nil {
+		t.Error("ServeControl() replaced a regular file")
+	}
+	if b, err := os.ReadFile(notASocket); err != nil || string(b) != "keep me" {
+		t.Errorf("regular file = %q, %v after ServeControl", b, err)
+	}
+
+	path := filepath.Join(dir, "control.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	stop, err := r.ServeControl(path)
+	if err != nil {
+		t.Fatalf("ServeControl() error = %v", err)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Type() != os.ModeSocket || fi.Mode().Perm() != 0o600 {
+		t.Errorf("control socket mode = %s, want a 0600 socket", fi.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("ServeControl() left %d entries in %s, want the file and the socket", len(entries), dir)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("could not connect to the control socket: %v", err)
+	}
+	conn.Close()
+
+	if err := stop(context.Background()); err != nil {
+		t.Errorf("stop error = %v", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("control socket still at %s after stop", path)
+	}
+}
@@ -0,0 +1,58 @@
+package runner
+
+import (
+	"context"
+	"strings"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	ma "github.com/multiformats/go-multiaddr"
+
+	cmn "mnwarm/internal/shared"
+)
+
+// newHost creates the runner host and a dht client. we reserve on our relays ourselves
+// instead of through autorelay, addrs advertises the circuit addrs of the relay we hold
+// a reservation on, whichever relay that is after a failover
+func newHost(ctx context.Context, c *Config, store *cmn.Store, diagnostics *cmn.Diagnostics, nodeOpt libp2p.Option, addrs func([]ma.Multiaddr) []ma.Multiaddr) (host.Host, *dht.IpfsDHT, error) {
+	cfg := cmn.RunnerHostConfig()
+	cfg.AddrsFactory = addrs
+	cfg.Identity = nodeOpt
+	cfg.Store = store
+	cfg.Diagnostics = diagnostics
+	cfg.RelayService = c.RelayService
+	if err := cfg.UseReachability(c.Reachability); err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.UseTransports(strings.Join(c.Transports, ",")); err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.UseSecurity(strings.Join(c.Security, ",")); err != nil {
+		return nil, nil, err
+	}
+	if c.SwarmKey != "" {
+		psk, err := cmn.ParsePSK(c.SwarmKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := cfg.UsePrivateNetwork(psk); err != nil {
+			return nil, nil, err
+		}
+	}
+	h, kademliaDHT, err := cmn.NewHost(ctx, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, conn network.Conn) {
+			log.Debugf("connected to %s", conn.RemotePeer())
+		},
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			log.Debugf("disconnected from %s", conn.RemotePeer())
+		},
+	})
+	return h, kademliaDHT, nil
+}
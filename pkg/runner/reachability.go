@@ -0,0 +1,76 @@
+package runner
+
+import (
+	"github.com/libp2p/go-libp2p/core/network"
+
+	"mnwarm/internal/health"
+	cmn "mnwarm/internal/shared"
+)
+
+// adaptive is true when AutoNAT decides whether we need a relay, see Config.Reachability
+func (r *Runner) adaptive() bool {
+	return r.cfg.Reachability == cmn.ReachabilityAuto
+}
+
+// Public is true while we are publicly reachable and advertise our direct addrs
+// instead of holding a relay reservation
+func (r *Runner) Public() bool {
+	return r.public.Load()
+}
+
+// onReachability follows AutoNAT: a public runner lets its reservation lapse and is
+// dialed directly, a runner that loses public reachability goes back to a relay.
+// hostAddrs swaps the circuit addrs in and out of our addrs
+func (r *Runner) onReachability(reachability network.Reachability) {
+	switch reachability {
+	case network.ReachabilityPublic:
+		if r.public.Swap(true) {
+			return
+		}
+		log.Infof("publicly reachable, advertising our direct addrs without a relay")
+		r.dropReservation()
+		r.Readvertise()
+	case network.ReachabilityPrivate:
+		if !r.public.Swap(false) {
+			return
+		}
+		log.Infof("not publicly reachable anymore, going back to a relay")
+		if r.failingOver.CompareAndSwap(false, true) {
+			go r.regainReservation()
+		}
+	}
+}
+
+// dropReservation stops renewing our reservation, the relay lets it expire
+func (r *Runner) dropReservation() {
+	r.relayMu.Lock()
+	stop := r.stopKeeper
+	r.stopKeeper = nil
+	r.keeper.Store(nil)
+	r.relayMu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// regainReservation reserves on our relay or one of the spares after we were public
+func (r *Runner) regainReservation() {
+	defer r.failingOver.Store(false)
+	candidates := r.relayCandidates("")
+	if relay, ok := r.reserveOnAny(candidates); ok {
+		log.Infof("reserved on relay %s", relay)
+		return
+	}
+	log.Warnf("none of %d relays granted a reservation, clients can't reach us", len(candidates))
+}
+
+// reservationCheck is the relay reservation readiness check, a public runner needs none
+func (r *Runner) reservationCheck() health.Check {
+	check := health.ReservationCheck(r.host, r.reservation)
+	return func() error {
+		if r.Public() {
+			return nil
+		}
+		return check()
+	}
+}
@@ -0,0 +1,124 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	relay "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+
+	cmn "mnwarm/internal/shared"
+)
+
+func TestReachabilityAdaptation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	relayHost, runnerHost := mn.Hosts()[0], mn.Hosts()[1]
+	if _, err := relay.New(relayHost); err != nil {
+		t.Fatal(err)
+	}
+	relayInfo := peer.AddrInfo{ID: relayHost.ID(), Addrs: relayHost.Addrs()}
+
+	r := newTestRunner(t)
+	defer r.cancel()
+	r.cfg.Reachability = cmn.ReachabilityAuto
+	r.host = runnerHost
+	r.relayInfo = &relayInfo
+	r.classifier = cmn.NewPeerClassifier(runnerHost)
+	rsvp, err := cmn.ReserveRelay(ctx, runnerHost, &relayInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.keepReservation(relayInfo, rsvp); err != nil {
+		t.Fatal(err)
+	}
+	check := r.reservationCheck()
+
+	r.onReachability(network.ReachabilityPublic)
+	if !r.Public() || !r.Status().Public {
+		t.Error("runner not public after AutoNAT found it public")
+	}
+	if _, rsvp := r.reservation(); rsvp != nil {
+		t.Error("public runner still keeps its reservation")
+	}
+	if err := check(); err != nil {
+		t.Errorf("reservation check of a public runner = %v", err)
+	}
+
+	r.onReachability(network.ReachabilityPrivate)
+	if r.Public() {
+		t.Error("runner still public after AutoNAT found it private")
+	}
+	for {
+		if _, rsvp := r.reservation(); rsvp != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("no reservation after losing public reachability")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	if err := check(); err != nil {
+		t.Errorf("reservation check after going back to the relay = %v", err)
+	}
+}
+
+func TestStartForcedPublic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	bootCfg := cmn.BootstrapHostConfig(0)
+	bootCfg.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+	boot, bootDHT, err := cmn.NewHost(ctx, bootCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boot.Close()
+	defer bootDHT.Close()
+
+	// nothing listens on the relay, a public runner must not need it
+	relayKey, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayID, err := peer.IDFromPrivateKey(relayKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := NewConfig()
+	cfg.Relay = "/ip4/127.0.0.1/tcp/1/p2p/" + relayID.String()
+	cfg.Bootstrap = []string{fmt.Sprintf("%s/p2p/%s", boot.Addrs()[0], boot.ID())}
+	cfg.Transports = []string{"tcp"}
+	cfg.Reachability = cmn.ReachabilityPublic
+	cfg.ReadyTimeout = 5 * time.Second
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop(context.Background())
+
+	if err := r.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if !r.Public() || !r.Status().Public {
+		t.Error("runner forced public doesn't report itself public")
+	}
+	if _, rsvp := r.reservation(); rsvp != nil {
+		t.Error("runner forced public holds a relay reservation")
+	}
+	if err := r.reservationCheck()(); err != nil {
+		t.Errorf("reservation check of a runner forced public = %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package runner
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+
+	cmn "mnwarm/internal/shared"
+)
+
+// how long we wait for each other relay when ours drops or refuses our reservation
+const failoverTimeout = 15 * time.Second
+
+// reservation is the relay we hold a reservation on and the reservation, nil without one
+func (r *Runner) reservation() (peer.ID, *client.Reservation) {
+	k := r.keeper.Load()
+	if k == nil {
+		return "", nil
+	}
+	return k.Relay().ID, k.Current()
+}
+
+// keepReservation renews rsvp on relay from now on, replacing the reservation we kept before
+func (r *Runner) keepReservation(relay peer.AddrInfo, rsvp *client.Reservation) error {
+	k := cmn.NewReservationKeeper(r.host, relay)
+	k.OnEvent(r.onReservationEvent)
+	ctx, cancel := context.WithCancel(r.ctx)
+	if err := k.Keep(ctx, rsvp); err != nil {
+		cancel()
+		return err
+	}
+
+	r.relayMu.Lock()
+	stop := r.stopKeeper
+	r.stopKeeper = cancel
+	r.keeper.Store(k)
+	r.relayMu.Unlock()
+	if stop != nil {
+		stop()
+	}
+	return nil
+}
+
+// addSpareRelays remembers relays learned from peer exchange and the manifest,
+// we move our reservation to one of them when our relay fails us
+func (r *Runner) addSpareRelays(relays ...peer.AddrInfo) {
+	r.relayMu.Lock()
+	defer r.relayMu.Unlock()
+	for _, relay := range relays {
+		known := relay.ID == r.host.ID()
+		for _, spare := range r.spareRelays {
+			known = known || spare.ID == relay.ID
+		}
+		if !known {
+			r.spareRelays = append(r.spareRelays, relay)
+		}
+	}
+}
+
+// relayCandidates are the configured relay and the spare relays except exclude
+func (r *Runner) relayCandidates(exclude peer.ID) []peer.AddrInfo {
+	r.relayMu.Lock()
+	defer r.relayMu.Unlock()
+	var out []peer.AddrInfo
+	for _, relay := range append([]peer.AddrInfo{*r.relayInfo}, r.spareRelays...) {
+		if relay.ID != exclude {
+			out = append(out, relay)
+		}
+	}
+	return out
+}
+
+func (r *Runner) onReservationEvent(ev cmn.ReservationEvent) {
+	if ev.Type == cmn.ReservationRenewed {
+		return
+	}
+	if k := r.keeper.Load(); k == nil || k.Relay().ID != ev.Relay {
+		return
+	}
+	if r.failingOver.CompareAndSwap(false, true) {
+		go r.failover(ev.Relay)
+	}
+}
+
+// failover reserves on another relay while the current one keeps retrying, the
+// first relay to grant a reservation becomes ours
+func (r *Runner) failover(from peer.ID) {
+	defer r.failingOver.Store(false)
+
+	candidates := r.relayCandidates(from)
+	if len(candidates) == 0 {
+		log.Warnf("relay %s failed our reservation and we know no other relay", from)
+		return
+	}
+	if relay, ok := r.reserveOnAny(candidates); ok {
+		log.Infof("moved relay reservation from %s to %s", from, relay)
+		return
+	}
+	log.Warnf("none of %d other relays granted a reservation, still retrying %s", len(candidates), from)
+}
+
+// reserveOnAny keeps a reservation on the first of candidates to grant one and
+// advertises our circuit addrs through it. it gives up when we hold a reservation again or
+// became publicly reachable
+func (r *Runner) reserveOnAny(candidates []peer.AddrInfo) (peer.ID, bool) {
+	for _, relay := range candidates {
+		if _, rsvp := r.reservation(); rsvp != nil || r.Public() {
+			return "", false
+		}
+		ctx, cancel := context.WithTimeout(r.ctx, failoverTimeout)
+		rsvp, err := cmn.ReserveRelay(ctx, r.host, &relay)
+		cancel()
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return "", false
+			}
+			continue
+		}
+
+		r.classifier.AddRelays(relay)
+		cmn.ProtectInfrastructure(r.host.ConnManager(), relay)
+		if err := r.keepReservation(relay, rsvp); err != nil {
+			log.Errorf("could not keep reservation on relay %s: %v", relay.ID, err)
+			continue
+		}
+		r.Readvertise()
+		return relay.ID, true
+	}
+	return "", false
+}
+
+// hostAddrs is the addrs factory of our host. unless we are public it adds our circuit
+// addrs through the relay we hold a reservation on and, as autorelay would, drops the
+// public addrs a runner forced private can't be dialed on
+func (r *Runner) hostAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if r.Public() {
+		return addrs
+	}
+	out := make([]ma.Multiaddr, 0, len(addrs)+4)
+	for _, a := range addrs {
+		// AutoNAT tests our public addrs through this factory, keep them while it decides
+		if r.adaptive() || manet.IsPrivateAddr(a) {
+			out = append(out, a)
+		}
+	}
+	k := r.keeper.Load()
+	if k == nil || k.Current() == nil {
+		return out
+	}
+	relay := k.Relay()
+	if len(relay.Addrs) == 0 {
+		relay.Addrs = r.host.Peerstore().Addrs(relay.ID)
+	}
+	relayed, err := cmn.RelayedAddrs(relay)
+	if err != nil {
+		log.Warnf("no circuit addrs through relay %s: %v", relay.ID, err)
+		return out
+	}
+	return append(out, relayed...)
+}
@@ -0,0 +1,91 @@
+package runner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	cmn "mnwarm/internal/shared"
+)
+
+func newRelayHost(t *testing.T, ctx context.Context) host.Host {
+	t.Helper()
+	cfg := cmn.RelayHostConfig(0)
+	cfg.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+	h, d, err := cmn.NewHost(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+		h.Close()
+	})
+	return h
+}
+
+// relayedThrough is true when addrs hold a circuit addr through relay
+func relayedThrough(addrs []ma.Multiaddr, relay peer.ID) bool {
+	for _, a := range addrs {
+		if !cmn.IsCircuitAddr(a) {
+			continue
+		}
+		if id, err := a.ValueForProtocol(ma.P_P2P); err == nil && id == relay.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFailoverAdvertisesNewRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	ours, spare := newRelayHost(t, ctx), newRelayHost(t, ctx)
+	oursInfo := peer.AddrInfo{ID: ours.ID(), Addrs: ours.Addrs()}
+	spareInfo := peer.AddrInfo{ID: spare.ID(), Addrs: spare.Addrs()}
+
+	r := newTestRunner(t)
+	defer r.cancel()
+	hostCfg := cmn.RunnerHostConfig()
+	hostCfg.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+	hostCfg.AddrsFactory = r.hostAddrs
+	h, d, err := cmn.NewHost(ctx, hostCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	defer d.Close()
+	r.host = h
+	r.relayInfo = &oursInfo
+	r.classifier = cmn.NewPeerClassifier(h)
+	r.addSpareRelays(spareInfo)
+
+	rsvp, err := cmn.ReserveRelay(ctx, h, &oursInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.keepReservation(oursInfo, rsvp); err != nil {
+		t.Fatal(err)
+	}
+	if !relayedThrough(h.Addrs(), ours.ID()) {
+		t.Fatalf("Addrs() = %v, want a circuit addr through our relay", h.Addrs())
+	}
+
+	if err := ours.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for !relayedThrough(h.Addrs(), spare.ID()) {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Addrs() = %v, want a circuit addr through the spare relay", h.Addrs())
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	if relayedThrough(h.Addrs(), ours.ID()) {
+		t.Errorf("Addrs() = %v still holds circuit addrs through the relay we lost", h.Addrs())
+	}
+}
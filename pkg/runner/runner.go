@@ -0,0 +1,697 @@
+// Package runner embeds a mnwarm node runner: it joins the network, holds a relay
+// reservation, advertises itself to clients and serves their streams from
+// registered sources.
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	libp2p "github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+
+	discovery "mnwarm/internal/discovery"
+	"mnwarm/internal/health"
+	"mnwarm/internal/membership"
+	ping "mnwarm/internal/ping"
+	p2p "mnwarm/internal/ping/pb"
+	"mnwarm/internal/presence"
+	cmn "mnwarm/internal/shared"
+)
+
+var log = logging.Logger("runnerlog")
+
+// how often the runner asks its bootstrap peers for a newer network manifest
+const manifestInterval = time.Minute
+
+// Config is what a Runner needs to join the network
+type Config struct {
+	// Relay is the multiaddr of the relay we hold a reservation on
+	Relay string
+	// Bootstrap are bootstrap multiaddrs, BootstrapList and OperatorKey optionally
+	// add peers from a signed bootstrap list. OperatorKey also pins the key of the
+	// network manifest the runner follows
+	Bootstrap     []string
+	BootstrapList string
+	OperatorKey   string
+	// PrivateKey is a base64 libp2p private key, when empty KeyIndex picks a built in
+	// identity and a negative KeyIndex an ephemeral one
+	PrivateKey string
+	KeyIndex   int
+	// Projects, Region and Capacity are advertised to clients, no projects serves all
+	Projects []string
+	Region   string
+	Capacity int
+	// ReadyTimeout bounds each startup step, 0 keeps the defaults
+	ReadyTimeout time.Duration
+	// HealthAddr serves liveness and readiness probes when set
+	HealthAddr string
+	// Transports (tcp, quic, webtransport, ws) and Security (noise, tls), empty enables all
+	Transports []string
+	Security   []string
+	// SwarmKey is the content of a swarm.key, it joins the private network of that key
+	SwarmKey string
+	// DataDir keeps the peerstore and DHT records across restarts, empty keeps them in memory
+	DataDir string
+	// ControlSocket serves the local control API on this unix socket when set
+	ControlSocket string
+	// Reachability is auto, public or private, empty keeps the runner private behind
+	// its relay. with auto a runner AutoNAT finds public is dialed directly and goes
+	// back to a relay once it isn't anymore
+	Reachability string
+	// RelayService relays circuits for others while we are publicly reachable
+	RelayService bool
+}
+
+// NewConfig returns a config with an ephemeral identity and room for one session
+func NewConfig() Config {
+	return Config{KeyIndex: -1, Capacity: 1}
+}
+
+func (cfg *Config) identity() (libp2p.Option, error) {
+	if cfg.PrivateKey != "" {
+		b, err := crypto.ConfigDecodeKey(cfg.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("private key error: %w", err)
+		}
+		priv, err := crypto.UnmarshalPrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("private key error: %w", err)
+		}
+		return libp2p.Identity(priv), nil
+	}
+	if cfg.KeyIndex >= 0 {
+		return cmn.GetLibp2pIdentity(cfg.KeyIndex)
+	}
+	return libp2p.RandomIdentity, nil
+}
+
+// activeSession is a session with the source serving it
+type activeSession struct {
+	session *Session
+	source  Source
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// Runner is a node runner on the network, it is safe for concurrent use
+type Runner struct {
+	cfg     Config
+	sources sources
+
+	mu       sync.Mutex
+	attrs    discovery.RunnerAttrs
+	onStart  []func(*Session) error
+	onStop   []func(*Session)
+	sessions map[peer.ID]*activeSession
+	started  bool
+	stopped  bool
+
+	ctx         context.Context
+	cancel      context.CancelFunc
+	host        host.Host
+	dht         *dht.IpfsDHT
+	protocol    *ping.PingProtocol
+	relayInfo   *peer.AddrInfo
+	classifier  *cmn.PeerClassifier
+	store       *cmn.Store
+	diagnostics *cmn.Diagnostics
+	keeper      atomic.Pointer[cmn.ReservationKeeper]
+	stopKeeper  context.CancelFunc
+	relayMu     sync.Mutex
+	spareRelays []peer.AddrInfo
+	failingOver atomic.Bool
+	public      atomic.Bool
+	announcer   *discovery.Service
+	manifest    *membership.ManifestWatcher
+	presence    *presence.Channel
+	publisher   *presence.Publisher
+	stopProbes  func(ctx context.Context) error
+	stopControl func(ctx context.Context) error
+}
+
+func New(cfg Config) (*Runner, error) {
+	if cfg.Relay == "" {
+		return nil, errors.New("relay address is required")
+	}
+	if cfg.Capacity <= 0 {
+		cfg.Capacity = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Runner{
+		cfg:    cfg,
+		ctx:    ctx,
+		cancel: cancel,
+		attrs: discovery.RunnerAttrs{
+			Projects: cfg.Projects,
+			Region:   cfg.Region,
+			Capacity: cfg.Capacity,
+		},
+		sessions: make(map[peer.ID]*activeSession),
+	}, nil
+}
+
+// OnStartStream registers a callback run before a session is accepted,
+// an error rejects the session. register callbacks before Start
+func (r *Runner) OnStartStream(fn func(*Session) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onStart = append(r.onStart, fn)
+}
+
+// OnStopStream registers a callback run once a session ended
+func (r *Runner) OnStopStream(fn func(*Session)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onStop = append(r.onStop, fn)
+}
+
+// RegisterSource adds a named stream source. clients pick one with the "source"
+// config option, the first registered source serves everybody else
+func (r *Runner) RegisterSource(name string, src Source) error {
+	return r.sources.register(name, src)
+}
+
+// Sources are the names of the registered sources
+func (r *Runner) Sources() []string {
+	return r.sources.names()
+}
+
+// Host is the libp2p host, nil before Start. services may add their own protocols to it
+func (r *Runner) Host() host.Host {
+	return r.host
+}
+
+// Start joins the network and returns once clients can reach us: bootstrap and DHT
+// are up, the relay reservation is held and we advertise ourselves. a runner with
+// public reachability skips the relay. ctx bounds startup
+func (r *Runner) Start(ctx context.Context) error {
+	r.mu.Lock()
+	if r.started {
+		r.mu.Unlock()
+		return errors.New("runner already started")
+	}
+	r.started = true
+	r.mu.Unlock()
+
+	relayInfo, err := cmn.ParseRelayAddress(r.cfg.Relay)
+	if err != nil {
+		return err
+	}
+	r.relayInfo = relayInfo
+	nodeOpt, err := r.cfg.identity()
+	if err != nil {
+		return err
+	}
+	bootstrapPeers, err := cmn.ResolveBootstrapPeers(r.cfg.Bootstrap, r.cfg.BootstrapList, r.cfg.OperatorKey)
+	if err != nil {
+		log.Errorf("error in startup %v", err)
+	}
+	if len(bootstrapPeers) == 0 {
+		return errors.New("no valid bootstrap addrs")
+	}
+
+	if r.cfg.DataDir != "" {
+		if r.store, err = cmn.OpenStore(r.cfg.DataDir); err != nil {
+			return err
+		}
+	}
+	r.diagnostics = cmn.NewDiagnostics()
+	r.host, r.dht, err = newHost(r.ctx, &r.cfg, r.store, r.diagnostics, nodeOpt, r.hostAddrs)
+	if err != nil {
+		return err
+	}
+
+	ready := cmn.DefaultReadinessConfig().WithTimeout(r.cfg.ReadyTimeout)
+	if r.cfg.HealthAddr != "" {
+		checker := health.NewChecker()
+		checker.Add("bootstrap", health.BootstrapCheck(r.host, bootstrapPeers))
+		checker.Add("routing_table", health.RoutingTableCheck(r.dht, ready.MinRoutingPeers))
+		checker.Add("relay_reservation", r.reservationCheck())
+		if r.stopProbes, err = checker.Serve(r.cfg.HealthAddr); err != nil {
+			return err
+		}
+	}
+
+	if err := cmn.WaitForBootstrap(ctx, r.host, bootstrapPeers, ready.BootstrapTimeout); err != nil {
+		return fmt.Errorf("not ready: %w", err)
+	}
+	var learnedRelays []peer.AddrInfo
+	if px, err := membership.Expand(ctx, r.host, bootstrapPeers); err != nil {
+		log.Warnf("peer exchange failed, using the configured bootstrap peers: %v", err)
+	} else {
+		bootstrapPeers = px.Bootstraps
+		learnedRelays = px.Relays
+	}
+	cmn.BootstrapDHT(r.ctx, r.dht)
+	if err := cmn.WaitForRoutingTable(ctx, r.dht, ready.MinRoutingPeers, ready.RoutingTableTimeout); err != nil {
+		return fmt.Errorf("not ready: %w", err)
+	}
+	// a runner forced public is dialed directly and never needs its relay
+	r.public.Store(r.cfg.Reachability == cmn.ReachabilityPublic)
+	if !r.Public() {
+		if err := cmn.ConnectToRelay(ctx, r.host, relayInfo); err != nil {
+			return fmt.Errorf("not ready: %w", err)
+		}
+	}
+	relayAddresses, err := cmn.ConstructRelayAddresses(r.host, relayInfo)
+	if err != nil {
+		return err
+	}
+
+	r.classifier = cmn.NewPeerClassifier(r.host)
+	r.classifier.AddRelays(append(relayAddresses, *relayInfo)...)
+	r.classifier.AddRelays(learnedRelays...)
+	r.addSpareRelays(learnedRelays...)
+	cmn.ProtectInfrastructure(r.host.ConnManager(), append(bootstrapPeers, *relayInfo)...)
+
+	if !r.Public() {
+		rsvp, err := cmn.WaitForReservation(ctx, r.host, relayInfo, ready.ReservationTimeout)
+		if err != nil {
+			return fmt.Errorf("not ready: %w", err)
+		}
+		if err := r.keepReservation(*relayInfo, rsvp); err != nil {
+			return err
+		}
+		if err := cmn.WaitForRelayAddrs(ctx, r.host, ready.RelayAddrsTimeout); err != nil {
+			return fmt.Errorf("not ready: %w", err)
+		}
+	}
+
+	r.protocol = ping.NewPingProtocol(r.host, make(chan bool))
+	r.protocol.SetSystemConfig(r.attrs.SystemConfig())
+	r.protocol.AddSystemConfigSource(func() map[string]string {
+		return r.diagnostics.HolePunchStats().Total.SystemConfig()
+	})
+	r.protocol.SetCapacity(r.attrs.Capacity)
+	scorer := cmn.NewPeerScorer(r.host.ConnManager())
+	if err := scorer.Watch(r.ctx, r.host); err != nil {
+		return err
+	}
+	r.protocol.SetRPCObserver(scorer)
+	r.protocol.SetStreamController(controller{r})
+	r.protocol.SetDataHandler(r.serveData)
+
+	r.announcer = discovery.NewService(r.host, drouting.NewRoutingDiscovery(r.dht),
+		discovery.WithInterval(30*time.Second, 5*time.Second),
+		discovery.WithAdvertise(r.attrs.Namespaces()...),
+	)
+	r.announcer.Start(r.ctx)
+
+	ps, err := presence.NewGossipSub(r.ctx, r.host)
+	if err != nil {
+		return err
+	}
+	if r.presence, err = presence.Join(r.host, ps); err != nil {
+		return err
+	}
+	r.publisher = r.presence.StartPublishing(r.ctx, presence.DefaultInterval, r.presenceState)
+
+	if r.cfg.OperatorKey != "" {
+		operatorKey, err := cmn.DecodeOperatorKey(r.cfg.OperatorKey)
+		if err != nil {
+			return err
+		}
+		r.manifest = membership.NewManifestWatcher(r.host, operatorKey, manifestInterval)
+		r.manifest.OnUpdate(func(m *cmn.Manifest) {
+			relays, err := m.RelayPeers()
+			if err != nil {
+				log.Warnf("manifest relay addrs: %v", err)
+			}
+			r.classifier.AddRelays(relays...)
+			r.addSpareRelays(relays...)
+		})
+		r.manifest.Start(r.ctx)
+	}
+	if r.adaptive() {
+		if err := cmn.WatchReachability(r.ctx, r.host, r.onReachability); err != nil {
+			return err
+		}
+	}
+	if r.cfg.ControlSocket != "" {
+		if r.stopControl, err = r.ServeControl(r.cfg.ControlSocket); err != nil {
+			return err
+		}
+	}
+	log.Infof("runner %s ready", r.host.ID())
+	return nil
+}
+
+// Stop ends every session, releases the relay reservation and leaves the network
+func (r *Runner) Stop(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.started || r.stopped {
+		r.mu.Unlock()
+		return nil
+	}
+	r.stopped = true
+	r.mu.Unlock()
+
+	var errs []error
+	if r.stopControl != nil {
+		errs = append(errs, r.stopControl(ctx))
+	}
+	if r.protocol != nil {
+		r.protocol.EndSessions(ctx)
+	}
+	r.cancel()
+	if r.presence != nil {
+		errs = append(errs, r.presence.Close())
+	}
+	// a circuit v2 reservation lives as long as our connection to the relay
+	if k := r.keeper.Load(); r.host != nil && k != nil {
+		errs = append(errs, r.host.Network().ClosePeer(k.Relay().ID))
+	}
+	if r.stopProbes != nil {
+		errs = append(errs, r.stopProbes(ctx))
+	}
+	if r.dht != nil {
+		if r.store != nil {
+			errs = append(errs, r.store.SaveRoutingTable(ctx, r.dht))
+		}
+		errs = append(errs, r.dht.Close())
+	}
+	if r.host != nil {
+		errs = append(errs, r.host.Close())
+	}
+	if r.store != nil {
+		errs = append(errs, r.store.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// SessionStatus is a running session
+type SessionStatus struct {
+	Session
+	Duration time.Duration
+}
+
+// Status is a snapshot of the runner
+type Status struct {
+	ID       string
+	Addrs    []string
+	Projects []string
+	Region   string
+	Capacity int
+	Sources  []string
+	Sessions []SessionStatus
+	// ReservationExpiry is when the relay reservation runs out, zero without one,
+	// it moves forward each time the reservation is renewed
+	ReservationExpiry time.Time
+	// ManifestVersion is the network manifest in use, zero without one
+	ManifestVersion uint64
+	// HolePunches are the hole punch totals with our clients
+	HolePunches cmn.HolePunchStats
+	// Public is true while we are publicly reachable, see Config.Reachability
+	Public bool
+}
+
+// Status reports who we are and what we are streaming
+func (r *Runner) Status() Status {
+	r.mu.Lock()
+	st := Status{
+		Projects: r.attrs.Projects,
+		Region:   r.attrs.Region,
+		Capacity: r.attrs.Capacity,
+		Sources:  r.sources.names(),
+	}
+	now := time.Now()
+	for _, active := range r.sessions {
+		st.Sessions = append(st.Sessions, SessionStatus{Session: *active.session, Duration: now.Sub(active.session.Started)})
+	}
+	r.mu.Unlock()
+	sort.Slice(st.Sessions, func(i, j int) bool { return st.Sessions[i].Started.Before(st.Sessions[j].Started) })
+
+	if r.host != nil {
+		st.ID = r.host.ID().String()
+		for _, a := range r.host.Addrs() {
+			st.Addrs = append(st.Addrs, a.String())
+		}
+	}
+	if _, rsvp := r.reservation(); rsvp != nil {
+		st.ReservationExpiry = rsvp.Expiration
+	}
+	if r.diagnostics != nil {
+		st.HolePunches = r.diagnostics.HolePunchStats().Total
+	}
+	st.Public = r.Public()
+	if r.manifest != nil {
+		if m := r.manifest.Current(); m != nil {
+			st.ManifestVersion = m.Version
+		}
+	}
+	return st
+}
+
+// PeerStatus is a connection to a peer
+type PeerStatus struct {
+	ID        string
+	Role      string
+	Addr      string
+	Transport string
+	Direction string
+	Limited   bool
+	Opened    time.Time
+}
+
+// Peers lists our connections and the transport each one uses
+func (r *Runner) Peers() []PeerStatus {
+	if r.host == nil {
+		return nil
+	}
+	var out []PeerStatus
+	for _, conn := range r.host.Network().Conns() {
+		pid := conn.RemotePeer()
+		stat := conn.Stat()
+		out = append(out, PeerStatus{
+			ID:        pid.String(),
+			Role:      r.classifier.Classify(pid).String(),
+			Addr:      conn.RemoteMultiaddr().String(),
+			Transport: cmn.ConnTransport(conn),
+			Direction: stat.Direction.String(),
+			Limited:   stat.Limited,
+			Opened:    stat.Opened,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// ReservationStatus is a reservation we hold on a relay
+type ReservationStatus struct {
+	Relay     string
+	Connected bool
+	Expiry    time.Time
+	Addrs     []string
+	// LimitDuration and LimitData are how long and how many bytes each way the relay
+	// carries a circuit to us, zero is unlimited
+	LimitDuration time.Duration
+	LimitData     uint64
+}
+
+// Reservations lists our relay reservations
+func (r *Runner) Reservations() []ReservationStatus {
+	relayID, rsvp := r.reservation()
+	if rsvp == nil {
+		return nil
+	}
+	st := ReservationStatus{
+		Relay:         relayID.String(),
+		Connected:     r.host.Network().Connectedness(relayID) == network.Connected,
+		Expiry:        rsvp.Expiration,
+		LimitDuration: rsvp.LimitDuration,
+		LimitData:     rsvp.LimitData,
+	}
+	for _, a := range rsvp.Addrs {
+		st.Addrs = append(st.Addrs, a.String())
+	}
+	return []ReservationStatus{st}
+}
+
+// Diagnose reports our NAT traversal state, see cmn.NATReport. it runs an AutoNAT v2
+// check on each of our addrs so it may take a few seconds
+func (r *Runner) Diagnose(ctx context.Context) (cmn.NATReport, error) {
+	if r.diagnostics == nil {
+		return cmn.NATReport{}, errors.New("runner is not started")
+	}
+	report, err := r.diagnostics.Report(ctx, r.relayCandidates("")...)
+	if err != nil {
+		return report, err
+	}
+	relayID, rsvp := r.reservation()
+	for i := range report.Relays {
+		if rsvp != nil && report.Relays[i].Relay == relayID.String() {
+			report.Relays[i].Expiry = rsvp.Expiration
+		}
+	}
+	return report, nil
+}
+
+// EndSession force stops the session of a client, telling it the stream ended within ctx
+func (r *Runner) EndSession(ctx context.Context, client string) error {
+	pid, err := peer.Decode(client)
+	if err != nil {
+		return fmt.Errorf("bad client id: %w", err)
+	}
+	if r.protocol == nil || !r.protocol.EndSession(ctx, pid) {
+		return fmt.Errorf("no session with %s", pid)
+	}
+	return nil
+}
+
+// SetCapacity changes how many sessions we take and advertise, running sessions are kept
+func (r *Runner) SetCapacity(n int) error {
+	if n < 1 {
+		return fmt.Errorf("capacity must be at least 1, got %d", n)
+	}
+	r.mu.Lock()
+	r.attrs.Capacity = n
+	attrs := r.attrs
+	r.mu.Unlock()
+
+	if r.protocol != nil {
+		r.protocol.SetCapacity(n)
+		r.protocol.SetSystemConfig(attrs.SystemConfig())
+	}
+	r.Readvertise()
+	log.Infof("capacity set to %d", n)
+	return nil
+}
+
+// Readvertise advertises us again now instead of waiting for the next round
+func (r *Runner) Readvertise() {
+	if r.announcer != nil {
+		r.announcer.Readvertise()
+	}
+	r.updatePresence()
+}
+
+// updatePresence publishes our sessions and capacity on the presence channel now
+func (r *Runner) updatePresence() {
+	if r.publisher != nil {
+		r.publisher.Update()
+	}
+}
+
+// presenceState is what we publish on the presence channel
+func (r *Runner) presenceState() presence.Presence {
+	r.mu.Lock()
+	p := presence.Presence{Attrs: r.attrs, Sessions: len(r.sessions)}
+	r.mu.Unlock()
+	for _, a := range r.host.Addrs() {
+		p.Addrs = append(p.Addrs, a.String())
+	}
+	return p
+}
+
+// serveData sends the content of the session of from over its data stream, when
+// its source is a Sender
+func (r *Runner) serveData(s network.Stream, from peer.ID) {
+	r.mu.Lock()
+	active, ok := r.sessions[from]
+	r.mu.Unlock()
+	var sender Sender
+	if ok {
+		sender, _ = active.source.(Sender)
+	}
+	if sender == nil {
+		log.Warnf("no data to send to %s", from)
+		s.Reset()
+		return
+	}
+
+	if err := sender.Send(active.ctx, active.session, s); err != nil {
+		log.Warnf("sending %s to %s: %v", active.session.Source, from, err)
+		s.Reset()
+		return
+	}
+	s.Close()
+}
+
+// controller serves the sessions the ping protocol accepts
+type controller struct {
+	r *Runner
+}
+
+func (c controller) StartStream(from peer.ID, req *p2p.StartStreamRequest) error {
+	r := c.r
+	s := &Session{
+		Client:    from.String(),
+		ProjectID: req.GetId().GetProjectId(),
+		DevID:     req.GetId().GetDevId(),
+		APIKey:    req.GetId().GetApiKey(),
+		IssueNeed: req.GetRequestIssueNeed(),
+		Options:   req.GetConfigOptions(),
+		Started:   time.Now(),
+	}
+
+	r.mu.Lock()
+	serves := r.attrs.Serves(s.ProjectID)
+	onStart := append([]func(*Session) error{}, r.onStart...)
+	r.mu.Unlock()
+	if !serves {
+		return fmt.Errorf("project %q not served", s.ProjectID)
+	}
+
+	name, src, err := r.sources.lookup(s.Options[SourceOption])
+	if err != nil {
+		return err
+	}
+	s.Source = name
+
+	for _, fn := range onStart {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	if src != nil {
+		if err := src.Open(ctx, s); err != nil {
+			cancel()
+			return fmt.Errorf("source %s: %w", name, err)
+		}
+	}
+
+	r.mu.Lock()
+	r.sessions[from] = &activeSession{session: s, source: src, ctx: ctx, cancel: cancel}
+	r.mu.Unlock()
+	r.updatePresence()
+	log.Infof("streaming %s to %s from source %q", s.ProjectID, from, name)
+	return nil
+}
+
+func (c controller) StopStream(from peer.ID, id *p2p.Id) {
+	r := c.r
+	r.mu.Lock()
+	active, ok := r.sessions[from]
+	delete(r.sessions, from)
+	onStop := append([]func(*Session){}, r.onStop...)
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	active.cancel()
+	if active.source != nil {
+		if err := active.source.Close(active.session); err != nil {
+			log.Warnf("closing source %s for %s: %v", active.session.Source, from, err)
+		}
+	}
+	for _, fn := range onStop {
+		fn(active.session)
+	}
+	r.updatePresence()
+	log.Infof("stopped streaming to %s", from)
+}
@@ -0,0 +1,180 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	ping "mnwarm/internal/ping"
+	p2p "mnwarm/internal/ping/pb"
+)
+
+type fakeSource struct {
+	opened, closed int
+	err            error
+}
+
+func (f *fakeSource) Open(ctx context.Context, s *Session) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.opened++
+	return nil
+}
+
+func (f *fakeSource) Close(s *Session) error {
+	f.closed++
+	return nil
+}
+
+func newTestRunner(t *testing.T) *Runner {
+	cfg := NewConfig()
+	cfg.Relay = "/ip4/127.0.0.1/tcp/4001"
+	cfg.Projects = []string{"p1"}
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func startRequest(project string, options map[string]string) *p2p.StartStreamRequest {
+	return &p2p.StartStreamRequest{
+		Id:            &p2p.Id{ProjectId: project},
+		ConfigOptions: options,
+	}
+}
+
+func TestNewRequiresRelay(t *testing.T) {
+	if _, err := New(NewConfig()); err == nil {
+		t.Error("expected an error without a relay")
+	}
+}
+
+func TestSources(t *testing.T) {
+	r := newTestRunner(t)
+	if err := r.RegisterSource("camera", &fakeSource{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RegisterSource("screen", &fakeSource{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RegisterSource("camera", &fakeSource{}); err == nil {
+		t.Error("expected an error registering a source twice")
+	}
+	if got := r.Sources(); len(got) != 2 || got[0] != "camera" || got[1] != "screen" {
+		t.Errorf("Sources() = %v", got)
+	}
+
+	if name, _, err := r.sources.lookup(""); err != nil || name != "camera" {
+		t.Errorf("default source = %q, %v, want camera", name, err)
+	}
+	if _, _, err := r.sources.lookup("mic"); err == nil {
+		t.Error("expected an error for an unknown source")
+	}
+}
+
+func TestStreamCallbacks(t *testing.T) {
+	r := newTestRunner(t)
+	camera, screen := &fakeSource{}, &fakeSource{}
+	r.RegisterSource("camera", camera)
+	r.RegisterSource("screen", screen)
+
+	var started, stopped []*Session
+	r.OnStartStream(func(s *Session) error {
+		if s.DevID == "banned" {
+			return errors.New("banned")
+		}
+		started = append(started, s)
+		return nil
+	})
+	r.OnStopStream(func(s *Session) {
+		stopped = append(stopped, s)
+	})
+
+	c := controller{r}
+	pid := peer.ID("client")
+	if err := c.StartStream(pid, startRequest("p2", nil)); err == nil {
+		t.Error("expected a project we don't serve to be rejected")
+	}
+	banned := startRequest("p1", nil)
+	banned.Id.DevId = "banned"
+	if err := c.StartStream(pid, banned); err == nil {
+		t.Error("expected OnStartStream to reject the stream")
+	}
+
+	if err := c.StartStream(pid, startRequest("p1", map[string]string{SourceOption: "screen"})); err != nil {
+		t.Fatal(err)
+	}
+	if screen.opened != 1 || camera.opened != 0 {
+		t.Errorf("opened camera %d screen %d, want the screen", camera.opened, screen.opened)
+	}
+	if len(started) != 1 || started[0].Source != "screen" || started[0].Client != pid.String() {
+		t.Errorf("started = %+v", started)
+	}
+	if st := r.Status(); len(st.Sessions) != 1 || st.Sessions[0].ProjectID != "p1" {
+		t.Errorf("Status().Sessions = %+v", st.Sessions)
+	}
+
+	c.StopStream(pid, nil)
+	if screen.closed != 1 || len(stopped) != 1 {
+		t.Errorf("closed %d, stopped %d, want 1 each", screen.closed, len(stopped))
+	}
+	if st := r.Status(); len(st.Sessions) != 0 {
+		t.Errorf("Status().Sessions = %+v after stop", st.Sessions)
+	}
+}
+
+// sendingSource sends its content to the client
+type sendingSource struct {
+	fakeSource
+	content string
+}
+
+func (f *sendingSource) Send(ctx context.Context, s *Session, w io.Writer) error {
+	_, err := io.WriteString(w, f.content)
+	return err
+}
+
+func TestSessionData(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatalf("Failed to create mocknet: %v", err)
+	}
+	defer mn.Close()
+	runnerHost, clientHost := mn.Hosts()[0], mn.Hosts()[1]
+
+	r := newTestRunner(t)
+	r.RegisterSource("camera", &sendingSource{content: "frames"})
+	r.protocol = ping.NewPingProtocol(runnerHost, make(chan bool))
+	r.protocol.SetStreamController(controller{r})
+	r.protocol.SetDataHandler(r.serveData)
+	client := ping.NewPingProtocol(clientHost, make(chan bool))
+
+	if s, err := client.OpenDataStream(ctx, runnerHost.ID()); err == nil {
+		if _, err := io.ReadAll(s); err == nil {
+			t.Error("data stream served without a session")
+		}
+	}
+
+	resp, err := client.RequestStartStream(ctx, runnerHost.ID(), "p1", "", "", "", nil)
+	if err != nil || resp.StatusMessage != ping.StatusSuccess {
+		t.Fatalf("RequestStartStream() = %v, %v", resp, err)
+	}
+	s, err := client.OpenDataStream(ctx, runnerHost.ID())
+	if err != nil {
+		t.Fatalf("OpenDataStream() error = %v", err)
+	}
+	defer s.Close()
+	got, err := io.ReadAll(s)
+	if err != nil || string(got) != "frames" {
+		t.Errorf("session data = %q, %v, want frames", got, err)
+	}
+}
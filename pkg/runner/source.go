@@ -0,0 +1,92 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SourceOption is the StartStream config option naming the source a client wants
+const SourceOption = "source"
+
+// Session is a stream a client asked us for
+type Session struct {
+	// Client is the peer id of the client
+	Client    string
+	ProjectID string
+	DevID     string
+	APIKey    string
+	IssueNeed string
+	Options   map[string]string
+	// Source is the name of the registered source serving the session
+	Source  string
+	Started time.Time
+}
+
+// Source produces the stream of a session. Open returns once the stream runs,
+// ctx is canceled when the session ends. Close releases what Open set up
+type Source interface {
+	Open(ctx context.Context, s *Session) error
+	Close(s *Session) error
+}
+
+// Sender is a Source that also sends the content of a session to its client, over
+// the data stream the client opens. Send returns once the content ends or ctx, which
+// is canceled when the session ends, is done
+type Sender interface {
+	Send(ctx context.Context, s *Session, w io.Writer) error
+}
+
+// sources is the registry of named sources, the one registered first is the default
+type sources struct {
+	mu    sync.Mutex
+	named map[string]Source
+	first string
+}
+
+func (r *sources) register(name string, src Source) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.named == nil {
+		r.named = make(map[string]Source)
+	}
+	if _, ok := r.named[name]; ok {
+		return fmt.Errorf("source %q already registered", name)
+	}
+	r.named[name] = src
+	if r.first == "" {
+		r.first = name
+	}
+	return nil
+}
+
+// lookup returns the source named, or the default one when name is empty
+func (r *sources) lookup(name string) (string, Source, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name == "" {
+		name = r.first
+	}
+	src, ok := r.named[name]
+	if !ok {
+		if name == "" {
+			return "", nil, nil
+		}
+		return "", nil, fmt.Errorf("unknown source %q", name)
+	}
+	return name, src, nil
+}
+
+func (r *sources) names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]string, 0, len(r.named))
+	for name := range r.named {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -111,7 +111,7 @@ func StartRunner(ctx context.Context, relayInfo *peer.AddrInfo) (*Runner, error)
 		return nil, fmt.Errorf("connect to relay failed: %w", err)
 	}
 
-	if err := cmn.ReserveRelay(ctx, h, relayInfo); err != nil {
+	if _, err := cmn.ReserveRelay(ctx, h, relayInfo); err != nil {
 		_ = h.Close()
 		return nil, fmt.Errorf("reserve relay failed: %w", err)
 	}
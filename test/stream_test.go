@@ -238,7 +238,7 @@ func TestRelayReservation(t *testing.T) {
 			}
 			defer host.Close()
 
-			err = cmn.ReserveRelay(ctx, host, relayInfo)
+			_, err = cmn.ReserveRelay(ctx, host, relayInfo)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ReserveRelay() error = %v, wantErr %v", err, tt.wantErr)
 			}